@@ -5,6 +5,7 @@ go 1.16
 require (
 	github.com/inercia/kubernetes-e2e-utils v0.0.0-20220707165028-d70af38e4226
 	github.com/phayes/freeport v0.0.0-20220201140144-74d24b5ae9f5
+	github.com/prometheus/client_golang v1.11.1
 	github.com/spf13/cobra v1.4.0
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
@@ -16,4 +17,5 @@ require (
 	k8s.io/klog/v2 v2.60.1
 	k8s.io/kubectl v0.23.0
 	sigs.k8s.io/e2e-framework v0.0.7
+	sigs.k8s.io/yaml v1.3.0
 )
@@ -0,0 +1,166 @@
+package attach
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/pschmitt/kubetnl/pkg/graceful"
+	"github.com/pschmitt/kubetnl/pkg/kube"
+	"github.com/pschmitt/kubetnl/pkg/net"
+	"github.com/pschmitt/kubetnl/pkg/port"
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
+)
+
+var (
+	attachShort = "Attach to the resources of an existing tunnel"
+
+	attachLong = templates.LongDesc(`
+		Attach to the resources of an existing tunnel.
+
+		"kubetnl attach" connects to the service and pod of a tunnel that were created
+		by another kubetnl process, e.g. one that was killed before it could clean up,
+		and becomes the client of the tunnel. No resources are created.
+
+		Without TARGET_ADDR:SERVICE_PORT arguments, every port of the tunnel pod is
+		tunneled to the same port on 127.0.0.1. The port mappings must match the ports
+		of the tunnel.
+
+		The SSH server of the pod must accept the credentials of "kubetnl attach". The
+		password of tunnels created with --ssh-password is read from the pod. For
+		tunnels using public key authentication, pass the private key with
+		--ssh-private-key or --ssh-key-secret. Ephemeral keys generated by "kubetnl
+		tunnel" can not be attached to.
+
+		"kubetnl attach" runs in the foreground. To stop press CTRL+C once. The
+		resources of the tunnel are left in the cluster unless --delete is set.`)
+
+	attachExample = templates.Examples(`
+		# Attach to the tunnel myservice, tunneling every port to the same local port.
+		kubetnl attach myservice
+
+		# Attach to the tunnel myservice, tunneling its port 80 to local port 8080.
+		kubetnl attach myservice 8080:80
+
+		# Attach to the tunnel myservice and delete it when stopped.
+		kubetnl attach --delete myservice`)
+)
+
+type AttachOptions struct {
+	genericclioptions.IOStreams
+
+	TunnelConfig tunnel.TunnelConfig
+}
+
+func NewAttachCommand(f cmdutil.Factory, streams genericclioptions.IOStreams) *cobra.Command {
+	o := &AttachOptions{
+		IOStreams: streams,
+		TunnelConfig: tunnel.TunnelConfig{
+			IOStreams:           streams,
+			LocalAddresses:      []string{"127.0.0.1"},
+			TargetDialTimeout:   10 * time.Second,
+			PortForwardAttempts: 10,
+			DrainTimeout:        30 * time.Second,
+			KeepaliveInterval:   30 * time.Second,
+			RequireAllMappings:  true,
+			Attach:              true,
+
+			PortForwardMaxRetryDuration: 5 * time.Minute,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "attach NAME [TARGET_ADDR:SERVICE_PORT [...[TARGET_ADDR:SERVICE_PORT]]]",
+		Short:   attachShort,
+		Long:    attachLong,
+		Example: attachExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f, cmd, args))
+			o.Run(cmd.Context())
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&o.TunnelConfig.LocalAddresses, "address", o.TunnelConfig.LocalAddresses, "Addresses to listen on for the port-forward to the SSH server of the pod (comma separated). Only accepts IP addresses or localhost as a value.")
+	cmd.Flags().BoolVar(&o.TunnelConfig.AttachCleanup, "delete", o.TunnelConfig.AttachCleanup, "If true, delete the resources of the tunnel when \"kubetnl attach\" is stopped.")
+	cmd.Flags().StringVar(&o.TunnelConfig.SSHUser, "ssh-user", o.TunnelConfig.SSHUser, "The user of the SSH connection to the tunnel pod. Defaults to \"user\".")
+	cmd.Flags().StringVar(&o.TunnelConfig.SSHPassword, "ssh-password", o.TunnelConfig.SSHPassword, "The password of the SSH connection to the tunnel pod. If not set, the password is read from the pod.")
+	cmd.Flags().StringVar(&o.TunnelConfig.SSHPrivateKeyPath, "ssh-private-key", o.TunnelConfig.SSHPrivateKeyPath, "Path of the private key used to authenticate the SSH connection to the tunnel pod, for tunnels using public key authentication.")
+	cmd.Flags().StringVar(&o.TunnelConfig.SSHKeySecret, "ssh-key-secret", o.TunnelConfig.SSHKeySecret, "Read the private key used to authenticate the SSH connection to the tunnel pod from this key of a Secret in the namespace of the tunnel, in the format NAME/KEY. Can not be used with --ssh-private-key.")
+	cmd.Flags().StringVar(&o.TunnelConfig.SSHKeyPassphrase, "ssh-key-passphrase", o.TunnelConfig.SSHKeyPassphrase, "The passphrase of the private key set with --ssh-private-key or --ssh-key-secret if it is encrypted.")
+	cmd.Flags().BoolVar(&o.TunnelConfig.InsecureSkipHostKeyCheck, "insecure-skip-host-key-check", o.TunnelConfig.InsecureSkipHostKeyCheck, "If true, accept any SSH host key if the host key can not be read from the tunnel pod, e.g. because of missing permissions to create pods/exec. This allows to intercept the SSH connection.")
+	cmd.Flags().DurationVar(&o.TunnelConfig.TargetDialTimeout, "target-dial-timeout", o.TunnelConfig.TargetDialTimeout, "The timeout for connecting to the target of a port mapping. Connections that can not be established within this duration are closed. Zero means no timeout.")
+	cmd.Flags().DurationVar(&o.TunnelConfig.KeepaliveInterval, "ssh-keepalive-interval", o.TunnelConfig.KeepaliveInterval, "The interval SSH keepalive requests are sent to the tunnel pod at. If a request is not answered within the interval, the connection is considered dead and re-established. Zero disables keepalives and thus reconnecting.")
+	cmd.Flags().DurationVar(&o.TunnelConfig.DrainTimeout, "drain-timeout", o.TunnelConfig.DrainTimeout, "The time active connections are given to finish when the tunnel is stopped. Connections still active afterwards are closed. Zero means to wait until all connections finished.")
+
+	return cmd
+}
+
+func (o *AttachOptions) Complete(f cmdutil.Factory, cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return cmdutil.UsageErrorf(cmd, "NAME of the tunnel is required for attach")
+	}
+	c := &o.TunnelConfig
+	c.Name = args[0]
+	c.RawPortMappings = args[1:]
+	var err error
+	if c.PortMappings, err = port.ParseMappings(c.RawPortMappings); err != nil {
+		return err
+	}
+	if err := port.CheckDuplicates(c.PortMappings); err != nil {
+		return err
+	}
+	if c.SSHKeySecret != "" {
+		if c.SSHPrivateKeyPath != "" {
+			return fmt.Errorf("--ssh-key-secret and --ssh-private-key are mutually exclusive")
+		}
+		if err := tunnel.ValidateSSHKeySecret(c.SSHKeySecret); err != nil {
+			return err
+		}
+	}
+	c.Namespace, c.EnforceNamespace, err = kube.Namespace(f.ToRawKubeConfigLoader())
+	if err != nil {
+		return err
+	}
+	c.RESTConfig, err = f.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	c.ClientSet, err = f.KubernetesClientSet()
+	if err != nil {
+		return err
+	}
+	c.LocalSSHPort, err = net.GetFreeLocalPort(net.PortRange{})
+	if err != nil {
+		return fmt.Errorf("error choosing the local port for the SSH connection: %v", err)
+	}
+	return nil
+}
+
+func (o *AttachOptions) Run(ctx context.Context) {
+	ctx, cancel := graceful.WithKill(ctx)
+	defer cancel()
+	ctx, interruptCancel := graceful.WithInterrupt(ctx)
+	defer interruptCancel()
+
+	o.TunnelConfig.ContinueOnTunnelError = !o.TunnelConfig.RequireAllMappings
+	tun := tunnel.NewTunnel(o.TunnelConfig)
+	if _, err := tun.Run(ctx); err != nil {
+		// Stop only deletes the resources with --delete. CheckErr
+		// exits without running deferred functions.
+		tun.Stop(context.Background())
+		cmdutil.CheckErr(err)
+	}
+	defer tun.Stop(context.Background())
+
+	select {
+	case <-ctx.Done():
+	case <-tun.Done():
+		tun.Stop(context.Background())
+		cmdutil.CheckErr(tun.Err())
+	}
+}
@@ -2,6 +2,7 @@ package cleanup
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -11,7 +12,10 @@ import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/cli-runtime/pkg/printers"
 	"k8s.io/cli-runtime/pkg/resource"
@@ -20,14 +24,19 @@ import (
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	cmdwait "k8s.io/kubectl/pkg/cmd/wait"
 	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/pschmitt/kubetnl/pkg/kube"
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
 )
 
 type CleanupOptions struct {
 	genericclioptions.IOStreams
 
+	Name             string
 	Namespace        string
 	EnforceNamespace bool
 	AllNamespaces    bool
+	DryRun           bool
 	ForceDeletion    bool
 	GracePeriod      int
 	WaitForDeletion  bool
@@ -48,8 +57,12 @@ var (
 		created tunnels. Pods and services might, in rare cases, fail to be
 		cleaned up correctly e.g. because of a broken internet connection.
 
-		This command will delete all pods and services that have a label with the key 
-		"io.github.kubetnl" in the selected namespace.
+		This command will delete all deployments, pods, services, config maps and service accounts
+		that have a label with the key "io.github.kubetnl" in the selected namespace.
+		If NAME is given, only the resources of the tunnel NAME are deleted. The
+		finalizer of services created with "kubetnl tunnel --protect" is removed.
+		Services reused with "kubetnl tunnel --reuse-service" that were not created
+		by kubetnl are kept.
 
 		Note that this will also destroy any actively running tunnels.`)
 
@@ -57,6 +70,12 @@ var (
 		# Cleanup all kubetnl resources in the current namespace.
 		kubetnl cleanup
 
+		# Cleanup the resources of the tunnel myservice in the current namespace.
+		kubetnl cleanup myservice
+
+		# List the kubetnl resources in the current namespace that would be deleted.
+		kubetnl cleanup --dry-run
+
 		# Cleanup all kubetnl resources in the "hello" namespace.
 		kubetnl cleanup -n hello
 
@@ -72,21 +91,22 @@ func NewCleanupCommand(f cmdutil.Factory, streams genericclioptions.IOStreams) *
 	}
 
 	cmd := &cobra.Command{
-		Use:     "cleanup [options]",
+		Use:     "cleanup [NAME] [options]",
 		Short:   cleanupShort,
 		Long:    cleanupLong,
 		Example: cleanupExamples,
 		Run: func(cmd *cobra.Command, args []string) {
-			cmdutil.CheckErr(o.Complete(f))
+			cmdutil.CheckErr(o.Complete(f, cmd, args))
 			cmdutil.CheckErr(o.Validate())
 			cmdutil.CheckErr(o.Run(cmd.Context()))
 		},
 	}
 
-	cmd.Flags().BoolVarP(&o.AllNamespaces, "all-namespaces", "A", o.AllNamespaces, "If present, list the requested object(s) across all namespaces. Namespace in current context is ignored even if specified with --namespace.")
+	cmd.Flags().BoolVarP(&o.AllNamespaces, "all-namespaces", "A", o.AllNamespaces, "If present, delete the resources of tunnels across all namespaces. Namespace in current context is ignored even if specified with --namespace.")
 	cmd.Flags().BoolVar(&o.ForceDeletion, "force", o.ForceDeletion, "If true, immediately remove resources from API and bypass graceful deletion. Note that immediate deletion of some resources may result in inconsistency or data loss and requires confirmation.")
 	cmd.Flags().IntVar(&o.GracePeriod, "grace-period", o.GracePeriod, "Period of time in seconds given to the resource to terminate gracefully. Ignored if negative. Set to 1 for immediate shutdown. Can only be set to 0 when --force is true (force deletion).")
 	cmd.Flags().BoolVar(&o.WaitForDeletion, "wait", o.WaitForDeletion, "If true, wait for resources to be gone before returning. This waits for finalizers.")
+	cmd.Flags().BoolVar(&o.DryRun, "dry-run", o.DryRun, "If true, only print the resources that would be deleted without deleting them.")
 	// TODO quiet flag
 
 	return cmd
@@ -102,12 +122,24 @@ func (o *CleanupOptions) Validate() error {
 	return nil
 }
 
-func (o *CleanupOptions) Complete(f cmdutil.Factory) (err error) {
-	o.Namespace, o.EnforceNamespace, err = f.ToRawKubeConfigLoader().Namespace()
+func (o *CleanupOptions) Complete(f cmdutil.Factory, cmd *cobra.Command, args []string) (err error) {
+	if len(args) > 1 {
+		return cmdutil.UsageErrorf(cmd, "at most one NAME may be specified")
+	}
+	if len(args) == 1 {
+		o.Name = args[0]
+		if errs := validation.IsDNS1035Label(o.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid NAME %q: %s", o.Name, strings.Join(errs, ", "))
+		}
+	}
+	o.Namespace, o.EnforceNamespace, err = kube.Namespace(f.ToRawKubeConfigLoader())
 	if err != nil {
 		return err
 	}
 	req, _ := labels.NewRequirement("io.github.kubetnl", selection.Exists, []string{})
+	if o.Name != "" {
+		req, _ = labels.NewRequirement("io.github.kubetnl", selection.Equals, []string{o.Name})
+	}
 	selector := labels.NewSelector().Add(*req)
 
 	o.Result = f.NewBuilder().
@@ -115,8 +147,8 @@ func (o *CleanupOptions) Complete(f cmdutil.Factory) (err error) {
 		ContinueOnError().
 		NamespaceParam(o.Namespace).DefaultNamespace().
 		LabelSelector(selector.String()).
-		AllNamespaces(false).
-		ResourceTypeOrNameArgs(true, "pod,service,configmap").RequireObject(false).
+		AllNamespaces(o.AllNamespaces).
+		ResourceTypeOrNameArgs(true, "deployment,pod,service,configmap,serviceaccount").RequireObject(false).
 		Flatten().
 		Do()
 	err = o.Result.Err()
@@ -139,7 +171,24 @@ func (o *CleanupOptions) Run(ctx context.Context) error {
 			// If there was a problem walking the list of resources.
 			return err
 		}
+		if isReusedService(info) {
+			// The Service was created by the user and only reused
+			// by a tunnel, see tunnel.ManagedAnnotation. A finalizer
+			// left behind by --protect is still removed.
+			klog.V(1).Infof("Keeping Service %q which was not created by kubetnl.", info.Name)
+			if o.DryRun {
+				return nil
+			}
+			return removeProtectFinalizer(info)
+		}
 		deletedInfos = append(deletedInfos, info)
+		if o.DryRun {
+			o.PrintObj(info)
+			return nil
+		}
+		if err := removeProtectFinalizer(info); err != nil {
+			return err
+		}
 		options := &metav1.DeleteOptions{}
 		if o.GracePeriod >= 0 {
 			options = metav1.NewDeleteOptions(int64(o.GracePeriod))
@@ -181,7 +230,7 @@ func (o *CleanupOptions) Run(ctx context.Context) error {
 		fmt.Fprintf(o.Out, "No resources found\n")
 		return nil
 	}
-	if !o.WaitForDeletion {
+	if !o.WaitForDeletion || o.DryRun {
 		return nil
 	}
 	waitOptions := cmdwait.WaitOptions{
@@ -204,6 +253,54 @@ func (o *CleanupOptions) Run(ctx context.Context) error {
 	return err
 }
 
+// isReusedService reports whether the resource of info is a Service that
+// carries the label of a tunnel but lacks the tunnel.ManagedAnnotation, i.e.
+// a Service of the user adopted with --reuse-service.
+func isReusedService(info *resource.Info) bool {
+	if info.Mapping.GroupVersionKind.GroupKind() != (schema.GroupKind{Kind: "Service"}) {
+		return false
+	}
+	obj, err := meta.Accessor(info.Object)
+	if err != nil {
+		return false
+	}
+	return obj.GetAnnotations()[tunnel.ManagedAnnotation] != "true"
+}
+
+// removeProtectFinalizer removes the finalizer of protected tunnels from the
+// resource of info, which is left behind if kubetnl did not stop gracefully.
+func removeProtectFinalizer(info *resource.Info) error {
+	obj, err := meta.Accessor(info.Object)
+	if err != nil {
+		return nil
+	}
+	finalizers := []string{}
+	for _, f := range obj.GetFinalizers() {
+		if f != tunnel.ProtectFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	if len(finalizers) == len(obj.GetFinalizers()) {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": obj.GetResourceVersion(),
+			"finalizers":      finalizers,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = resource.
+		NewHelper(info.Client, info.Mapping).
+		Patch(info.Namespace, info.Name, types.MergePatchType, patch, nil)
+	if err != nil {
+		return fmt.Errorf("error removing finalizer %q of %s %q: %v", tunnel.ProtectFinalizer, info.Mapping.Resource.Resource, info.Name, err)
+	}
+	return nil
+}
+
 func (o *CleanupOptions) PrintObj(info *resource.Info) {
 	groupKind := info.Mapping.GroupVersionKind
 	kindString := fmt.Sprintf("%s.%s", strings.ToLower(groupKind.Kind), groupKind.Group)
@@ -214,5 +311,12 @@ func (o *CleanupOptions) PrintObj(info *resource.Info) {
 	if o.GracePeriod == 0 {
 		operation = "force deleted"
 	}
+	if o.DryRun {
+		operation += " (dry run)"
+	}
+	if o.AllNamespaces {
+		fmt.Fprintf(o.Out, "%s \"%s\" %s in namespace %q\n", kindString, info.Name, operation, info.Namespace)
+		return
+	}
 	fmt.Fprintf(o.Out, "%s \"%s\" %s\n", kindString, info.Name, operation)
 }
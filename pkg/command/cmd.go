@@ -11,8 +11,12 @@ import (
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/util/templates"
 
+	"github.com/pschmitt/kubetnl/pkg/command/attach"
 	"github.com/pschmitt/kubetnl/pkg/command/cleanup"
+	"github.com/pschmitt/kubetnl/pkg/command/list"
 	"github.com/pschmitt/kubetnl/pkg/command/options"
+	"github.com/pschmitt/kubetnl/pkg/command/prewarm"
+	"github.com/pschmitt/kubetnl/pkg/command/status"
 	"github.com/pschmitt/kubetnl/pkg/command/tunnel"
 	"github.com/pschmitt/kubetnl/pkg/command/version"
 )
@@ -68,7 +72,11 @@ func NewKubetnlCommand(in io.Reader, out, err io.Writer) *cobra.Command {
 			Message: "Basic commands",
 			Commands: []*cobra.Command{
 				tunnel.NewTunnelCommand(f, streams),
+				attach.NewAttachCommand(f, streams),
+				list.NewListCommand(f, streams),
+				status.NewStatusCommand(f, streams),
 				cleanup.NewCleanupCommand(f, streams),
+				prewarm.NewPrewarmCommand(f, streams),
 			},
 		},
 	}
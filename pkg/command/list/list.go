@@ -0,0 +1,236 @@
+package list
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/cli-runtime/pkg/printers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubectl/pkg/cmd/get"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/pschmitt/kubetnl/pkg/kube"
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
+)
+
+type ListOptions struct {
+	genericclioptions.IOStreams
+
+	PrintFlags *get.PrintFlags
+
+	Namespace     string
+	AllNamespaces bool
+	Watch         bool
+
+	ClientSet *kubernetes.Clientset
+}
+
+var (
+	listShort = "List the tunnels in the cluster"
+
+	listLong = templates.LongDesc(`
+		List the tunnels in the cluster.
+
+		Tunnels are identified by the resources that have a label with the key
+		"io.github.kubetnl". The output formats follow the conventions of
+		"kubectl get".`)
+
+	listExample = templates.Examples(`
+		# List all tunnels in the current namespace.
+		kubetnl list
+
+		# List all tunnels in all namespaces including the image and node.
+		kubetnl list -A -o wide
+
+		# Print the tunnels in the current namespace as YAML.
+		kubetnl list -o yaml
+
+		# Watch the tunnels in all namespaces, redrawing the table whenever a tunnel changes.
+		kubetnl list -A --watch
+
+		# Print the service ports of all tunnels.
+		kubetnl list -o custom-columns=NAME:.metadata.name,PORTS:.spec.ports[*].port`)
+)
+
+func NewListCommand(f cmdutil.Factory, streams genericclioptions.IOStreams) *cobra.Command {
+	o := &ListOptions{
+		IOStreams:  streams,
+		PrintFlags: get.NewGetPrintFlags(),
+	}
+
+	cmd := &cobra.Command{
+		Use:     "list [options]",
+		Aliases: []string{"ls"},
+		Short:   listShort,
+		Long:    listLong,
+		Example: listExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f))
+			cmdutil.CheckErr(o.Run(cmd.Context()))
+		},
+	}
+
+	o.PrintFlags.AddFlags(cmd)
+	cmd.Flags().BoolVarP(&o.AllNamespaces, "all-namespaces", "A", o.AllNamespaces, "If present, list the tunnels across all namespaces. Namespace in current context is ignored even if specified with --namespace.")
+	cmd.Flags().BoolVarP(&o.Watch, "watch", "w", o.Watch, "If present, keep running and print the tunnels again whenever tunnels are created, change or are deleted. Human readable output is redrawn, all other formats print the whole list on every change.")
+
+	return cmd
+}
+
+func (o *ListOptions) Complete(f cmdutil.Factory) (err error) {
+	o.Namespace, _, err = kube.Namespace(f.ToRawKubeConfigLoader())
+	if err != nil {
+		return err
+	}
+	if o.AllNamespaces {
+		o.Namespace = ""
+		o.PrintFlags.EnsureWithNamespace()
+	}
+	o.ClientSet, err = f.KubernetesClientSet()
+	return err
+}
+
+func (o *ListOptions) Run(ctx context.Context) error {
+	printer, err := o.PrintFlags.ToPrinter()
+	if err != nil {
+		return err
+	}
+	if o.Watch {
+		return o.watch(ctx, printer)
+	}
+
+	infos, err := tunnel.ListTunnels(ctx, o.ClientSet, o.Namespace)
+	if err != nil {
+		return err
+	}
+	return o.print(printer, infos)
+}
+
+// watch prints the tunnels whenever they change until ctx is done or
+// printing fails.
+func (o *ListOptions) watch(ctx context.Context, printer printers.ResourcePrinter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var printErr error
+	err := tunnel.WatchTunnels(ctx, o.ClientSet, o.Namespace, func(infos []tunnel.TunnelInfo) {
+		if o.isHumanReadable() {
+			// Clear the screen and move the cursor to the top left.
+			fmt.Fprint(o.Out, "\033[H\033[2J")
+		}
+		if printErr = o.print(printer, infos); printErr != nil {
+			cancel()
+		}
+	})
+	if printErr != nil {
+		return printErr
+	}
+	return err
+}
+
+func (o *ListOptions) print(printer printers.ResourcePrinter, infos []tunnel.TunnelInfo) error {
+	if len(infos) == 0 && o.isHumanReadable() {
+		fmt.Fprintf(o.ErrOut, "No tunnels found\n")
+		return nil
+	}
+	obj, err := o.toObject(infos)
+	if err != nil {
+		return err
+	}
+	return printer.PrintObj(obj, o.Out)
+}
+
+func (o *ListOptions) isHumanReadable() bool {
+	format := ""
+	if o.PrintFlags.OutputFormat != nil {
+		format = *o.PrintFlags.OutputFormat
+	}
+	return format == "" || format == "wide"
+}
+
+// toObject converts infos into an object suitable for the printer returned by
+// o.PrintFlags: A table for the human readable formats and an unstructured
+// list for all other formats.
+func (o *ListOptions) toObject(infos []tunnel.TunnelInfo) (runtime.Object, error) {
+	items := make([]unstructured.Unstructured, 0, len(infos))
+	for i := range infos {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&infos[i])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, unstructured.Unstructured{Object: u})
+	}
+
+	if !o.isHumanReadable() {
+		list := &unstructured.UnstructuredList{Items: items}
+		list.SetAPIVersion("v1")
+		list.SetKind("List")
+		if len(items) == 1 {
+			return &items[0], nil
+		}
+		return list, nil
+	}
+	return toTable(infos, items), nil
+}
+
+func toTable(infos []tunnel.TunnelInfo, items []unstructured.Unstructured) *metav1.Table {
+	table := &metav1.Table{
+		ColumnDefinitions: []metav1.TableColumnDefinition{
+			{Name: "Name", Type: "string", Format: "name"},
+			{Name: "Ports", Type: "string"},
+			{Name: "Ready", Type: "string"},
+			{Name: "Status", Type: "string"},
+			{Name: "Age", Type: "string"},
+			{Name: "Cluster-IP", Type: "string", Priority: 1},
+			{Name: "Node", Type: "string", Priority: 1},
+			{Name: "Image", Type: "string", Priority: 1},
+		},
+	}
+	for i, info := range infos {
+		var ports []string
+		for _, p := range info.Spec.Ports {
+			ports = append(ports, fmt.Sprintf("%d/%s", p.Port, p.Protocol))
+		}
+		ready := "0/1"
+		if info.Status.Ready {
+			ready = "1/1"
+		}
+		table.Rows = append(table.Rows, metav1.TableRow{
+			Cells: []interface{}{
+				info.Name,
+				orNone(strings.Join(ports, ",")),
+				ready,
+				orNone(string(info.Status.Phase)),
+				translateTimestampSince(info.CreationTimestamp),
+				orNone(info.Status.ClusterIP),
+				orNone(info.Status.Node),
+				orNone(info.Spec.Image),
+			},
+			Object: runtime.RawExtension{Object: &items[i]},
+		})
+	}
+	return table
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+func translateTimestampSince(timestamp metav1.Time) string {
+	if timestamp.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(timestamp.Time))
+}
@@ -0,0 +1,145 @@
+package prewarm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/pschmitt/kubetnl/pkg/graceful"
+	"github.com/pschmitt/kubetnl/pkg/kube"
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
+)
+
+var (
+	prewarmShort = "Create an idle tunnel pod to speed up subsequent tunnels"
+
+	prewarmLong = templates.LongDesc(`
+		Create an idle tunnel pod to speed up subsequent tunnels.
+
+		"kubetnl prewarm" creates the pod that serves the SSH server for a tunnel and
+		waits until it is ready, causing the cluster to pull the image. The pod is left
+		running idle and labeled with "io.github.kubetnl/prewarmed".
+
+		A tunnel that is started with "kubetnl tunnel --use-prewarmed" adopts a
+		prewarmed pod running the same image instead of creating a new one. The
+		adopted pod is deleted together with the tunnel.
+
+		Use "kubetnl prewarm --cleanup" to delete all prewarmed pods that have not
+		been adopted by a tunnel.`)
+
+	prewarmExample = templates.Examples(`
+		# Create a prewarmed pod in the current namespace.
+		kubetnl prewarm
+
+		# Use the prewarmed pod for a tunnel.
+		kubetnl tunnel --use-prewarmed myservice 8080:80
+
+		# Delete all prewarmed pods in the current namespace.
+		kubetnl prewarm --cleanup`)
+)
+
+type PrewarmOptions struct {
+	genericclioptions.IOStreams
+
+	TunnelConfig tunnel.TunnelConfig
+	Cleanup      bool
+}
+
+func NewPrewarmCommand(f cmdutil.Factory, streams genericclioptions.IOStreams) *cobra.Command {
+	o := &PrewarmOptions{
+		IOStreams: streams,
+		TunnelConfig: tunnel.TunnelConfig{
+			IOStreams:     streams,
+			Image:         tunnel.DefaultTunnelImage,
+			RemoteSSHPort: 2222,
+			PodResources:  tunnel.DefaultPodResources(),
+
+			SeccompProfile:  tunnel.DefaultSeccompProfile,
+			SecurityContext: tunnel.DefaultSecurityContext(),
+
+			ProbeInitialDelay:     tunnel.DefaultProbeInitialDelay,
+			ProbePeriod:           tunnel.DefaultProbePeriod,
+			ProbeFailureThreshold: tunnel.DefaultProbeFailureThreshold,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "prewarm [NAME] [--cleanup]",
+		Short:   prewarmShort,
+		Long:    prewarmLong,
+		Example: prewarmExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f, cmd, args))
+			cmdutil.CheckErr(o.Run(cmd.Context()))
+		},
+	}
+
+	cmd.Flags().StringVar(&o.TunnelConfig.Image, "image", o.TunnelConfig.Image, "The container image thats get deployed to serve a SSH server")
+	cmd.Flags().StringArrayVar(&o.TunnelConfig.ImagePullSecrets, "image-pull-secret", o.TunnelConfig.ImagePullSecrets, "Name of a Secret in the namespace used to pull --image, e.g. from a private registry. Can be repeated.")
+	cmd.Flags().StringVar(&o.TunnelConfig.SSHUser, "ssh-user", o.TunnelConfig.SSHUser, "The user of the SSH server in the pod. Defaults to \"user\".")
+	cmd.Flags().StringVar(&o.TunnelConfig.SSHPassword, "ssh-password", o.TunnelConfig.SSHPassword, "The password of the SSH server in the pod. If not set, a random password is generated. Tunnels without --ssh-password adopt the password of the pod.")
+	cmd.Flags().BoolVar(&o.Cleanup, "cleanup", o.Cleanup, "If true, delete all prewarmed pods that have not been adopted by a tunnel instead of creating a new one.")
+
+	return cmd
+}
+
+func (o *PrewarmOptions) Complete(f cmdutil.Factory, cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return cmdutil.UsageErrorf(cmd, "at most one NAME may be specified")
+	}
+	if len(args) == 1 {
+		if o.Cleanup {
+			return cmdutil.UsageErrorf(cmd, "NAME can not be specified together with --cleanup")
+		}
+		o.TunnelConfig.Name = args[0]
+	} else {
+		o.TunnelConfig.Name = "kubetnl-prewarmed-" + rand.String(5)
+	}
+	var err error
+	o.TunnelConfig.Namespace, o.TunnelConfig.EnforceNamespace, err = kube.Namespace(f.ToRawKubeConfigLoader())
+	if err != nil {
+		return err
+	}
+	o.TunnelConfig.RESTConfig, err = f.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	o.TunnelConfig.ClientSet, err = f.KubernetesClientSet()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *PrewarmOptions) Run(ctx context.Context) error {
+	if o.Cleanup {
+		deleted, err := tunnel.CleanupPrewarmed(ctx, o.TunnelConfig.ClientSet, o.TunnelConfig.Namespace)
+		for _, name := range deleted {
+			fmt.Fprintf(o.Out, "pod %q deleted\n", name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(deleted) == 0 {
+			fmt.Fprintf(o.Out, "No prewarmed pods found\n")
+		}
+		return nil
+	}
+
+	ctx, cancel := graceful.WithInterrupt(ctx)
+	defer cancel()
+
+	tun := tunnel.NewTunnel(o.TunnelConfig)
+	if err := tun.Prewarm(ctx); err != nil {
+		// Do not leave a half-created prewarmed pod behind.
+		tun.Stop(context.Background())
+		return err
+	}
+	fmt.Fprintf(o.Out, "pod %q prewarmed\n", o.TunnelConfig.Name)
+	return nil
+}
@@ -0,0 +1,129 @@
+package status
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/cli-runtime/pkg/printers"
+	"k8s.io/client-go/kubernetes"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/pschmitt/kubetnl/pkg/kube"
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
+)
+
+var (
+	statusShort = "Check the health of a tunnel"
+
+	statusLong = templates.LongDesc(`
+		Check the health of a tunnel.
+
+		"kubetnl status" checks the cluster side state of the tunnel NAME: whether its
+		service exists, whether its pod is ready and whether the service has ready
+		endpoints. Each check is reported as OK or FAIL with the underlying reason,
+		followed by the ports of the tunnel.
+
+		The port-forward and SSH connection of the kubetnl process running the tunnel
+		can not be checked from the cluster. Send SIGUSR2 to the process for a
+		diagnostics snapshot instead.
+
+		Exits with a non-zero status if any check fails.`)
+
+	statusExample = templates.Examples(`
+		# Check the health of the tunnel myservice in the current namespace.
+		kubetnl status myservice`)
+)
+
+type StatusOptions struct {
+	genericclioptions.IOStreams
+
+	Name      string
+	Namespace string
+
+	ClientSet *kubernetes.Clientset
+}
+
+func NewStatusCommand(f cmdutil.Factory, streams genericclioptions.IOStreams) *cobra.Command {
+	o := &StatusOptions{
+		IOStreams: streams,
+	}
+
+	cmd := &cobra.Command{
+		Use:     "status NAME",
+		Short:   statusShort,
+		Long:    statusLong,
+		Example: statusExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f, cmd, args))
+			cmdutil.CheckErr(o.Run(cmd.Context()))
+		},
+	}
+
+	return cmd
+}
+
+func (o *StatusOptions) Complete(f cmdutil.Factory, cmd *cobra.Command, args []string) (err error) {
+	if len(args) != 1 {
+		return cmdutil.UsageErrorf(cmd, "exactly one NAME is required for status")
+	}
+	o.Name = args[0]
+	o.Namespace, _, err = kube.Namespace(f.ToRawKubeConfigLoader())
+	if err != nil {
+		return err
+	}
+	o.ClientSet, err = f.KubernetesClientSet()
+	return err
+}
+
+func (o *StatusOptions) Run(ctx context.Context) error {
+	status, err := tunnel.GetTunnelStatus(ctx, o.ClientSet, o.Namespace, o.Name)
+	if err != nil {
+		return err
+	}
+
+	w := printers.GetNewTabWriter(o.Out)
+	for _, c := range status.Checks {
+		result := "OK"
+		if !c.OK {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result, c.Name, c.Reason)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(status.Ports) > 0 || len(status.ContainerPorts) > 0 {
+		fmt.Fprintf(o.Out, "\nPorts:\n")
+		for _, sp := range status.Ports {
+			fmt.Fprintf(w, "  service port %d/%s\t--> pod port %s\n", sp.Port, sp.Protocol, sp.TargetPort.String())
+		}
+		for _, cp := range status.ContainerPorts {
+			if !targeted(status, cp) {
+				fmt.Fprintf(w, "  pod port %d/%s\t(not in the service)\n", cp.ContainerPort, cp.Protocol)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if !status.Healthy() {
+		return fmt.Errorf("tunnel %q is not healthy", o.Name)
+	}
+	return nil
+}
+
+// targeted reports whether a port of the Service of the tunnel targets cp.
+func targeted(status *tunnel.TunnelStatus, cp corev1.ContainerPort) bool {
+	for _, sp := range status.Ports {
+		if sp.Protocol == cp.Protocol && (sp.TargetPort.IntValue() == int(cp.ContainerPort) || (cp.Name != "" && sp.TargetPort.StrVal == cp.Name)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
+)
+
+// redacted replaces secrets in the output of --show-config.
+const redacted = "<redacted>"
+
+// effectiveConfig is the resolved configuration of a tunnel as printed by
+// --show-config.
+type effectiveConfig struct {
+	Name                  string                       `json:"name"`
+	Namespace             string                       `json:"namespace"`
+	Image                 string                       `json:"image,omitempty"`
+	ImagePullSecrets      []string                     `json:"imagePullSecrets,omitempty"`
+	ExistingPod           string                       `json:"existingPod,omitempty"`
+	UsePrewarmed          bool                         `json:"usePrewarmed"`
+	HostNetwork           bool                         `json:"hostNetwork"`
+	NodeSelector          map[string]string            `json:"nodeSelector,omitempty"`
+	NodeName              string                       `json:"nodeName,omitempty"`
+	Tolerations           []corev1.Toleration          `json:"tolerations,omitempty"`
+	SeccompProfile        string                       `json:"seccompProfile,omitempty"`
+	Resources             *corev1.ResourceRequirements `json:"resources,omitempty"`
+	ContainerName         string                       `json:"containerName,omitempty"`
+	NoInitScript          bool                         `json:"noInitScript,omitempty"`
+	ServiceAccount        string                       `json:"serviceAccount,omitempty"`
+	Env                   []corev1.EnvVar              `json:"env,omitempty"`
+	PodSecurityContext    *corev1.PodSecurityContext   `json:"podSecurityContext,omitempty"`
+	SecurityContext       *corev1.SecurityContext      `json:"securityContext,omitempty"`
+	Labels                map[string]string            `json:"labels,omitempty"`
+	Annotations           map[string]string            `json:"annotations,omitempty"`
+	ServiceType           string                       `json:"serviceType,omitempty"`
+	ServiceAnnotations    map[string]string            `json:"serviceAnnotations,omitempty"`
+	InternalTrafficPolicy string                       `json:"internalTrafficPolicy,omitempty"`
+	PortMappings          []mappingConfig              `json:"portMappings"`
+	SSH                   sshConfig                    `json:"ssh"`
+	Timeouts              timeoutsConfig               `json:"timeouts"`
+	Forwarding            forwardConfig                `json:"forwarding"`
+	ResourceTTL           string                       `json:"resourceTTL,omitempty"`
+	Protect               bool                         `json:"protect"`
+	ReuseService          bool                         `json:"reuseService"`
+	WaitEndpoints         bool                         `json:"waitEndpoints"`
+	FollowLogs            bool                         `json:"followLogs"`
+	Controller            string                       `json:"controller,omitempty"`
+	ConnectionLog         string                       `json:"connectionLog,omitempty"`
+	MetricsAddr           string                       `json:"metricsAddr,omitempty"`
+	ConnectionLogSample   float64                      `json:"connectionLogSample,omitempty"`
+}
+
+type mappingConfig struct {
+	ServicePort string   `json:"servicePort"`
+	Target      string   `json:"target"`
+	Name        string   `json:"name,omitempty"`
+	AppProtocol string   `json:"appProtocol,omitempty"`
+	InService   bool     `json:"inService"`
+	RewriteHost string   `json:"rewriteHost,omitempty"`
+	Allow       []string `json:"allow,omitempty"`
+	Deny        []string `json:"deny,omitempty"`
+}
+
+type sshConfig struct {
+	RemotePort     int      `json:"remotePort"`
+	RemoteBind     string   `json:"remoteBindAddress,omitempty"`
+	LocalPort      int      `json:"localPort"`
+	LocalAddresses []string `json:"localAddresses"`
+	User           string   `json:"user,omitempty"`
+	Auth           string   `json:"auth,omitempty"`
+	Password       string   `json:"password,omitempty"`
+	PrivateKey     string   `json:"privateKey,omitempty"`
+	MaxSessions    int      `json:"maxSessions,omitempty"`
+	MaxStartups    string   `json:"maxStartups,omitempty"`
+
+	InsecureSkipHostKeyCheck bool `json:"insecureSkipHostKeyCheck"`
+}
+
+type timeoutsConfig struct {
+	TargetDial                   string `json:"targetDial"`
+	Drain                        string `json:"drain"`
+	SSHKeepalive                 string `json:"sshKeepalive"`
+	ImagePull                    string `json:"imagePull,omitempty"`
+	PodReady                     string `json:"podReady,omitempty"`
+	Setup                        string `json:"setup,omitempty"`
+	Idle                         string `json:"idle,omitempty"`
+	PodMaxLifetime               string `json:"podMaxLifetime,omitempty"`
+	PortForwardAttempts          int    `json:"portForwardAttempts"`
+	PortForwardMaxRetry          string `json:"portForwardMaxRetryDuration,omitempty"`
+	SSHDialAttempts              int    `json:"sshDialAttempts"`
+	SSHDial                      string `json:"sshDial,omitempty"`
+	SSHConnect                   string `json:"sshConnect"`
+	ProbeInitialDelay            string `json:"probeInitialDelay,omitempty"`
+	ProbePeriod                  string `json:"probePeriod,omitempty"`
+	ProbeFailureThreshold        int32  `json:"probeFailureThreshold,omitempty"`
+	StartupProbe                 bool   `json:"startupProbe"`
+	StartupProbeFailureThreshold int32  `json:"startupProbeFailureThreshold,omitempty"`
+}
+
+type forwardConfig struct {
+	ContinueOnError  bool `json:"continueOnError"`
+	RequireAll       bool `json:"requireAllMappings"`
+	Workers          int  `json:"workers,omitempty"`
+	PrewarmConns     int  `json:"prewarmTargetConns,omitempty"`
+	MaxBufferPerConn int  `json:"maxBufferPerConn,omitempty"`
+	VerifyTLSTarget  bool `json:"verifyTLSTarget"`
+}
+
+// redactEnv returns a copy of env with the values redacted, they may hold
+// secrets passed with --env.
+func redactEnv(env []corev1.EnvVar) []corev1.EnvVar {
+	var out []corev1.EnvVar
+	for _, e := range env {
+		if e.Value != "" {
+			e.Value = redacted
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// printConfig writes the resolved configuration o as YAML to w. Secrets are
+// redacted.
+func printConfig(w io.Writer, o *tunnel.TunnelConfig) error {
+	c := effectiveConfig{
+		Name:                  o.Name,
+		Namespace:             o.Namespace,
+		ExistingPod:           o.ExistingPod,
+		UsePrewarmed:          o.UsePrewarmed,
+		HostNetwork:           o.HostNetwork,
+		NodeSelector:          o.NodeSelector,
+		NodeName:              o.NodeName,
+		Tolerations:           o.Tolerations,
+		SeccompProfile:        o.SeccompProfile,
+		Labels:                o.Labels,
+		Annotations:           o.Annotations,
+		ServiceType:           o.ServiceType,
+		ServiceAnnotations:    o.ServiceAnnotations,
+		InternalTrafficPolicy: o.InternalTrafficPolicy,
+		Protect:               o.Protect,
+		ReuseService:          o.ReuseService,
+		WaitEndpoints:         o.WaitEndpoints,
+		FollowLogs:            o.FollowLogs,
+		Controller:            o.Controller,
+		SSH: sshConfig{
+			RemotePort:     o.RemoteSSHPort,
+			RemoteBind:     o.RemoteBindAddress,
+			LocalPort:      o.LocalSSHPort,
+			LocalAddresses: o.LocalAddresses,
+			MaxSessions:    o.SSHMaxSessions,
+			MaxStartups:    o.SSHMaxStartups,
+
+			InsecureSkipHostKeyCheck: o.InsecureSkipHostKeyCheck,
+		},
+		Timeouts: timeoutsConfig{
+			TargetDial:          o.TargetDialTimeout.String(),
+			Drain:               o.DrainTimeout.String(),
+			SSHKeepalive:        o.KeepaliveInterval.String(),
+			PortForwardAttempts: o.PortForwardAttempts,
+			SSHDialAttempts:     o.SSHDialBackoff.Steps,
+			SSHConnect:          o.SSHConnectTimeout.String(),
+			StartupProbe:        o.StartupProbe,
+		},
+		Forwarding: forwardConfig{
+			ContinueOnError:  o.ContinueOnTunnelError,
+			RequireAll:       o.RequireAllMappings,
+			Workers:          o.ForwarderWorkers,
+			PrewarmConns:     o.PrewarmConns,
+			MaxBufferPerConn: o.MaxBufferPerConn,
+			VerifyTLSTarget:  o.VerifyTLSTarget,
+		},
+		ConnectionLog: o.ConnectionLogPath,
+		MetricsAddr:   o.MetricsAddr,
+	}
+	if o.ExistingPod == "" {
+		c.Image = o.Image
+		c.ImagePullSecrets = o.ImagePullSecrets
+		c.Resources = &o.PodResources
+		c.ContainerName = o.ContainerName
+		c.NoInitScript = o.NoInitScript
+		c.ServiceAccount = o.ServiceAccount
+		c.Env = redactEnv(o.ExtraEnv)
+		c.PodSecurityContext = o.PodSecurityContext
+		c.SecurityContext = o.SecurityContext
+	}
+	if o.ConnectionLogPath != "" {
+		c.ConnectionLogSample = o.ConnectionLogSample
+	}
+	if o.StartupProbe {
+		c.Timeouts.StartupProbeFailureThreshold = o.StartupProbeFailureThreshold
+	}
+	if o.ImagePullTimeout > 0 {
+		c.Timeouts.ImagePull = o.ImagePullTimeout.String()
+	}
+	if o.SSHDialTimeout > 0 {
+		c.Timeouts.SSHDial = o.SSHDialTimeout.String()
+	}
+	if o.ExistingPod == "" {
+		c.Timeouts.ProbeInitialDelay = o.ProbeInitialDelay.String()
+		c.Timeouts.ProbePeriod = o.ProbePeriod.String()
+		c.Timeouts.ProbeFailureThreshold = o.ProbeFailureThreshold
+	}
+	if o.PodReadyTimeout > 0 && o.ExistingPod == "" {
+		c.Timeouts.PodReady = o.PodReadyTimeout.String()
+	}
+	if o.PortForwardMaxRetryDuration > 0 {
+		c.Timeouts.PortForwardMaxRetry = o.PortForwardMaxRetryDuration.String()
+	}
+	if o.IdleTimeout > 0 {
+		c.Timeouts.Idle = o.IdleTimeout.String()
+	}
+	if o.SetupTimeout > 0 {
+		c.Timeouts.Setup = o.SetupTimeout.String()
+	}
+	if o.PodMaxLifetime > 0 {
+		c.Timeouts.PodMaxLifetime = o.PodMaxLifetime.String()
+	}
+	if o.ResourceTTL > 0 {
+		c.ResourceTTL = o.ResourceTTL.String()
+	}
+	// Credentials of other providers are only known once the tunnel runs.
+	switch creds := o.CredentialProvider.(type) {
+	case nil:
+		c.SSH.User = o.SSHUser
+		if c.SSH.User == "" {
+			c.SSH.User = tunnel.DefaultSSHUser
+		}
+		switch {
+		case o.SSHPassword != "":
+			c.SSH.Auth, c.SSH.Password = "password", redacted
+		case o.SSHPrivateKeyPath != "":
+			c.SSH.Auth, c.SSH.PrivateKey = "publickey", o.SSHPrivateKeyPath
+		case o.SSHKeySecret != "":
+			c.SSH.Auth, c.SSH.PrivateKey = "publickey", "secret:"+o.SSHKeySecret
+		case o.UsePrewarmed || o.ExistingPod != "":
+			c.SSH.Auth = "password"
+		default:
+			c.SSH.Auth, c.SSH.PrivateKey = "publickey", "<generated>"
+		}
+	case tunnel.StaticCredentials:
+		c.SSH.User = creds.User
+		if creds.Signer != nil {
+			c.SSH.Auth = "publickey"
+		} else {
+			c.SSH.Auth, c.SSH.Password = "password", redacted
+		}
+	}
+	for _, m := range o.PortMappings {
+		c.PortMappings = append(c.PortMappings, mappingConfig{
+			ServicePort: m.ContainerPort().String(),
+			Target:      m.TargetAddress(),
+			Name:        m.ContainerPortName,
+			AppProtocol: m.AppProtocol,
+			InService:   !m.ServiceHidden,
+			RewriteHost: m.RewriteHost,
+			Allow:       cidrStrings(m.AllowCIDRs),
+			Deny:        cidrStrings(m.DenyCIDRs),
+		})
+	}
+
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("error printing config: %v", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"k8s.io/cli-runtime/pkg/printers"
+
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
+)
+
+// readyOutput describes a ready tunnel as printed by --output json.
+type readyOutput struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Service   string `json:"service,omitempty"`
+
+	// ServiceDNSName is the name of the Service within the cluster. It is
+	// relative to the cluster domain.
+	ServiceDNSName string `json:"serviceDNSName,omitempty"`
+
+	Ports []readyPort `json:"ports"`
+}
+
+type readyPort struct {
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	Name          string `json:"name,omitempty"`
+	Target        string `json:"target"`
+	InService     bool   `json:"inService"`
+}
+
+// validateOutput returns an error if format is not a valid --output.
+func validateOutput(format string) error {
+	switch format {
+	case "", "json":
+		return nil
+	}
+	return fmt.Errorf("invalid --output %q: only \"json\" is supported", format)
+}
+
+// printReady writes the readyOutput of tun as a single line JSON object to w.
+// Only the port mappings that are forwarded are included.
+func printReady(w io.Writer, tun *tunnel.Tunnel) error {
+	out := readyOutput{
+		Name:      tun.Name,
+		Namespace: tun.Namespace,
+		Pod:       tun.PodName(),
+		Service:   tun.ServiceName(),
+		Ports:     []readyPort{},
+	}
+	if out.Service != "" {
+		out.ServiceDNSName = fmt.Sprintf("%s.%s.svc", out.Service, out.Namespace)
+	}
+	for _, m := range tun.ActivePortMappings() {
+		out.Ports = append(out.Ports, readyPort{
+			ContainerPort: m.ContainerPortNumber,
+			Protocol:      string(m.Protocol),
+			Name:          m.ContainerPortName,
+			Target:        m.TargetAddress(),
+			InService:     !m.ServiceHidden,
+		})
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+// printManifests prints the objects the tunnel of cfg creates with p, see
+// tunnel.Render. With server set, the objects are validated and defaulted by
+// the API server without being persisted.
+func printManifests(ctx context.Context, p printers.ResourcePrinter, w io.Writer, cfg *tunnel.TunnelConfig, server bool) error {
+	objs, err := tunnel.NewTunnel(*cfg).Render(ctx, server)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if err := p.PrintObj(obj, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
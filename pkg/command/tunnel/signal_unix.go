@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package tunnel
+
+import (
+	"os"
+	"syscall"
+)
+
+// diagnosticsSignals are the signals that make a running tunnel write a
+// diagnostics snapshot.
+var diagnosticsSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals are the signals that make a running tunnel reload its ports
+// file.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,13 @@
+package tunnel
+
+import (
+	"os"
+)
+
+// diagnosticsSignals are the signals that make a running tunnel write a
+// diagnostics snapshot. There is no suitable signal on Windows.
+var diagnosticsSignals []os.Signal
+
+// reloadSignals are the signals that make a running tunnel reload its ports
+// file. Use --watch-ports on Windows instead.
+var reloadSignals []os.Signal
@@ -2,16 +2,36 @@ package tunnel
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gonet "net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/phayes/freeport"
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/cli-runtime/pkg/printers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/util/templates"
 
 	"github.com/pschmitt/kubetnl/pkg/graceful"
+	"github.com/pschmitt/kubetnl/pkg/kube"
 	"github.com/pschmitt/kubetnl/pkg/net"
 	"github.com/pschmitt/kubetnl/pkg/port"
+	"github.com/pschmitt/kubetnl/pkg/proc"
 	"github.com/pschmitt/kubetnl/pkg/tunnel"
 )
 
@@ -29,8 +49,14 @@ var (
 		service/pod will be tunneled to the endpoint specified for that port.
 
 		"kubetnl tunnel" runs in the foreground. To stop press CTRL+C once. This will 
-		gracefully shutdown all active connections and cleanup the created resources 
-		in the cluster before exiting.`)
+		delete the service, so that no new connections arrive, give active connections 
+		up to --drain-timeout to finish and cleanup the remaining resources in the 
+		cluster before exiting.
+
+		Sending SIGUSR2 to a running "kubetnl tunnel" writes a diagnostics snapshot 
+		with the port mappings, connection statistics, SSH connection status, last 
+		errors and recent events to a timestamped JSON file in the directory set 
+		with --diagnostics-dir. This is not supported on Windows.`)
 
 	tunnelExample = templates.Examples(`
 		# Tunnel to local port 8080 from myservice.<namespace>.svc.cluster.local:80.
@@ -39,32 +65,145 @@ var (
 		# Tunnel to 10.10.10.10:3333 from myservice.<namespace>.svc.cluster.local:80.
 		kubetnl tunnel myservice 10.10.10.10:3333:80
 
+		# Tunnel to api.internal.example.com:443 from myservice.<namespace>.svc.cluster.local:443. The name is resolved on this machine for every connection.
+		kubetnl tunnel myservice api.internal.example.com:443:443
+
 		# Tunnel to local port 8080 from myservice.<namespace>.svc.cluster.local:80 and to local port 9090 from myservice.<namespace>.svc.cluster.local:90.
 		kubetnl tunnel myservice 8080:80 9090:90
 
+		# Tunnel to local UDP port 5353 from mydns.<namespace>.svc.cluster.local:53.
+		kubetnl tunnel mydns 5353:53/udp
+
+		# Tunnel both TCP connections and UDP datagrams to local port 5353 from mydns.<namespace>.svc.cluster.local:53.
+		kubetnl tunnel mydns 5353:53/tcp+udp
+
+		# Tunnel to 10.10.10.10:3333 from myservice.<namespace>.svc.cluster.local:80, running the tunnel pod on a node labeled with pool=onprem.
+		kubetnl tunnel --node-selector pool=onprem myservice 10.10.10.10:3333:80
+
+		# Print the resources the tunnel myservice would create as YAML without creating them.
+		kubetnl tunnel --dry-run=client myservice 8080:80
+
+		# Tunnel to local port 8080 from a service with a generated name like myservice-x7k2p.
+		kubetnl tunnel --generate-name myservice- 8080:80
+
+		# Tunnel to local port 8080 from myservice.<namespace>.svc.cluster.local:80, setting the appProtocol of the service port to "http" for service meshes.
+		kubetnl tunnel myservice 8080:80/tcp:http
+
+		# Tunnel to the local Unix domain socket /var/run/app.sock from myservice.<namespace>.svc.cluster.local:80.
+		kubetnl tunnel myservice unix:/var/run/app.sock:80
+
+		# Tunnel to local port 8080 from myservice.<namespace>.svc.cluster.local:80, naming the container port "http" and targeting it by name.
+		kubetnl tunnel myservice 8080:80@http
+
+		# Tunnel to local port 8080 from myservice.<namespace>.svc.cluster.local:80 and to local port 9090 from port 90 of the pod only, without adding it to the service.
+		kubetnl tunnel myservice 8080:80 9090:90!
+
 		# Tunnel to local port 80 from myservice.<namespace>.svc.cluster.local:80 using version 0.1.0 of the kubetnl server image.
-		kubetnl tunnel --image docker.io/fischor/kubetnl-server:0.1.0 myservice 80:80`)
+		kubetnl tunnel --image docker.io/fischor/kubetnl-server:0.1.0 myservice 80:80
+
+		# Tunnel to local port 8080 from myservice.<namespace>.svc.cluster.local:80 but only forward connections from pods within 10.42.0.0/16.
+		kubetnl tunnel --allow-cidr 10.42.0.0/16 myservice 8080:80
+
+		# Tunnel to local port 8080 from myservice.<namespace>.svc.cluster.local:80, setting the Host header of all requests to app.localhost.
+		kubetnl tunnel --http-mode --rewrite-host app.localhost myservice 8080:80
+
+		# Tunnel to the port the local process "myapp" listens on from myservice.<namespace>.svc.cluster.local:80.
+		kubetnl tunnel --from-process myapp --from-process-port 80 myservice
+
+		# Tunnel all ports of the existing service backend to the same ports on 192.168.1.10.
+		kubetnl tunnel --mirror-service backend --target 192.168.1.10 backend-local
+
+		# Run all tunnels declared in tunnels.yaml until CTRL+C is pressed.
+		kubetnl tunnel -f tunnels.yaml`)
 )
 
 func NewTunnelCommand(f cmdutil.Factory, streams genericclioptions.IOStreams) *cobra.Command {
-	localSSHPort, err := freeport.GetFreePort()
-	if err != nil {
-		cmdutil.CheckErr(err)
-	}
-
 	tunnelConfig := tunnel.TunnelConfig{
-		IOStreams:    streams,
-		LocalSSHPort: localSSHPort,
-		Image:        tunnel.DefaultTunnelImage,
+		IOStreams:             streams,
+		LocalAddresses:        []string{"127.0.0.1"},
+		Image:                 tunnel.DefaultTunnelImage,
+		TargetDialTimeout:     10 * time.Second,
+		ResourceTTLAnnotation: tunnel.DefaultResourceTTLAnnotation,
+
+		ProbeInitialDelay:            tunnel.DefaultProbeInitialDelay,
+		ProbePeriod:                  tunnel.DefaultProbePeriod,
+		ProbeFailureThreshold:        tunnel.DefaultProbeFailureThreshold,
+		StartupProbeFailureThreshold: 60,
+		PortForwardAttempts:          10,
+		PortForwardMaxRetryDuration:  5 * time.Minute,
+		SSHDialBackoff:               tunnel.DefaultSSHDialBackoff,
+		SSHConnectTimeout:            tunnel.DefaultSSHConnectTimeout,
+		DrainTimeout:                 30 * time.Second,
+		KeepaliveInterval:            30 * time.Second,
+		PodReadyTimeout:              5 * time.Minute,
+		RequireAllMappings:           true,
+		PodResources:                 tunnel.DefaultPodResources(),
+		SeccompProfile:               tunnel.DefaultSeccompProfile,
+		SecurityContext:              tunnel.DefaultSecurityContext(),
 	}
 
+	var eventsJSON, traceConnections bool
+	connectionLog := "kubetnl-connections.log"
+	diagnosticsDir := os.TempDir()
+
 	cmd := &cobra.Command{
-		Use:     "tunnel SERVICE_NAME TARGET_ADDR:SERVICE_PORT [...[TARGET_ADDR:SERVICE_PORT]]",
+		Use:     "tunnel SERVICE_NAME [TARGET_ADDR:SERVICE_PORT [...[TARGET_ADDR:SERVICE_PORT]]]",
 		Short:   tunnelShort,
 		Long:    tunnelLong,
 		Example: tunnelExample,
 		Run: func(cmd *cobra.Command, args []string) {
+			tunnelConfig.ContinueOnTunnelError = !tunnelConfig.RequireAllMappings
+			if traceConnections || cmd.Flags().Changed("connection-log") {
+				tunnelConfig.ConnectionLogPath = connectionLog
+			}
+			if eventsJSON {
+				tunnelConfig.OnEvent = jsonEventWriter(streams)
+			}
+			if cmdutil.GetFlagString(cmd, "filename") != "" {
+				configs, err := CompleteFile(&tunnelConfig, f, cmd, args)
+				cmdutil.CheckErr(err)
+				for i := range configs {
+					switch {
+					case cmdutil.GetFlagBool(cmd, "check"):
+						printCheckSummary(streams, &configs[i])
+					case cmdutil.GetFlagBool(cmd, "show-config"):
+						if i > 0 {
+							fmt.Fprintln(streams.Out, "---")
+						}
+						cmdutil.CheckErr(printConfig(streams.Out, &configs[i]))
+					}
+				}
+				if cmdutil.GetFlagBool(cmd, "check") || cmdutil.GetFlagBool(cmd, "show-config") {
+					return
+				}
+				if dryRun, _ := cmdutil.GetDryRunStrategy(cmd); dryRun != cmdutil.DryRunNone {
+					p := &printers.YAMLPrinter{}
+					for i := range configs {
+						cmdutil.CheckErr(printManifests(cmd.Context(), p, streams.Out, &configs[i], dryRun == cmdutil.DryRunServer))
+					}
+					return
+				}
+				cmdutil.CheckErr(runTunnels(cmd.Context(), configs, diagnosticsDir, streams, cmdutil.GetFlagString(cmd, "output")))
+				return
+			}
+
 			cmdutil.CheckErr(Complete(&tunnelConfig, f, cmd, args))
+			if cmdutil.GetFlagBool(cmd, "check") {
+				printCheckSummary(streams, &tunnelConfig)
+				return
+			}
+			if cmdutil.GetFlagBool(cmd, "show-config") {
+				cmdutil.CheckErr(printConfig(streams.Out, &tunnelConfig))
+				return
+			}
+			if dryRun, _ := cmdutil.GetDryRunStrategy(cmd); dryRun != cmdutil.DryRunNone {
+				cmdutil.CheckErr(printManifests(cmd.Context(), &printers.YAMLPrinter{}, streams.Out, &tunnelConfig, dryRun == cmdutil.DryRunServer))
+				return
+			}
+			if cmdutil.GetFlagString(cmd, "generate-name") != "" && !eventsJSON && cmdutil.GetFlagString(cmd, "output") == "" {
+				// Print the name so that scripts can pick it up.
+				fmt.Fprintln(streams.Out, tunnelConfig.Name)
+			}
 
 			tun := tunnel.NewTunnel(tunnelConfig)
 
@@ -74,45 +213,1097 @@ func NewTunnelCommand(f cmdutil.Factory, streams genericclioptions.IOStreams) *c
 			defer interruptCancel()
 
 			if _, err := tun.Run(ctx); err != nil {
+				// Cleanup the resources that have been created
+				// before the error occurred. CheckErr exits
+				// without running deferred functions.
+				tun.Stop(context.Background())
 				cmdutil.CheckErr(err)
 			}
 			defer tun.Stop(context.Background())
 
 			<-tun.Ready()
-			<-ctx.Done()
+			if cmdutil.GetFlagString(cmd, "output") == "json" {
+				if err := printReady(streams.Out, tun); err != nil {
+					klog.Errorf("Error printing the tunnel: %v", err)
+				}
+			}
+			go writeDiagnosticsOnSignal(ctx, tun, diagnosticsDir, streams)
+			if cmdutil.GetFlagString(cmd, "ports-file") != "" {
+				go reloadMappings(ctx, tun, &tunnelConfig, cmd, cmdutil.GetFlagBool(cmd, "watch-ports"))
+			}
+			select {
+			case <-ctx.Done():
+			case <-tun.Done():
+				// An idle tunnel is stopped by the deferred Stop.
+				// CheckErr exits without running it.
+				if err := tun.Err(); !errors.Is(err, tunnel.ErrIdle) {
+					tun.Stop(context.Background())
+					cmdutil.CheckErr(err)
+				}
+			}
 		},
 	}
 
 	cmd.Flags().StringVar(&tunnelConfig.Image, "image", tunnelConfig.Image, "The container image thats get deployed to serve a SSH server")
+	cmd.Flags().StringArrayVar(&tunnelConfig.ImagePullSecrets, "image-pull-secret", tunnelConfig.ImagePullSecrets, "Name of a Secret in the namespace of the tunnel used to pull --image, e.g. from a private registry. Can be repeated.")
+	cmd.Flags().StringSliceVar(&tunnelConfig.LocalAddresses, "address", tunnelConfig.LocalAddresses, "Addresses to listen on for the port-forward to the SSH server of the pod (comma separated). Only accepts IP addresses or localhost as a value. Note that listening on a non-loopback address exposes the SSH server of the tunnel to other machines.")
+	cmd.Flags().DurationVar(&tunnelConfig.PodReadyTimeout, "pod-ready-timeout", tunnelConfig.PodReadyTimeout, "The maximum time to wait for the tunnel pod to become ready. On timeout, the scheduling events of the pod are reported. Zero means no timeout.")
+	cmd.Flags().DurationVar(&tunnelConfig.IdleTimeout, "idle-timeout", tunnelConfig.IdleTimeout, "If set, stop the tunnel, delete its resources and exit successfully once no data has been forwarded through any port mapping for this duration, e.g. for forgotten debug tunnels. Open connections without traffic do not keep the tunnel alive. Zero means no timeout.")
+	cmd.Flags().DurationVar(&tunnelConfig.SetupTimeout, "setup-timeout", tunnelConfig.SetupTimeout, "The maximum time to wait for the tunnel to become ready, including creating the resources, waiting for the pod and establishing the SSH connection. On timeout, the resources created so far are deleted and kubetnl exits with an error. Zero means no timeout.")
+	cmd.Flags().DurationVar(&tunnelConfig.PodMaxLifetime, "pod-max-lifetime", tunnelConfig.PodMaxLifetime, "If set, Kubernetes terminates the tunnel pod after this duration (activeDeadlineSeconds), even if kubetnl is still running. kubetnl exits with an error once the pod has been terminated. Zero means no limit.")
+	cmd.Flags().DurationVar(&tunnelConfig.ImagePullTimeout, "server-image-pull-timeout", tunnelConfig.ImagePullTimeout, "If set, fail if pulling the server image takes longer than this duration. Zero means no timeout.")
+	cmd.Flags().DurationVar(&tunnelConfig.TargetDialTimeout, "target-dial-timeout", tunnelConfig.TargetDialTimeout, "The timeout for connecting to the target of a port mapping. Connections that can not be established within this duration are closed. Zero means no timeout.")
+	cmd.Flags().IntVar(&tunnelConfig.ForwarderWorkers, "forwarder-workers", tunnelConfig.ForwarderWorkers, "The maximum number of connections handled concurrently per port mapping. Further connections wait until a worker is available. Zero means unlimited.")
+	cmd.Flags().IntVar(&tunnelConfig.SSHMaxSessions, "ssh-max-sessions", tunnelConfig.SSHMaxSessions, "If set, the MaxSessions setting of the SSH server in the pod. Raise it if connections fail under a high rate of new connections.")
+	cmd.Flags().StringVar(&tunnelConfig.SSHMaxStartups, "ssh-max-startups", tunnelConfig.SSHMaxStartups, "If set, the MaxStartups setting (\"start:rate:full\" or \"full\") of the SSH server in the pod.")
+	cmd.Flags().DurationVar(&tunnelConfig.ProbeInitialDelay, "probe-initial-delay", tunnelConfig.ProbeInitialDelay, "The delay before the readiness and liveness probes on the SSH port of the pod are first run. Raise it for server images that take longer to start the SSH server.")
+	cmd.Flags().DurationVar(&tunnelConfig.ProbePeriod, "probe-period", tunnelConfig.ProbePeriod, "The interval the readiness and liveness probes on the SSH port of the pod are run at.")
+	cmd.Flags().Int32Var(&tunnelConfig.ProbeFailureThreshold, "probe-failure-threshold", tunnelConfig.ProbeFailureThreshold, "The number of consecutive failed probes after which the pod is reported as not ready and its container is restarted.")
+	cmd.Flags().BoolVar(&tunnelConfig.StartupProbe, "startup-probe", tunnelConfig.StartupProbe, "If true, add a startup probe on the SSH port to the pod. Use this for server images that take a long time to start the SSH server.")
+	cmd.Flags().Int32Var(&tunnelConfig.StartupProbeFailureThreshold, "startup-probe-failure-threshold", tunnelConfig.StartupProbeFailureThreshold, "The number of failed startup probes, executed every 5 seconds, after which the container is restarted. Only used with --startup-probe.")
+	cmd.Flags().BoolVar(&tunnelConfig.HostNetwork, "host-network", tunnelConfig.HostNetwork, "If true, run the pod in the network namespace of its node. The SSH port and all service ports are then opened on the node: the pod can not be scheduled on nodes where these ports are already used by other host network pods, and the SSH port must not be used by any other process on the node.")
+	cmd.Flags().StringArray("node-selector", nil, "Only schedule the tunnel pod on nodes with this label in the format KEY=VALUE, e.g. nodes that can reach the target. Can be repeated. kubetnl fails if no node matches.")
+	cmd.Flags().StringVar(&tunnelConfig.NodeName, "node-name", tunnelConfig.NodeName, "Run the tunnel pod on this node, bypassing the scheduler.")
+	cmd.Flags().StringArray("toleration", nil, "Allow the tunnel pod on nodes with this taint, in the format KEY=VALUE:EFFECT or KEY:EFFECT to tolerate any value. The effect may be omitted to tolerate all effects. Can be repeated.")
+	cmd.Flags().String("request-cpu", "10m", "The CPU request of the tunnel pod. Set to an empty string for no request.")
+	cmd.Flags().String("request-memory", "16Mi", "The memory request of the tunnel pod. Set to an empty string for no request.")
+	cmd.Flags().String("limit-cpu", "", "The CPU limit of the tunnel pod. Defaults to no limit.")
+	cmd.Flags().String("limit-memory", "", "The memory limit of the tunnel pod. Defaults to no limit.")
+	cmd.Flags().StringVar(&tunnelConfig.ContainerName, "container-name", tunnelConfig.ContainerName, "The name of the container of the tunnel pod. Defaults to \"main\".")
+	cmd.Flags().StringArray("env", nil, "Set this environment variable in the format NAME=VALUE in the container of the tunnel pod, e.g. LOG_LEVEL=debug. Variables set by kubetnl for the SSH server, like PORT or USER_PASSWORD, are only replaced if set explicitly. Can be repeated.")
+	cmd.Flags().StringVar(&tunnelConfig.SeccompProfile, "seccomp-profile", tunnelConfig.SeccompProfile, "The seccomp profile of the tunnel pod: \"RuntimeDefault\", \"Unconfined\" or \"localhost/<path>\" for a profile on the node. Set to an empty string for no profile. Namespaces enforcing the \"baseline\" Pod Security Standard reject \"Unconfined\", the \"restricted\" level requires \"RuntimeDefault\" or a localhost profile.")
+	cmd.Flags().StringVar(&tunnelConfig.ServiceAccount, "service-account", tunnelConfig.ServiceAccount, "The name of an existing ServiceAccount in the namespace of the tunnel the tunnel pod runs as. If not set, a ServiceAccount is created for every tunnel, which requires permissions to create ServiceAccounts. The ServiceAccount is not deleted when the tunnel is stopped.")
+	cmd.Flags().BoolVar(&tunnelConfig.FollowLogs, "follow-logs", tunnelConfig.FollowLogs, "If true, stream the logs of the SSH server container of the tunnel pod to stderr as soon as the pod is created, each line prefixed with the container name. With --controller=deployment, the logs are streamed once a pod is ready.")
+	cmd.Flags().BoolVar(&tunnelConfig.NoInitScript, "no-init-script", tunnelConfig.NoInitScript, "If true, do not create the ConfigMap with the init script that configures the SSH server of the default image, e.g. for an --image that configures its SSH server itself. The SSH server must listen on the port in the PORT environment variable and allow TCP forwarding and gateway ports. Requires --ssh-password and can not be used with UDP port mappings.")
+	cmd.Flags().Bool("run-as-non-root", false, "If true, run the tunnel pod as a non-root user without any capability except NET_BIND_SERVICE and privilege escalation, as required by the \"restricted\" Pod Security Standard. Requires an --image that runs the SSH server as a non-root user, which the default image does not. By default all capabilities except the ones needed by the SSH server are dropped, which satisfies the \"baseline\" level.")
+	cmd.Flags().StringVar(&tunnelConfig.ServiceType, "service-type", tunnelConfig.ServiceType, "The type of the service: \"ClusterIP\", \"NodePort\" or \"LoadBalancer\". With \"NodePort\" and \"LoadBalancer\" the tunnel is reachable from outside of the cluster. The assigned node ports are printed once the service is created. Defaults to \"ClusterIP\".")
+	cmd.Flags().StringArray("label", nil, "Add this label in the format KEY=VALUE to all resources created for the tunnel, e.g. for cost tracking. Can be repeated.")
+	cmd.Flags().StringArray("annotation", nil, "Add this annotation in the format KEY=VALUE to all resources created for the tunnel. Can be repeated.")
+	cmd.Flags().StringArray("service-annotation", nil, "Add this annotation in the format KEY=VALUE to the service, e.g. to configure the load balancer of a cloud provider with --service-type=LoadBalancer. Can be repeated.")
+	cmd.Flags().StringVar(&tunnelConfig.InternalTrafficPolicy, "internal-traffic-policy", tunnelConfig.InternalTrafficPolicy, "The internalTrafficPolicy of the service, either \"Cluster\" or \"Local\". With \"Local\" only clients on the node of the tunnel pod can reach the service, saving a hop between nodes. Requires Kubernetes 1.21 or newer. Defaults to the cluster default.")
+	cmd.Flags().StringVar(&tunnelConfig.ExistingPod, "existing-pod", tunnelConfig.ExistingPod, "Name of a running pod with an SSH server to use for the tunnel. No resources are created or deleted in the cluster. The container port of the SSH server must be named \"ssh\".")
+	cmd.Flags().IntVar(&tunnelConfig.RemoteSSHPort, "remote-ssh-port", tunnelConfig.RemoteSSHPort, "The port the SSH server in the pod listens on, e.g. a port allowed by NetworkPolicies. Must not be used by a port mapping. Defaults to 2222, or 22 or a port from 49152 on if 2222 is used by a port mapping.")
+	cmd.Flags().StringVar(&tunnelConfig.Controller, "controller", tunnelConfig.Controller, "The kind of workload running the tunnel pod, \"pod\" or \"deployment\". A Deployment replaces the pod if it is lost, e.g. with its node, and the tunnel moves to the replacement. Moving the SSH connection requires --ssh-keepalive-interval.")
+	cmd.Flags().BoolVar(&tunnelConfig.UsePrewarmed, "use-prewarmed", tunnelConfig.UsePrewarmed, "If true, adopt a pod created by \"kubetnl prewarm\" running the same image instead of creating a new one. Falls back to creating a new pod if none is available.")
+	cmd.Flags().DurationVar(&tunnelConfig.ResourceTTL, "resource-ttl", tunnelConfig.ResourceTTL, "If set, annotate all created resources with this time to live, so that tools like kube-janitor delete them in case kubetnl fails to clean them up. The annotation key is set with --resource-ttl-annotation.")
+	cmd.Flags().StringVar(&tunnelConfig.ResourceTTLAnnotation, "resource-ttl-annotation", tunnelConfig.ResourceTTLAnnotation, "The annotation key used for --resource-ttl.")
+	cmd.Flags().BoolVar(&tunnelConfig.RequireAllMappings, "require-all-mappings", tunnelConfig.RequireAllMappings, "If true, fail if any port mapping can not be forwarded, e.g. because its port is already in use in the pod or its protocol is not supported. If false, the tunnel becomes ready as long as at least one port mapping is forwarded.")
+	cmd.Flags().BoolVar(&tunnelConfig.Protect, "protect", tunnelConfig.Protect, "If true, add a finalizer to the service so that deleting it, e.g. with kubectl, only takes effect once the tunnel is stopped. If kubetnl is killed, the finalizer blocks the deletion of the service, including by garbage collectors using --resource-ttl, until it is removed by \"kubetnl cleanup\".")
+	cmd.Flags().BoolVar(&tunnelConfig.ReuseService, "reuse-service", tunnelConfig.ReuseService, "If true and a service named SERVICE_NAME with the label \"io.github.kubetnl\" already exists, update its ports and selector instead of failing. The service is only deleted when the tunnel is stopped, or by \"kubetnl cleanup\", if it was created by kubetnl.")
+	cmd.Flags().IntVar(&tunnelConfig.PrewarmConns, "prewarm-target-conns", tunnelConfig.PrewarmConns, "The number of idle connections kept open to the target of each port mapping, so that connections through the tunnel do not wait for the target to be dialed. The target sees these connections while the tunnel runs, even if no client connects. Targets that close idle connections, e.g. after a timeout, make them be dialed again. Zero disables prewarming.")
+	cmd.Flags().DurationVar(&tunnelConfig.KeepaliveInterval, "ssh-keepalive-interval", tunnelConfig.KeepaliveInterval, "The interval SSH keepalive requests are sent to the tunnel pod at. If a request is not answered within the interval, the connection is considered dead and re-established. Zero disables keepalives and thus reconnecting.")
+	cmd.Flags().DurationVar(&tunnelConfig.DrainTimeout, "drain-timeout", tunnelConfig.DrainTimeout, "The time active connections are given to finish when the tunnel is stopped. Connections still active afterwards are closed. Zero means to wait until all connections finished.")
+	cmd.Flags().IntVar(&tunnelConfig.MaxBufferPerConn, "max-buffer-per-conn", tunnelConfig.MaxBufferPerConn, "The maximum number of bytes buffered per direction of a forwarded connection if one side reads slower than the other side writes. Connections exceeding the limit are closed. Zero means no additional buffering.")
+	cmd.Flags().StringArray("allow-cidr", nil, "Only forward connections from source addresses within this CIDR. Use SERVICE_PORT=CIDR to restrict a single port mapping only. Can be specified multiple times.")
+	cmd.Flags().StringVar(&tunnelConfig.SSHUser, "ssh-user", tunnelConfig.SSHUser, "The user of the SSH connection to the tunnel pod. Defaults to \"user\".")
+	cmd.Flags().StringVar(&tunnelConfig.SSHPassword, "ssh-password", tunnelConfig.SSHPassword, "The password of the SSH connection to the tunnel pod. If set, password authentication is used instead of public key authentication.")
+	cmd.Flags().BoolVar(&tunnelConfig.InsecureSkipHostKeyCheck, "insecure-skip-host-key-check", tunnelConfig.InsecureSkipHostKeyCheck, "If true, accept any SSH host key if the host key can not be read from the tunnel pod, e.g. because of missing permissions to create pods/exec. This allows to intercept the SSH connection.")
+	cmd.Flags().StringVar(&tunnelConfig.SSHKeySecret, "ssh-key-secret", tunnelConfig.SSHKeySecret, "Read the private key used to authenticate the SSH connection to the tunnel pod from this key of a Secret in the namespace of the tunnel, in the format NAME/KEY. Can not be used with --ssh-private-key.")
+	cmd.Flags().StringVar(&tunnelConfig.SSHKeyPassphrase, "ssh-key-passphrase", tunnelConfig.SSHKeyPassphrase, "The passphrase of the private key set with --ssh-private-key or --ssh-key-secret if it is encrypted.")
+	cmd.Flags().StringVar(&tunnelConfig.SSHPrivateKeyPath, "ssh-private-key", tunnelConfig.SSHPrivateKeyPath, "Path of a private key used to authenticate the SSH connection to the tunnel pod. If neither this nor --ssh-password is set, an ephemeral key is generated for every tunnel. With --existing-pod or --use-prewarmed the password of the pod is used instead.")
+	cmd.Flags().IntVar(&tunnelConfig.PortForwardAttempts, "port-forward-attempts", tunnelConfig.PortForwardAttempts, "The number of attempts to establish the port-forward to the pod once it is ready before giving up. This usually fails because of missing permissions to create pods/portforward. Zero means no limit.")
+	cmd.Flags().DurationVar(&tunnelConfig.PortForwardMaxRetryDuration, "port-forward-max-retry-duration", tunnelConfig.PortForwardMaxRetryDuration, "The maximum time the port-forward to the pod may fail continuously, e.g. because the pod is gone, before the tunnel gives up. The delay between attempts starts at 500ms and doubles with every failed attempt up to 30s. Zero means no limit.")
+	cmd.Flags().IntVar(&tunnelConfig.SSHDialBackoff.Steps, "ssh-dial-attempts", tunnelConfig.SSHDialBackoff.Steps, "The number of attempts to establish the SSH connection to the tunnel pod before giving up. The delay between attempts starts at 1s and doubles with every attempt.")
+	cmd.Flags().StringVar(&tunnelConfig.RemoteBindAddress, "remote-bind-address", tunnelConfig.RemoteBindAddress, "The IP address in the tunnel pod the forwarded ports are bound to. Defaults to 0.0.0.0, all interfaces of the pod. Use 127.0.0.1 to make the ports only reachable from within the pod, e.g. with \"kubectl port-forward\", but not via the service. The SSH server of an --image or --existing-pod must set \"GatewayPorts clientspecified\".")
+	cmd.Flags().DurationVar(&tunnelConfig.SSHConnectTimeout, "ssh-connect-timeout", tunnelConfig.SSHConnectTimeout, "The maximum time of a single attempt to establish the SSH connection to the tunnel pod, including the SSH handshake. Attempts exceeding it are retried.")
+	cmd.Flags().DurationVar(&tunnelConfig.SSHDialTimeout, "ssh-dial-timeout", tunnelConfig.SSHDialTimeout, "If set, give up establishing the SSH connection to the tunnel pod after this duration even if --ssh-dial-attempts are left. Zero means no timeout.")
+	cmd.Flags().IntVar(&tunnelConfig.LocalSSHPort, "local-ssh-port", tunnelConfig.LocalSSHPort, "The local port of the port-forward to the SSH server of the pod, e.g. for firewall rules. Must be free on all --address values. Defaults to any free port.")
+	cmd.Flags().String("local-port-range", "", "Only use local ports within this range, e.g. \"20000-21000\", for the port-forward of the SSH connection. Defaults to any free port.")
+	cmd.Flags().Bool("http-mode", false, "If true, forward connections of the mappings set with --rewrite-host as HTTP/1.x instead of raw TCP. TLS connections can not be forwarded in this mode.")
+	cmd.Flags().StringArray("rewrite-host", nil, "Set the Host header of all HTTP requests forwarded to the target to this value, e.g. for targets serving name based virtual hosts. Use the format SERVICE_PORT=HOST to only apply it to one port mapping. Requires --http-mode. Can be repeated.")
+	cmd.Flags().String("ports-file", "", "Read additional TARGET_ADDR:SERVICE_PORT mappings from this file, separated by whitespace or newlines. Lines starting with # are ignored. Sending SIGHUP reloads the file and applies added and removed mappings without restarting the tunnel.")
+	cmd.Flags().Bool("watch-ports", false, "If true, watch the --ports-file for changes and apply them without restarting the tunnel.")
+	cmd.Flags().StringP("filename", "f", "", "Run the tunnels declared in this YAML file concurrently instead of a single tunnel. Each entry sets the name, namespace, image, service type and port mappings of a tunnel, all other flags apply to every tunnel. CTRL+C stops all of them.")
+	cmd.Flags().Bool("show-config", false, "If true, print the resolved configuration of the tunnel as YAML and exit without creating any resources. Secrets are redacted.")
+	cmdutil.AddDryRunFlag(cmd)
+	cmd.Flags().Bool("check", false, "If true, only parse and validate the arguments and flags, print the resulting port mappings and exit without contacting the cluster. Exits non-zero if the validation fails.")
+	cmd.Flags().String("generate-name", "", "Generate a unique name for the tunnel by appending a random suffix to this prefix instead of passing SERVICE_NAME. The generated name is printed to stdout.")
+	cmd.Flags().String("mirror-service", "", "Name of an existing service in the namespace whose ports are all tunneled to the same ports on --target. Can be combined with TARGET_ADDR:SERVICE_PORT arguments.")
+	cmd.Flags().String("target", "127.0.0.1", "The host to tunnel the ports of --mirror-service to.")
+	cmd.Flags().String("from-process", "", "Name or ID of a local process to tunnel to. The ports the process listens on are discovered and tunneled to from the same service port, or from --from-process-port. Can be combined with TARGET_ADDR:SERVICE_PORT arguments.")
+	cmd.Flags().Int("from-process-port", 0, "The service port to tunnel to the port discovered with --from-process. Only valid if the process listens on a single port.")
+	cmd.Flags().StringArray("deny-cidr", nil, "Never forward connections from source addresses within this CIDR. Use SERVICE_PORT=CIDR to restrict a single port mapping only. Takes precedence over --allow-cidr. Can be specified multiple times.")
+	cmd.Flags().BoolVar(&tunnelConfig.WaitEndpoints, "wait-endpoints", tunnelConfig.WaitEndpoints, "If true, wait until the service has a ready endpoint before the tunnel is ready, so that the first request from within the cluster does not fail. The wait is bounded by --pod-ready-timeout.")
+	cmd.Flags().BoolVar(&tunnelConfig.VerifyTLSTarget, "verify-tls-target", tunnelConfig.VerifyTLSTarget, "If true, perform a TLS handshake with the target of each port mapping through the tunnel on startup and report the negotiated TLS version and certificate subject. Use it to check that TLS is passed through untouched.")
+	cmd.Flags().BoolVar(&traceConnections, "trace-connections", traceConnections, "If true, append a record with the remote address, transferred bytes and duration of every forwarded connection to the file set with --connection-log.")
+	cmd.Flags().StringVar(&connectionLog, "connection-log", connectionLog, "The file that connection records are appended to. Setting it implies --trace-connections.")
+	cmd.Flags().Float64Var(&tunnelConfig.ConnectionLogSample, "connection-log-sample", 1, "The fraction of connections between 0 and 1 recorded with --trace-connections, e.g. 0.01 for every hundredth connection on average. The rate applies to the connections of all port mappings. The connection statistics still count all connections.")
+	cmd.Flags().StringVar(&tunnelConfig.MetricsAddr, "metrics-addr", tunnelConfig.MetricsAddr, "If set, serve Prometheus metrics with connection and byte counters per port mapping and the number of reconnects on this address under /metrics, e.g. \"127.0.0.1:9090\".")
+	cmd.Flags().StringVar(&diagnosticsDir, "diagnostics-dir", diagnosticsDir, "The directory diagnostics snapshots are written to when receiving SIGUSR2.")
+	cmd.Flags().StringP("output", "o", "", "If set to \"json\", print a JSON object with the name, namespace, pod, service and forwarded port mappings of the tunnel to stdout once it is ready. Logs are still written to stderr.")
+	cmd.Flags().BoolVar(&eventsJSON, "events-json", eventsJSON, "If true, stream significant events (e.g. opened and closed connections, reconnects and errors) as JSON objects to stdout, one per line. Logs are still written to stderr.")
 
 	return cmd
 }
 
 func Complete(o *tunnel.TunnelConfig, f cmdutil.Factory, cmd *cobra.Command, args []string) error {
-	if len(args) < 2 {
-		return cmdutil.UsageErrorf(cmd, "SERVICE_NAME and list of TARGET_ADDR:SERVICE_PORT pairs are required for tunnel")
+	fromProcess := cmdutil.GetFlagString(cmd, "from-process")
+	mirrorService := cmdutil.GetFlagString(cmd, "mirror-service")
+	if generateName := cmdutil.GetFlagString(cmd, "generate-name"); generateName != "" {
+		// All arguments are port mappings.
+		name := generateName + rand.String(5)
+		if errs := validation.IsDNS1035Label(name); len(errs) > 0 {
+			return fmt.Errorf("invalid --generate-name %q: %s", generateName, strings.Join(errs, ", "))
+		}
+		args = append([]string{name}, args...)
+	}
+	portsFile := cmdutil.GetFlagString(cmd, "ports-file")
+	if len(args) < 1 || (len(args) < 2 && fromProcess == "" && mirrorService == "" && portsFile == "") {
+		return cmdutil.UsageErrorf(cmd, "SERVICE_NAME and list of TARGET_ADDR:SERVICE_PORT pairs, --ports-file, --from-process or --mirror-service are required for tunnel")
+	}
+	if err := validateOutput(cmdutil.GetFlagString(cmd, "output")); err != nil {
+		return err
+	}
+	dryRun, dryRunErr := cmdutil.GetDryRunStrategy(cmd)
+	if dryRunErr != nil {
+		return dryRunErr
+	}
+	if dryRun != cmdutil.DryRunNone && o.ExistingPod != "" {
+		return fmt.Errorf("--dry-run can not be used with --existing-pod: no resources are created")
+	}
+	if cmdutil.GetFlagBool(cmd, "watch-ports") && portsFile == "" {
+		return cmdutil.UsageErrorf(cmd, "--watch-ports requires --ports-file")
 	}
 	o.Name = args[0]
+	if errs := validation.IsDNS1035Label(o.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid SERVICE_NAME %q: %s", o.Name, strings.Join(errs, ", "))
+	}
+	// In check mode the cluster must not be contacted, the kubeconfig
+	// might not even exist.
+	check := cmdutil.GetFlagBool(cmd, "check")
 	var err error
-	o.PortMappings, err = port.ParseMappings(args[1:])
+	if !check {
+		o.Namespace, o.EnforceNamespace, err = kube.Namespace(f.ToRawKubeConfigLoader())
+		if err != nil {
+			return err
+		}
+		o.RESTConfig, err = f.ToRESTConfig()
+		if err != nil {
+			return err
+		}
+		o.ClientSet, err = f.KubernetesClientSet()
+		if err != nil {
+			return err
+		}
+	}
+	o.RawPortMappings = args[1:]
+	o.PortMappings, err = completeMappings(o, cmd)
 	if err != nil {
 		return err
 	}
-	o.RemoteSSHPort, err = net.GetFreeSSHPortInContainer(o.PortMappings)
+	if o.ExistingPod == "" && !hasServicePorts(o.PortMappings) {
+		return fmt.Errorf("at least one port mapping must be exposed in the service: remove the trailing \"!\" from one of them")
+	}
+	if o.HostNetwork {
+		// All ports are opened on the node, where port 22 is usually
+		// taken by the node's own SSH daemon.
+		if net.IsInUse(o.PortMappings, 22) {
+			return fmt.Errorf("service port 22 can not be used with --host-network")
+		}
+	}
+	switch {
+	case o.RemoteSSHPort != 0:
+		if err := validateRemoteSSHPort(o); err != nil {
+			return err
+		}
+	case o.HostNetwork:
+		o.RemoteSSHPort, err = net.GetFreeSSHPortOnNode(o.PortMappings)
+	default:
+		o.RemoteSSHPort, err = net.GetFreeSSHPortInContainer(o.PortMappings)
+	}
 	if err != nil {
 		return err
 	}
-	o.Namespace, o.EnforceNamespace, err = f.ToRawKubeConfigLoader().Namespace()
-	if err != nil {
+	if err := validateAddresses(o.LocalAddresses); err != nil {
 		return err
 	}
-	o.RESTConfig, err = f.ToRESTConfig()
-	if err != nil {
+	var portRange net.PortRange
+	if s := cmdutil.GetFlagString(cmd, "local-port-range"); s != "" {
+		if portRange, err = net.ParsePortRange(s); err != nil {
+			return err
+		}
+	}
+	if o.LocalSSHPort != 0 {
+		// Report a taken port before any resources are created.
+		if o.LocalSSHPort < 1 || o.LocalSSHPort > 65535 {
+			return fmt.Errorf("invalid --local-ssh-port %d: must be between 1 and 65535", o.LocalSSHPort)
+		}
+		if !portRange.IsZero() {
+			return fmt.Errorf("--local-ssh-port and --local-port-range are mutually exclusive")
+		}
+		if err := net.CheckLocalPort(o.LocalAddresses, o.LocalSSHPort); err != nil {
+			return fmt.Errorf("invalid --local-ssh-port: %v", err)
+		}
+	} else {
+		o.LocalSSHPort, err = net.GetFreeLocalPort(portRange)
+		if err != nil {
+			return fmt.Errorf("error choosing the local port for the SSH connection: %v", err)
+		}
+	}
+	if o.NodeSelector, err = parseKeyValues("node-selector", cmdutil.GetFlagStringArray(cmd, "node-selector"), true); err != nil {
 		return err
 	}
-	o.ClientSet, err = f.KubernetesClientSet()
-	if err != nil {
+	if (len(o.NodeSelector) > 0 || o.NodeName != "") && o.ExistingPod != "" {
+		return fmt.Errorf("--node-selector and --node-name can not be used with --existing-pod")
+	}
+	if errs := validation.IsDNS1123Subdomain(o.NodeName); o.NodeName != "" && len(errs) > 0 {
+		return fmt.Errorf("invalid --node-name %q: %s", o.NodeName, strings.Join(errs, ", "))
+	}
+	if o.Labels, err = parseKeyValues("label", cmdutil.GetFlagStringArray(cmd, "label"), true); err != nil {
 		return err
 	}
+	if _, ok := o.Labels["io.github.kubetnl"]; ok {
+		return fmt.Errorf("invalid --label: the label \"io.github.kubetnl\" is set by kubetnl")
+	}
+	if o.Annotations, err = parseKeyValues("annotation", cmdutil.GetFlagStringArray(cmd, "annotation"), false); err != nil {
+		return err
+	}
+	if o.Tolerations, err = parseTolerations(cmdutil.GetFlagStringArray(cmd, "toleration")); err != nil {
+		return err
+	}
+	if len(o.Tolerations) > 0 && o.ExistingPod != "" {
+		return fmt.Errorf("--toleration can not be used with --existing-pod")
+	}
+	for _, name := range o.ImagePullSecrets {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return fmt.Errorf("invalid --image-pull-secret %q: %s", name, strings.Join(errs, ", "))
+		}
+	}
+	if len(o.ImagePullSecrets) > 0 && o.ExistingPod != "" {
+		return fmt.Errorf("--image-pull-secret can not be used with --existing-pod")
+	}
+	if o.KeepaliveInterval < 0 {
+		return fmt.Errorf("invalid --ssh-keepalive-interval %s: must not be negative", o.KeepaliveInterval)
+	}
+	if o.PortForwardMaxRetryDuration < 0 {
+		return fmt.Errorf("invalid --port-forward-max-retry-duration %s: must not be negative", o.PortForwardMaxRetryDuration)
+	}
+	if o.SSHDialBackoff.Steps < 1 {
+		return fmt.Errorf("invalid --ssh-dial-attempts %d: must be at least 1", o.SSHDialBackoff.Steps)
+	}
+	if o.RemoteBindAddress != "" && gonet.ParseIP(o.RemoteBindAddress) == nil {
+		return fmt.Errorf("invalid --remote-bind-address %q: must be an IP address", o.RemoteBindAddress)
+	}
+	if o.SSHConnectTimeout <= 0 {
+		return fmt.Errorf("invalid --ssh-connect-timeout %s: must be positive", o.SSHConnectTimeout)
+	}
+	if o.SSHDialTimeout < 0 {
+		return fmt.Errorf("invalid --ssh-dial-timeout %s: must not be negative", o.SSHDialTimeout)
+	}
+	if o.IdleTimeout < 0 {
+		return fmt.Errorf("invalid --idle-timeout %s: must not be negative", o.IdleTimeout)
+	}
+	if o.SetupTimeout < 0 {
+		return fmt.Errorf("invalid --setup-timeout %s: must not be negative", o.SetupTimeout)
+	}
+	if o.PodMaxLifetime < 0 {
+		return fmt.Errorf("invalid --pod-max-lifetime %s: must not be negative", o.PodMaxLifetime)
+	}
+	if o.PodMaxLifetime > 0 && o.ExistingPod != "" {
+		return fmt.Errorf("--pod-max-lifetime can not be used with --existing-pod")
+	}
+	if o.ProbeInitialDelay < 0 {
+		return fmt.Errorf("invalid --probe-initial-delay %s: must not be negative", o.ProbeInitialDelay)
+	}
+	if o.ProbePeriod < time.Second {
+		return fmt.Errorf("invalid --probe-period %s: must be at least 1s", o.ProbePeriod)
+	}
+	if o.ProbeFailureThreshold < 1 {
+		return fmt.Errorf("invalid --probe-failure-threshold %d: must be at least 1", o.ProbeFailureThreshold)
+	}
+	if o.ExistingPod != "" && (cmd.Flags().Changed("probe-initial-delay") || cmd.Flags().Changed("probe-period") || cmd.Flags().Changed("probe-failure-threshold")) {
+		return fmt.Errorf("--probe-initial-delay, --probe-period and --probe-failure-threshold can not be used with --existing-pod")
+	}
+	if o.PodResources, err = podResources(cmd); err != nil {
+		return err
+	}
+	if errs := validation.IsDNS1123Label(o.ContainerName); o.ContainerName != "" && len(errs) > 0 {
+		return fmt.Errorf("invalid --container-name %q: %s", o.ContainerName, strings.Join(errs, ", "))
+	}
+	if o.ExtraEnv, err = parseEnv(cmdutil.GetFlagStringArray(cmd, "env")); err != nil {
+		return err
+	}
+	if (o.ContainerName != "" || len(o.ExtraEnv) > 0) && o.ExistingPod != "" {
+		return fmt.Errorf("--container-name and --env can not be used with --existing-pod")
+	}
+	if err := tunnel.ValidateSeccompProfile(o.SeccompProfile); err != nil {
+		return err
+	}
+	if o.FollowLogs && o.ExistingPod != "" {
+		return fmt.Errorf("--follow-logs can not be used with --existing-pod")
+	}
+	if o.ServiceAccount != "" {
+		if errs := validation.IsDNS1123Subdomain(o.ServiceAccount); len(errs) > 0 {
+			return fmt.Errorf("invalid --service-account %q: %s", o.ServiceAccount, strings.Join(errs, ", "))
+		}
+		switch {
+		case o.ExistingPod != "":
+			return fmt.Errorf("--service-account can not be used with --existing-pod")
+		case o.UsePrewarmed:
+			return fmt.Errorf("--service-account can not be used with --use-prewarmed: prewarmed pods run as their own ServiceAccount")
+		}
+	}
+	if o.UsePrewarmed {
+		if name := namedMapping(o.PortMappings); name != "" {
+			return fmt.Errorf("--use-prewarmed can not be used with the named port %q: prewarmed pods do not declare the names the service targets", name)
+		}
+	}
+	if o.NoInitScript {
+		switch {
+		case o.ExistingPod != "":
+			return fmt.Errorf("--no-init-script can not be used with --existing-pod")
+		case o.UsePrewarmed:
+			return fmt.Errorf("--no-init-script can not be used with --use-prewarmed: prewarmed pods run the init script")
+		case o.SSHPassword == "":
+			return fmt.Errorf("--no-init-script requires --ssh-password: the public key of the SSH connection is installed by the init script")
+		case hasUDPMappings(o.PortMappings):
+			return fmt.Errorf("--no-init-script can not be used with UDP port mappings: they are relayed by a service installed with the init script")
+		}
+	}
+	if cmdutil.GetFlagBool(cmd, "run-as-non-root") {
+		if o.ExistingPod != "" {
+			return fmt.Errorf("--run-as-non-root can not be used with --existing-pod")
+		}
+		o.PodSecurityContext, o.SecurityContext = tunnel.NonRootSecurityContexts()
+	}
+	if o.ConnectionLogSample <= 0 || o.ConnectionLogSample > 1 {
+		return fmt.Errorf("invalid --connection-log-sample %v: must be greater than 0 and at most 1", o.ConnectionLogSample)
+	}
+	if err := tunnel.ValidateServiceType(o.ServiceType); err != nil {
+		return err
+	}
+	if o.Protect && o.ExistingPod != "" {
+		return fmt.Errorf("--protect can not be used with --existing-pod: no service is created")
+	}
+	if o.ReuseService && o.ExistingPod != "" {
+		return fmt.Errorf("--reuse-service can not be used with --existing-pod: no service is created")
+	}
+	if err := tunnel.ValidateController(o.Controller); err != nil {
+		return err
+	}
+	if o.Controller == tunnel.ControllerDeployment {
+		switch {
+		case o.ExistingPod != "":
+			return fmt.Errorf("--controller can not be used with --existing-pod")
+		case o.UsePrewarmed:
+			return fmt.Errorf("--controller=deployment can not be used with --use-prewarmed: prewarmed pods are bare pods")
+		case o.PodMaxLifetime > 0:
+			return fmt.Errorf("--controller=deployment can not be used with --pod-max-lifetime: the pods of a Deployment can not have a deadline")
+		}
+	}
+	if o.WaitEndpoints && o.ExistingPod != "" {
+		return fmt.Errorf("--wait-endpoints can not be used with --existing-pod: no service is created")
+	}
+	if o.ServiceType != "" && o.ExistingPod != "" {
+		return fmt.Errorf("--service-type can not be used with --existing-pod: no service is created")
+	}
+	if o.ServiceAnnotations, err = parseKeyValues("service-annotation", cmdutil.GetFlagStringArray(cmd, "service-annotation"), false); err != nil {
+		return err
+	}
+	if len(o.ServiceAnnotations) > 0 && o.ExistingPod != "" {
+		return fmt.Errorf("--service-annotation can not be used with --existing-pod: no service is created")
+	}
+	if o.InternalTrafficPolicy != "" && o.ExistingPod != "" {
+		return fmt.Errorf("--internal-traffic-policy can not be used with --existing-pod: no service is created")
+	}
+	switch corev1.ServiceInternalTrafficPolicyType(o.InternalTrafficPolicy) {
+	case "", corev1.ServiceInternalTrafficPolicyCluster:
+	case corev1.ServiceInternalTrafficPolicyLocal:
+		klog.Warningf("Using --internal-traffic-policy=Local: clients on other nodes than the one of the tunnel pod can not reach the service.")
+	default:
+		return fmt.Errorf("invalid --internal-traffic-policy %q: must be \"Cluster\" or \"Local\"", o.InternalTrafficPolicy)
+	}
+	if o.SSHKeySecret != "" {
+		if o.SSHPrivateKeyPath != "" {
+			return fmt.Errorf("--ssh-key-secret and --ssh-private-key are mutually exclusive")
+		}
+		if err := tunnel.ValidateSSHKeySecret(o.SSHKeySecret); err != nil {
+			return err
+		}
+	}
+	if o.SSHMaxStartups != "" && !maxStartupsRegexp.MatchString(o.SSHMaxStartups) {
+		return fmt.Errorf("invalid --ssh-max-startups %q: must be in the format \"start:rate:full\" or \"full\"", o.SSHMaxStartups)
+	}
+	return nil
+}
+
+// fileConflictingFlags can not be used with --filename, since they either set
+// the mappings of a single tunnel or a resource that can not be shared.
+var fileConflictingFlags = []string{"generate-name", "ports-file", "watch-ports", "mirror-service", "from-process", "existing-pod", "local-ssh-port", "remote-ssh-port", "metrics-addr", "idle-timeout"}
+
+// CompleteFile returns the configuration of every tunnel declared in the
+// --filename file. Each entry is completed like the arguments of a single
+// tunnel, with the flags in o as defaults.
+func CompleteFile(o *tunnel.TunnelConfig, f cmdutil.Factory, cmd *cobra.Command, args []string) ([]tunnel.TunnelConfig, error) {
+	path := cmdutil.GetFlagString(cmd, "filename")
+	if len(args) > 0 {
+		return nil, cmdutil.UsageErrorf(cmd, "SERVICE_NAME and TARGET_ADDR:SERVICE_PORT arguments can not be used with --filename")
+	}
+	for _, flag := range fileConflictingFlags {
+		if cmd.Flags().Changed(flag) {
+			return nil, fmt.Errorf("--%s can not be used with --filename", flag)
+		}
+	}
+	file, err := readTunnelsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var portRange net.PortRange
+	if s := cmdutil.GetFlagString(cmd, "local-port-range"); s != "" {
+		if portRange, err = net.ParsePortRange(s); err != nil {
+			return nil, err
+		}
+	}
+
+	configs := make([]tunnel.TunnelConfig, 0, len(file.Tunnels))
+	names := make(map[string]bool)
+	localSSHPorts := make(map[int]bool)
+	for _, e := range file.Tunnels {
+		c := *o
+		if e.Image != "" {
+			c.Image = e.Image
+		}
+		if e.ServiceType != "" {
+			c.ServiceType = e.ServiceType
+		}
+		if err := Complete(&c, f, cmd, append([]string{e.Name}, e.Ports...)); err != nil {
+			return nil, fmt.Errorf("tunnel %q in %s: %v", e.Name, path, err)
+		}
+		if e.Namespace != "" {
+			c.Namespace, c.EnforceNamespace = e.Namespace, true
+		}
+		key := c.Namespace + "/" + c.Name
+		if names[key] {
+			return nil, fmt.Errorf("tunnel %q in %s: declared more than once", e.Name, path)
+		}
+		names[key] = true
+		// The free local ports are picked independently for every
+		// tunnel.
+		for localSSHPorts[c.LocalSSHPort] {
+			if c.LocalSSHPort, err = net.GetFreeLocalPort(portRange); err != nil {
+				return nil, fmt.Errorf("error choosing the local port for the SSH connection: %v", err)
+			}
+		}
+		localSSHPorts[c.LocalSSHPort] = true
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// completeMappings builds the port mappings of o from o.RawPortMappings, the
+// --ports-file, --from-process and --mirror-service flags and applies the
+// source address filters.
+func completeMappings(o *tunnel.TunnelConfig, cmd *cobra.Command) ([]port.Mapping, error) {
+	rawMappings := o.RawPortMappings
+	if portsFile := cmdutil.GetFlagString(cmd, "ports-file"); portsFile != "" {
+		fileMappings, err := readPortsFile(portsFile)
+		if err != nil {
+			return nil, err
+		}
+		rawMappings = append(append([]string{}, rawMappings...), fileMappings...)
+	}
+	mm, err := port.ParseMappings(rawMappings)
+	if err != nil {
+		return nil, err
+	}
+	if fromProcess := cmdutil.GetFlagString(cmd, "from-process"); fromProcess != "" {
+		pm, err := processMappings(fromProcess, cmdutil.GetFlagInt(cmd, "from-process-port"))
+		if err != nil {
+			return nil, err
+		}
+		mm = append(mm, pm...)
+	}
+	mirrorService := cmdutil.GetFlagString(cmd, "mirror-service")
+	if mirrorService != "" && o.ClientSet == nil {
+		klog.Warningf("Not checking the ports of --mirror-service %q: requires cluster access.", mirrorService)
+	} else if mirrorService != "" {
+		sm, err := serviceMappings(cmd.Context(), o.ClientSet, o.Namespace, mirrorService, cmdutil.GetFlagString(cmd, "target"))
+		if err != nil {
+			return nil, err
+		}
+		mm = append(mm, sm...)
+	}
+	if err := port.CheckDuplicates(mm); err != nil {
+		return nil, err
+	}
+	for _, m := range mm {
+		if m.ContainerPortName == "ssh" {
+			return nil, fmt.Errorf("port name \"ssh\" is reserved for the SSH port of the tunnel")
+		}
+	}
+	if err := applyCIDRFilters(mm, cmdutil.GetFlagStringArray(cmd, "allow-cidr"), false); err != nil {
+		return nil, err
+	}
+	if err := applyCIDRFilters(mm, cmdutil.GetFlagStringArray(cmd, "deny-cidr"), true); err != nil {
+		return nil, err
+	}
+	rewriteHosts := cmdutil.GetFlagStringArray(cmd, "rewrite-host")
+	httpMode := cmdutil.GetFlagBool(cmd, "http-mode")
+	if httpMode && len(rewriteHosts) == 0 {
+		return nil, fmt.Errorf("--http-mode requires --rewrite-host")
+	}
+	if !httpMode && len(rewriteHosts) > 0 {
+		return nil, fmt.Errorf("--rewrite-host requires --http-mode")
+	}
+	if err := applyRewriteHosts(mm, rewriteHosts); err != nil {
+		return nil, err
+	}
+	return mm, nil
+}
+
+// hasServicePorts reports whether any of mm is exposed in the service.
+func hasServicePorts(mm []port.Mapping) bool {
+	for _, m := range mm {
+		if !m.ServiceHidden {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUDPMappings reports whether any of mm forwards UDP.
+func hasUDPMappings(mm []port.Mapping) bool {
+	for _, m := range mm {
+		if m.Protocol == port.ProtocolUDP {
+			return true
+		}
+	}
+	return false
+}
+
+// namedMapping returns the name of the first named container port of mm, if
+// any.
+func namedMapping(mm []port.Mapping) string {
+	for _, m := range mm {
+		if m.ContainerPortName != "" {
+			return m.ContainerPortName
+		}
+	}
+	return ""
+}
+
+// readPortsFile reads port mappings from path. The file contains mappings
+// in the same format as the arguments, separated by whitespace or newlines.
+// Everything after a "#" in a line is ignored.
+func readPortsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ports file: %v", err)
+	}
+	var rawMappings []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		rawMappings = append(rawMappings, strings.Fields(line)...)
+	}
+	return rawMappings, nil
+}
+
+// reloadMappings reloads the port mappings of tun whenever one of the
+// reloadSignals is received or, if watch is set, the ports file changes.
+func reloadMappings(ctx context.Context, tun *tunnel.Tunnel, o *tunnel.TunnelConfig, cmd *cobra.Command, watch bool) {
+	sig := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(sig, reloadSignals...)
+		defer signal.Stop(sig)
+	}
+
+	// Poll the modification time of the ports file, which works the same
+	// on all platforms and for files replaced by editors.
+	var poll <-chan time.Time
+	portsFile := cmdutil.GetFlagString(cmd, "ports-file")
+	lastMod := modTime(portsFile)
+	if watch {
+		ticker := time.NewTicker(portsFilePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-sig:
+			klog.Infof("Reloading port mappings...")
+		case <-poll:
+			mod := modTime(portsFile)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			klog.Infof("Ports file %s changed: reloading port mappings...", portsFile)
+		case <-ctx.Done():
+			return
+		}
+		mm, err := completeMappings(o, cmd)
+		if err != nil {
+			klog.Errorf("Not reloading port mappings: %v", err)
+			continue
+		}
+		if err := tun.UpdatePortMappings(ctx, mm); err != nil {
+			klog.Errorf("Error updating port mappings: %v", err)
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// printCheckSummary prints the validated configuration of a tunnel.
+func printCheckSummary(streams genericclioptions.IOStreams, o *tunnel.TunnelConfig) {
+	fmt.Fprintf(streams.Out, "Tunnel %q is valid. SSH port: %d\n", o.Name, o.RemoteSSHPort)
+	w := printers.GetNewTabWriter(streams.Out)
+	fmt.Fprintln(w, "SERVICE PORT\tTARGET\tNAME\tIN SERVICE\tALLOW\tDENY")
+	for _, m := range o.PortMappings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\n", m.ContainerPort(), m.TargetAddress(), orNone(m.ContainerPortName), !m.ServiceHidden, joinCIDRs(m.AllowCIDRs), joinCIDRs(m.DenyCIDRs))
+	}
+	w.Flush()
+}
+
+func joinCIDRs(nn []*gonet.IPNet) string {
+	return orNone(strings.Join(cidrStrings(nn), ","))
+}
+
+func cidrStrings(nn []*gonet.IPNet) []string {
+	var ss []string
+	for _, n := range nn {
+		ss = append(ss, n.String())
+	}
+	return ss
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+// serviceMappings builds port mappings for all ports of the Service name in
+// namespace. Every port is tunneled to the same port number on target.
+func serviceMappings(ctx context.Context, cs kubernetes.Interface, namespace, name, target string) ([]port.Mapping, error) {
+	svc, err := cs.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting Service %q to mirror: %v", name, err)
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return nil, fmt.Errorf("Service %q to mirror has no ports", name)
+	}
+
+	targetIP := gonet.ParseIP(target)
+	if targetIP == nil {
+		addr, err := gonet.ResolveIPAddr("ip4", target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --target %q: %v", target, err)
+		}
+		targetIP = addr.IP
+	}
+	if targetIP.To4() == nil {
+		return nil, fmt.Errorf("invalid --target %q: IPv6 targets are not supported", target)
+	}
+
+	var mm []port.Mapping
+	for _, sp := range svc.Spec.Ports {
+		raw := fmt.Sprintf("%s:%d:%d/%s", targetIP, sp.Port, sp.Port, strings.ToLower(string(sp.Protocol)))
+		m, err := port.ParseMapping(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error mirroring port %q of Service %q: %v", sp.Name, name, err)
+		}
+		klog.V(1).Infof("Mirroring port %d/%s of Service %q to %s", sp.Port, sp.Protocol, name, m.TargetAddress())
+		mm = append(mm, m)
+	}
+	return mm, nil
+}
+
+// processMappings builds the port mappings for the ports the local process
+// identified by process listens on. If containerPort is set, the process must
+// listen on a single port only, which is mapped to containerPort. Otherwise
+// every port is mapped to the same container port.
+func processMappings(process string, containerPort int) ([]port.Mapping, error) {
+	ll, err := proc.ListeningPorts(process)
+	if err != nil {
+		return nil, err
+	}
+	if containerPort != 0 && len(ll) > 1 {
+		var ports []string
+		for _, l := range ll {
+			ports = append(ports, strconv.Itoa(l.Port))
+		}
+		return nil, fmt.Errorf("process %q listens on multiple ports (%s): use TARGET_ADDR:SERVICE_PORT arguments instead of --from-process-port", process, strings.Join(ports, ", "))
+	}
+	var mm []port.Mapping
+	for _, l := range ll {
+		ip := l.TargetIP()
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("process %q listens on IPv6 address %s only: IPv6 targets are not supported", process, ip)
+		}
+		cp := l.Port
+		if containerPort != 0 {
+			cp = containerPort
+		}
+		m, err := port.ParseMapping(fmt.Sprintf("%s:%d:%d", ip, l.Port, cp))
+		if err != nil {
+			return nil, err
+		}
+		klog.V(1).Infof("Process %q (pid %d) listens on %s:%d: tunneling from service port %d", process, l.PID, ip, l.Port, cp)
+		mm = append(mm, m)
+	}
+	return mm, nil
+}
+
+// portsFilePollInterval is the interval the ports file is checked for changes
+// with --watch-ports.
+const portsFilePollInterval = 2 * time.Second
+
+// maxStartupsRegexp matches valid values of the MaxStartups sshd setting. The
+// value is written into the sshd configuration, so it must not contain
+// anything else.
+var maxStartupsRegexp = regexp.MustCompile(`^[0-9]+(:[0-9]+:[0-9]+)?$`)
+
+// validateRemoteSSHPort checks the SSH port set with --remote-ssh-port.
+func validateRemoteSSHPort(o *tunnel.TunnelConfig) error {
+	p := o.RemoteSSHPort
+	switch {
+	case p < 1 || p > 65535:
+		return fmt.Errorf("invalid --remote-ssh-port %d: must be between 1 and 65535", p)
+	case o.ExistingPod != "":
+		return fmt.Errorf("--remote-ssh-port can not be used with --existing-pod: the SSH port is read from the pod")
+	case o.UsePrewarmed:
+		return fmt.Errorf("--remote-ssh-port can not be used with --use-prewarmed: the SSH port of a prewarmed pod is already set")
+	case net.IsInUse(o.PortMappings, p):
+		return fmt.Errorf("--remote-ssh-port %d conflicts with the port mapping to container port %d: choose a different port", p, p)
+	case o.HostNetwork && p == 22:
+		return fmt.Errorf("--remote-ssh-port 22 can not be used with --host-network: the port is usually taken by the SSH daemon of the node")
+	}
+	return nil
+}
+
+// validateAddresses checks that every address in addresses is an IP address
+// or "localhost" and warns about non-loopback addresses.
+func validateAddresses(addresses []string) error {
+	for _, addr := range addresses {
+		if addr == "localhost" {
+			continue
+		}
+		ip := gonet.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid --address %q: only IP addresses and localhost are allowed", addr)
+		}
+		if !ip.IsLoopback() {
+			klog.Warningf("Listening on non-loopback address %s: the SSH server of the tunnel is reachable from other machines.", addr)
+		}
+	}
 	return nil
 }
+
+// parseTolerations parses the --toleration flags in the format
+// "KEY[=VALUE][:EFFECT]". Without a value, any value of the taint is
+// tolerated and without an effect, all effects are.
+func parseTolerations(rawTolerations []string) ([]corev1.Toleration, error) {
+	var tolerations []corev1.Toleration
+	for _, raw := range rawTolerations {
+		t := corev1.Toleration{Operator: corev1.TolerationOpExists}
+		spec := raw
+		if i := strings.LastIndex(spec, ":"); i >= 0 {
+			t.Effect = corev1.TaintEffect(spec[i+1:])
+			spec = spec[:i]
+			switch t.Effect {
+			case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			default:
+				return nil, fmt.Errorf("invalid --toleration %q: effect must be NoSchedule, PreferNoSchedule or NoExecute", raw)
+			}
+		}
+		t.Key = spec
+		if i := strings.Index(spec, "="); i >= 0 {
+			t.Key, t.Value, t.Operator = spec[:i], spec[i+1:], corev1.TolerationOpEqual
+			if errs := validation.IsValidLabelValue(t.Value); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid --toleration %q: %s", raw, strings.Join(errs, ", "))
+			}
+		}
+		if errs := validation.IsQualifiedName(t.Key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid --toleration %q: %s", raw, strings.Join(errs, ", "))
+		}
+		tolerations = append(tolerations, t)
+	}
+	return tolerations, nil
+}
+
+// podResources parses the resource requests and limits of the tunnel pod from
+// the --request-* and --limit-* flags.
+func podResources(cmd *cobra.Command) (corev1.ResourceRequirements, error) {
+	var resources corev1.ResourceRequirements
+	for _, r := range []struct {
+		flag string
+		list *corev1.ResourceList
+		name corev1.ResourceName
+	}{
+		{"request-cpu", &resources.Requests, corev1.ResourceCPU},
+		{"request-memory", &resources.Requests, corev1.ResourceMemory},
+		{"limit-cpu", &resources.Limits, corev1.ResourceCPU},
+		{"limit-memory", &resources.Limits, corev1.ResourceMemory},
+	} {
+		raw := cmdutil.GetFlagString(cmd, r.flag)
+		if raw == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(raw)
+		if err != nil {
+			return resources, fmt.Errorf("invalid --%s %q: %v", r.flag, raw, err)
+		}
+		if *r.list == nil {
+			*r.list = corev1.ResourceList{}
+		}
+		(*r.list)[r.name] = q
+	}
+	return resources, nil
+}
+
+// parseKeyValues parses the values of the repeatable flag in the format
+// "KEY=VALUE", e.g. labels and annotations. Keys must be qualified names. If
+// label is true, values must be valid label values.
+func parseKeyValues(flag string, rawValues []string, label bool) (map[string]string, error) {
+	if len(rawValues) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, raw := range rawValues {
+		i := strings.Index(raw, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --%s %q: must be in the format KEY=VALUE", flag, raw)
+		}
+		key, value := raw[:i], raw[i+1:]
+		errs := validation.IsQualifiedName(key)
+		if label {
+			errs = append(errs, validation.IsValidLabelValue(value)...)
+		}
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("invalid --%s %q: %s", flag, raw, strings.Join(errs, ", "))
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// parseEnv parses environment variables in the format NAME=VALUE. The order
+// is kept, so that later values of the same variable take precedence.
+func parseEnv(rawEnv []string) ([]corev1.EnvVar, error) {
+	var env []corev1.EnvVar
+	for _, raw := range rawEnv {
+		i := strings.Index(raw, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --env %q: must be in the format NAME=VALUE", raw)
+		}
+		name, value := raw[:i], raw[i+1:]
+		if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid --env %q: %s", raw, strings.Join(errs, ", "))
+		}
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	return env, nil
+}
+
+// applyRewriteHosts parses the Host header rewrites in the format
+// "[SERVICE_PORT=]HOST" and marks the matching TCP mappings as HTTP. Without
+// a port, all TCP mappings are marked.
+func applyRewriteHosts(mm []port.Mapping, rawRewrites []string) error {
+	for _, raw := range rawRewrites {
+		rawPort, host := "", raw
+		if i := strings.Index(raw, "="); i >= 0 {
+			rawPort, host = raw[:i], raw[i+1:]
+		}
+		if host == "" {
+			return fmt.Errorf("invalid --rewrite-host %q: empty host", raw)
+		}
+		containerPort := 0
+		if rawPort != "" {
+			var err error
+			containerPort, err = strconv.Atoi(rawPort)
+			if err != nil {
+				return fmt.Errorf("invalid port number in %q: %v", raw, err)
+			}
+		}
+		matched := false
+		for i := range mm {
+			if containerPort != 0 && mm[i].ContainerPortNumber != containerPort {
+				continue
+			}
+			if mm[i].Protocol != port.ProtocolTCP {
+				continue
+			}
+			matched = true
+			mm[i].RewriteHost = host
+		}
+		if !matched && containerPort == 0 {
+			return fmt.Errorf("invalid --rewrite-host %q: no TCP port mapping", raw)
+		}
+		if !matched {
+			return fmt.Errorf("invalid --rewrite-host %q: no TCP port mapping for service port %d", raw, containerPort)
+		}
+	}
+	return nil
+}
+
+// applyCIDRFilters parses the source address filters in the format
+// [SERVICE_PORT=]CIDR and adds them to the allow or deny list of the matching
+// port mappings. Filters without a port apply to all port mappings.
+func applyCIDRFilters(mm []port.Mapping, rawFilters []string, deny bool) error {
+	for _, raw := range rawFilters {
+		rawPort, rawCIDR := "", raw
+		if i := strings.Index(raw, "="); i >= 0 {
+			rawPort, rawCIDR = raw[:i], raw[i+1:]
+		}
+		_, ipNet, err := gonet.ParseCIDR(rawCIDR)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q: %v", raw, err)
+		}
+		containerPort := 0
+		if rawPort != "" {
+			containerPort, err = strconv.Atoi(rawPort)
+			if err != nil {
+				return fmt.Errorf("invalid port number in %q: %v", raw, err)
+			}
+		}
+		matched := false
+		for i := range mm {
+			if containerPort != 0 && mm[i].ContainerPortNumber != containerPort {
+				continue
+			}
+			matched = true
+			if deny {
+				mm[i].DenyCIDRs = append(mm[i].DenyCIDRs, ipNet)
+			} else {
+				mm[i].AllowCIDRs = append(mm[i].AllowCIDRs, ipNet)
+			}
+		}
+		if !matched {
+			return fmt.Errorf("invalid CIDR filter %q: no port mapping for service port %d", raw, containerPort)
+		}
+	}
+	return nil
+}
+
+// runTunnels runs a tunnel for every config concurrently. It returns once ctx
+// is done or any of the tunnels ended, after stopping all of them. If a tunnel
+// fails to start, the others are stopped as well.
+func runTunnels(ctx context.Context, configs []tunnel.TunnelConfig, diagnosticsDir string, streams genericclioptions.IOStreams, output string) error {
+	ctx, cancel := graceful.WithKill(ctx)
+	defer cancel()
+	ctx, interruptCancel := graceful.WithInterrupt(ctx)
+	defer interruptCancel()
+
+	tuns := make([]*tunnel.Tunnel, len(configs))
+	for i := range configs {
+		tuns[i] = tunnel.NewTunnel(configs[i])
+	}
+	defer stopTunnels(tuns)
+	// Stopping tunnels that are still running is like an interrupt.
+	runCtx, runCancel := context.WithCancel(ctx)
+	defer runCancel()
+
+	errs := make(chan error, len(tuns))
+	for _, tun := range tuns {
+		go func(tun *tunnel.Tunnel) {
+			_, err := tun.Run(runCtx)
+			if err != nil {
+				err = fmt.Errorf("tunnel %q: %v", tun.Name, err)
+			}
+			errs <- err
+		}(tun)
+	}
+	var runErr error
+	for range tuns {
+		if err := <-errs; err != nil && runErr == nil {
+			runErr = err
+			runCancel()
+		}
+	}
+	if runErr != nil {
+		return runErr
+	}
+	klog.Infof("All %d tunnels are ready.", len(tuns))
+	if output == "json" {
+		for _, tun := range tuns {
+			if err := printReady(streams.Out, tun); err != nil {
+				klog.Errorf("Error printing tunnel %q: %v", tun.Name, err)
+			}
+		}
+	}
+
+	done := make(chan *tunnel.Tunnel, len(tuns))
+	for _, tun := range tuns {
+		go writeDiagnosticsOnSignal(runCtx, tun, diagnosticsDir, streams)
+		go func(tun *tunnel.Tunnel) {
+			select {
+			case <-tun.Done():
+				done <- tun
+			case <-runCtx.Done():
+			}
+		}(tun)
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case tun := <-done:
+		if err := tun.Err(); err != nil {
+			return fmt.Errorf("tunnel %q: %v", tun.Name, err)
+		}
+		klog.Infof("Tunnel %q ended: stopping all tunnels.", tun.Name)
+		return nil
+	}
+}
+
+// stopTunnels stops all tuns concurrently, so that their connections are
+// drained at the same time.
+func stopTunnels(tuns []*tunnel.Tunnel) {
+	var wg sync.WaitGroup
+	for _, tun := range tuns {
+		wg.Add(1)
+		go func(tun *tunnel.Tunnel) {
+			defer wg.Done()
+			tun.Stop(context.Background())
+		}(tun)
+	}
+	wg.Wait()
+}
+
+// writeDiagnosticsOnSignal writes a diagnostics snapshot of tun to dir
+// whenever one of the diagnosticsSignals is received until ctx is done.
+func writeDiagnosticsOnSignal(ctx context.Context, tun *tunnel.Tunnel, dir string, streams genericclioptions.IOStreams) {
+	if len(diagnosticsSignals) == 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, diagnosticsSignals...)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-sig:
+			path, err := tun.WriteDiagnostics(dir)
+			if err != nil {
+				klog.Errorf("Error writing diagnostics: %v", err)
+				continue
+			}
+			fmt.Fprintf(streams.ErrOut, "Wrote diagnostics to %s\n", path)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// jsonEventWriter returns a tunnel.TunnelConfig.OnEvent callback that writes
+// every event as a single line JSON object to streams.Out.
+func jsonEventWriter(streams genericclioptions.IOStreams) func(tunnel.Event) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(streams.Out)
+	return func(e tunnel.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(e); err != nil {
+			fmt.Fprintf(streams.ErrOut, "Failed to write event: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// TunnelsFile is the schema of the file set with --filename. It declares
+// multiple tunnels that are run by a single kubetnl process:
+//
+//	tunnels:
+//	- name: myservice
+//	  ports: ["8080:80", "9090:90"]
+//	- name: mydns
+//	  namespace: dns
+//	  serviceType: NodePort
+//	  ports: ["5353:53/udp"]
+type TunnelsFile struct {
+	Tunnels []TunnelEntry `json:"tunnels"`
+}
+
+// TunnelEntry declares a single tunnel of a TunnelsFile. Fields that are not
+// set default to the flags of "kubetnl tunnel".
+type TunnelEntry struct {
+	// Name is the SERVICE_NAME of the tunnel.
+	Name string `json:"name"`
+
+	// Namespace defaults to the namespace of the current context.
+	Namespace string `json:"namespace,omitempty"`
+
+	Image       string `json:"image,omitempty"`
+	ServiceType string `json:"serviceType,omitempty"`
+
+	// Ports are port mappings in the TARGET_ADDR:SERVICE_PORT format of
+	// the arguments.
+	Ports []string `json:"ports"`
+}
+
+// readTunnelsFile reads and validates the TunnelsFile at path. Unknown
+// fields are rejected, so that typos do not go unnoticed.
+func readTunnelsFile(path string) (*TunnelsFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tunnels file: %v", err)
+	}
+	var file TunnelsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing tunnels file %s: %v", path, err)
+	}
+	if len(file.Tunnels) == 0 {
+		return nil, fmt.Errorf("invalid tunnels file %s: no tunnels declared", path)
+	}
+	for i, e := range file.Tunnels {
+		if e.Name == "" {
+			return nil, fmt.Errorf("invalid tunnels file %s: tunnel %d has no name", path, i+1)
+		}
+		if len(e.Ports) == 0 {
+			return nil, fmt.Errorf("invalid tunnels file %s: tunnel %q has no ports", path, e.Name)
+		}
+		if errs := validation.IsDNS1123Label(e.Namespace); e.Namespace != "" && len(errs) > 0 {
+			return nil, fmt.Errorf("invalid tunnels file %s: invalid namespace %q of tunnel %q: %s", path, e.Namespace, e.Name, strings.Join(errs, ", "))
+		}
+	}
+	return &file, nil
+}
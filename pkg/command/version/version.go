@@ -1,53 +1,91 @@
 package version
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/spf13/cobra"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/util/templates"
 
+	"github.com/pschmitt/kubetnl/pkg/tunnel"
 	"github.com/pschmitt/kubetnl/pkg/version"
 )
 
 type VersionOptions struct {
 	genericclioptions.IOStreams
-	Short bool
+	Short  bool
+	Output string
 }
 
 var (
 	versionExample = templates.Examples(`
-                # Print the version number and git commit SHA.
+                # Print the version number, git commit SHA and default tunnel image.
                 kubetnl version
 
 		# Print the version number only and omit the git commit SHA.
-                kubetnl version --short`)
+                kubetnl version --short
+
+		# Print the version information as JSON.
+		kubetnl version -o json`)
 )
 
+// versionOutput is the JSON object printed with --output=json.
+type versionOutput struct {
+	version.Info
+
+	// DefaultImage is the image "kubetnl tunnel" runs the tunnel pod with
+	// unless --image is set.
+	DefaultImage string `json:"defaultImage"`
+}
+
 func NewVersionCommand(streams genericclioptions.IOStreams) *cobra.Command {
 	o := &VersionOptions{
 		IOStreams: streams,
 	}
 
 	cmd := &cobra.Command{
-		Use:     "version [--short]",
+		Use:     "version [--short | --output=json]",
 		Short:   "Print the kubetnl version",
 		Example: versionExample,
 		Run: func(cmd *cobra.Command, args []string) {
-			o.Run()
+			cmdutil.CheckErr(o.Validate())
+			cmdutil.CheckErr(o.Run())
 		},
 	}
 
 	cmd.Flags().BoolVar(&o.Short, "short", o.Short, "If true, just prints the version number and omits git commit SHA.")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", o.Output, "If set to \"json\", print the version, git commit SHA and default tunnel image as a JSON object.")
 
 	return cmd
 }
 
-func (o *VersionOptions) Run() {
+func (o *VersionOptions) Validate() error {
+	switch o.Output {
+	case "":
+		return nil
+	case "json":
+		if o.Short {
+			return fmt.Errorf("--short can not be used with --output")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid --output %q: only \"json\" is supported", o.Output)
+}
+
+func (o *VersionOptions) Run() error {
 	i := version.Get()
-	if o.Short {
+	switch {
+	case o.Output == "json":
+		enc := json.NewEncoder(o.Out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(versionOutput{Info: i, DefaultImage: tunnel.DefaultTunnelImage})
+	case o.Short:
 		fmt.Fprintf(o.Out, "%s\n", i.Version)
-	} else {
+	default:
 		fmt.Fprintf(o.Out, "%s at %s\n", i.Version, i.GitCommit)
+		fmt.Fprintf(o.Out, "Default tunnel image: %s\n", tunnel.DefaultTunnelImage)
 	}
+	return nil
 }
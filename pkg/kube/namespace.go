@@ -0,0 +1,38 @@
+package kube
+
+import (
+	"os"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// serviceAccountNamespaceFile holds the namespace of the pod in containers
+// that have a service account token mounted.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Namespace returns the namespace to use like clientcmd.ClientConfig does
+// and whether it was set explicitly with --namespace. If neither --namespace
+// nor the current kubeconfig context set a namespace and kubetnl runs inside
+// a pod, the namespace of the pod is used instead of "default".
+func Namespace(loader clientcmd.ClientConfig) (string, bool, error) {
+	namespace, enforce, err := loader.Namespace()
+	if err != nil || enforce {
+		return namespace, enforce, err
+	}
+	if raw, err := loader.RawConfig(); err == nil {
+		if c, ok := raw.Contexts[raw.CurrentContext]; ok && c.Namespace != "" {
+			return namespace, enforce, nil
+		}
+	}
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return namespace, enforce, nil
+	}
+	if ns := strings.TrimSpace(string(data)); ns != "" {
+		klog.V(2).Infof("Using namespace %q of the service account token.", ns)
+		return ns, enforce, nil
+	}
+	return namespace, enforce, nil
+}
@@ -0,0 +1,40 @@
+package kube
+
+import (
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestNamespace(t *testing.T) {
+	config := clientcmdapi.Config{
+		CurrentContext: "ctx",
+		Contexts: map[string]*clientcmdapi.Context{
+			"ctx": {Cluster: "cluster", Namespace: "context-ns"},
+		},
+		Clusters: map[string]*clientcmdapi.Cluster{
+			"cluster": {Server: "https://127.0.0.1:6443"},
+		},
+	}
+	tests := []struct {
+		name          string
+		flagNamespace string
+		wantNamespace string
+		wantEnforce   bool
+	}{
+		{name: "context namespace", wantNamespace: "context-ns"},
+		{name: "explicit --namespace", flagNamespace: "flag-ns", wantNamespace: "flag-ns", wantEnforce: true},
+	}
+	for _, tt := range tests {
+		overrides := &clientcmd.ConfigOverrides{Context: clientcmdapi.Context{Namespace: tt.flagNamespace}}
+		namespace, enforce, err := Namespace(clientcmd.NewDefaultClientConfig(config, overrides))
+		if err != nil {
+			t.Errorf("%s: Namespace failed: %v", tt.name, err)
+			continue
+		}
+		if namespace != tt.wantNamespace || enforce != tt.wantEnforce {
+			t.Errorf("%s: Namespace returned (%q, %t), want (%q, %t)", tt.name, namespace, enforce, tt.wantNamespace, tt.wantEnforce)
+		}
+	}
+}
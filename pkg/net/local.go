@@ -0,0 +1,82 @@
+package net
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/phayes/freeport"
+)
+
+// PortRange is an inclusive range of local port numbers. The zero value
+// allows any port.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses a port range in the format "MIN-MAX".
+func ParsePortRange(s string) (PortRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return PortRange{}, fmt.Errorf("invalid port range %q: must be in the format MIN-MAX", s)
+	}
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	max, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("invalid port range %q: must be within 1-65535 and MIN must not be greater than MAX", s)
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// IsZero reports whether r allows any port.
+func (r PortRange) IsZero() bool {
+	return r == PortRange{}
+}
+
+// GetFreeLocalPort returns a local port within r that is free to listen on.
+// If r is the zero value any free port is returned. The ports of the range
+// are tried starting at a random one, so that concurrent callers are
+// unlikely to pick the same port.
+func GetFreeLocalPort(r PortRange) (int, error) {
+	if r.IsZero() {
+		return freeport.GetFreePort()
+	}
+	n := r.Max - r.Min + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		p := r.Min + (start+i)%n
+		l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(p)))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return p, nil
+	}
+	return 0, fmt.Errorf("no free local port in range %s", r)
+}
+
+// CheckLocalPort returns an error if p is not free to listen on on one of the
+// local addresses.
+func CheckLocalPort(addresses []string, p int) error {
+	for _, addr := range addresses {
+		l, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(p)))
+		if err != nil {
+			return fmt.Errorf("local port %d is not free on %s: %v", p, addr, err)
+		}
+		l.Close()
+	}
+	return nil
+}
@@ -9,24 +9,42 @@ import (
 // GetFreeSSHPortInContainer chooses the port number for the SSH server respecting the ports
 // that are used for incoming traffic.
 func GetFreeSSHPortInContainer(mm []port.Mapping) (int, error) {
-	if !isInUse(mm, 2222) {
+	if !IsInUse(mm, 2222) {
 		return 2222, nil
 	}
 	// TODO: for 22 portforwarding somewhat never works.
-	if !isInUse(mm, 22) {
+	if !IsInUse(mm, 22) {
 		return 22, nil
 	}
 	min := 49152
 	max := 65535
 	for i := min; i <= max; i++ {
-		if !isInUse(mm, i) {
+		if !IsInUse(mm, i) {
 			return i, nil
 		}
 	}
 	return 0, fmt.Errorf("Failed to choose a port for the SSH connection - all ports in use")
 }
 
-func isInUse(mm []port.Mapping, containerPort int) bool {
+// GetFreeSSHPortOnNode is like GetFreeSSHPortInContainer but never chooses
+// port 22, since that one is used by the SSH daemon of most nodes. Use it for
+// pods running in the network namespace of their node.
+func GetFreeSSHPortOnNode(mm []port.Mapping) (int, error) {
+	if !IsInUse(mm, 2222) {
+		return 2222, nil
+	}
+	min := 49152
+	max := 65535
+	for i := min; i <= max; i++ {
+		if !IsInUse(mm, i) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Failed to choose a port for the SSH connection - all ports in use")
+}
+
+// IsInUse reports whether containerPort is used by one of the mappings in mm.
+func IsInUse(mm []port.Mapping, containerPort int) bool {
 	for _, m := range mm {
 		if m.ContainerPortNumber == containerPort {
 			return true
@@ -3,8 +3,12 @@ package port
 import (
 	"fmt"
 	"net"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 type Protocol string
@@ -29,11 +33,45 @@ func (p Port) String() string {
 }
 
 type Mapping struct {
+	// TargetIP is the IP address or DNS name of the target. DNS names are
+	// resolved on the machine running kubetnl whenever a connection to
+	// the target is opened, so that private DNS zones and changed records
+	// are honored.
 	TargetIP            string
 	TargetPortNumber    int
 	ContainerPortNumber int
 	Protocol            Protocol
 
+	// TargetSocket is the path of a Unix domain socket on the machine
+	// running kubetnl. If set, connections are forwarded to the socket
+	// instead of TargetIP and TargetPortNumber. Set with a "unix:" prefix
+	// in the raw mapping.
+	TargetSocket string
+
+	// ContainerPortName optionally names the container port. If set, the
+	// service targets the container port by its name.
+	ContainerPortName string
+
+	// AppProtocol optionally sets the appProtocol of the service port,
+	// e.g. "http" or "grpc", which service meshes and ingress controllers
+	// route by. Set with a ":" suffix after the protocol in the raw
+	// mapping.
+	AppProtocol string
+
+	// ServiceHidden excludes the mapping from the ports of the Service.
+	// The container port is still forwarded, but only reachable via the
+	// pod itself. Set with a trailing "!" in the raw mapping.
+	ServiceHidden bool
+
+	// RewriteHost marks the mapping as HTTP. If set, the Host header of
+	// all requests forwarded to the target is set to RewriteHost.
+	RewriteHost string
+
+	// AllowCIDRs and DenyCIDRs optionally restrict the source addresses
+	// connections to the container port are forwarded from.
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+
 	// The raw mapping string as passed to the command line.
 	raw string
 }
@@ -42,15 +80,29 @@ func (m *Mapping) ContainerPort() Port {
 	return Port{Number: m.ContainerPortNumber, Protocol: m.Protocol}
 }
 
-// TargetAddress returns the target address in format <host>:<port>.
+// TargetAddress returns the target address in format <host>:<port>, or the
+// path of the socket if TargetSocket is set.
 func (m *Mapping) TargetAddress() string {
-	return fmt.Sprintf("%s:%d", m.TargetIP, m.TargetPortNumber)
+	if m.TargetSocket != "" {
+		return m.TargetSocket
+	}
+	return net.JoinHostPort(m.TargetIP, strconv.Itoa(m.TargetPortNumber))
+}
+
+// TargetNetwork returns the network of TargetAddress as accepted by net.Dial:
+// "unix" if TargetSocket is set and the protocol of the mapping otherwise.
+func (m *Mapping) TargetNetwork() string {
+	if m.TargetSocket != "" {
+		return "unix"
+	}
+	return m.Protocol.String()
 }
 
 func CheckDuplicates(mm []Mapping) error {
-	mapped := make(map[int][]*Mapping)
-	for _, m := range mm {
-		mapped[m.ContainerPortNumber] = append(mapped[m.ContainerPortNumber], &m)
+	mapped := make(map[Port][]*Mapping)
+	for i := range mm {
+		p := mm[i].ContainerPort()
+		mapped[p] = append(mapped[p], &mm[i])
 	}
 	// TODO: collect errors for multiple duplicates and return one error
 	// comprising all ports with duplicate mappings
@@ -60,9 +112,19 @@ func CheckDuplicates(mm []Mapping) error {
 			for _, m := range mapped[p] {
 				rawMappings = append(rawMappings, m.raw)
 			}
-			return fmt.Errorf("container port %d mapped to multiple targets: %s", p, strings.Join(rawMappings, ", "))
+			return fmt.Errorf("container port %s mapped to multiple targets: %s", p, strings.Join(rawMappings, ", "))
 		}
 	}
+	named := make(map[string]string)
+	for _, m := range mm {
+		if m.ContainerPortName == "" {
+			continue
+		}
+		if other, ok := named[m.ContainerPortName]; ok && other != m.raw {
+			return fmt.Errorf("port name %q used for multiple mappings: %s, %s", m.ContainerPortName, other, m.raw)
+		}
+		named[m.ContainerPortName] = m.raw
+	}
 	return nil
 }
 
@@ -72,19 +134,12 @@ func ParsePort(rawPort string) (Port, error) {
 	if err != nil {
 		return Port{}, fmt.Errorf("Invalid port number: \"%s\"", rawPortNum)
 	}
-	var protocol Protocol
-	switch rawProtocol {
-	case "udp":
-		protocol = ProtocolUDP
-	case "tcp":
-		protocol = ProtocolTCP
-	case "sctp":
-		protocol = ProtocolSCTP
-	default:
-		// Note that rawProtocol comes as a return value from splitRawPort,
-		// however its always retuning "tcp" or what the user specifed,
-		// thus the error should make sense to the user.
-		return Port{}, fmt.Errorf("Invalid port protocol: \"%s\"", rawProtocol)
+	// Note that rawProtocol comes as a return value from splitRawPort,
+	// however its always retuning "tcp" or what the user specifed,
+	// thus the error should make sense to the user.
+	protocol, ok := parseProtocol(rawProtocol)
+	if !ok {
+		return Port{}, fmt.Errorf("Invalid port protocol: \"%s\": must be one of \"tcp\", \"udp\" or \"sctp\"", rawProtocol)
 	}
 
 	return Port{Number: portNum, Protocol: protocol}, nil
@@ -109,25 +164,78 @@ func ParseMappings(rawMappings []string) ([]Mapping, error) {
 	// TODO: collect errors for serveral mappings and return one error
 	// comprising all invalid mappings
 	for _, r := range rawMappings {
-		m, err := ParseMapping(r)
-		if err != nil {
-			return nil, fmt.Errorf("argument \"%s\": %v", r, err)
+		rWithoutHidden, hidden := splitRawHidden(r)
+		rps := splitProtocols(rWithoutHidden)
+		if len(rps) > 1 && strings.Contains(r, "@") {
+			return nil, fmt.Errorf("argument \"%s\": a port name can not be used with multiple protocols", r)
+		}
+		for _, rp := range rps {
+			m, err := ParseMapping(rp)
+			if err != nil {
+				return nil, fmt.Errorf("argument \"%s\": %v", r, err)
+			}
+			m.ServiceHidden = hidden
+			m.raw = r
+			mm = append(mm, m)
 		}
-		mm = append(mm, m)
 	}
 	return mm, nil
 }
 
+// splitProtocols splits up a raw mapping that specifies multiple protocols
+// joined by "+" into one raw mapping per protocol.
+//
+// 	splitProtocols("53:53/tcp+udp") -> "53:53/tcp", "53:53/udp"
+// 	splitProtocols("8080:80") -> "8080:80"
+func splitProtocols(rawMapping string) []string {
+	rawMappingWithoutApp, appProtocol := splitRawAppProtocol(rawMapping)
+	i := strings.LastIndex(rawMappingWithoutApp, "/")
+	// A ":" after the last "/" means it is part of a socket path.
+	if i < 0 || !strings.Contains(rawMappingWithoutApp[i:], "+") || strings.Contains(rawMappingWithoutApp[i:], ":") {
+		return []string{rawMapping}
+	}
+	suffix := ""
+	if appProtocol != "" {
+		suffix = ":" + appProtocol
+	}
+	var rr []string
+	for _, protocol := range strings.Split(rawMappingWithoutApp[i+1:], "+") {
+		rr = append(rr, rawMappingWithoutApp[:i+1]+protocol+suffix)
+	}
+	return rr
+}
+
 func ParseMapping(rawMapping string) (Mapping, error) {
-	rawTargetIP, rawTargetPortNum, rawContainerPort := splitRawMapping(rawMapping)
+	rawMappingWithoutHidden, hidden := splitRawHidden(rawMapping)
+	rawMappingWithApp, name := splitRawName(rawMappingWithoutHidden)
+	if name != "" {
+		if errs := validation.IsValidPortName(name); len(errs) > 0 {
+			return Mapping{}, fmt.Errorf("Invalid port name \"%s\": %s", name, strings.Join(errs, ", "))
+		}
+	}
+	rawMappingWithoutName, appProtocol := splitRawAppProtocol(rawMappingWithApp)
+	if appProtocol != "" {
+		if errs := validation.IsQualifiedName(appProtocol); len(errs) > 0 {
+			return Mapping{}, fmt.Errorf("Invalid app protocol \"%s\": %s", appProtocol, strings.Join(errs, ", "))
+		}
+	}
+	if strings.HasPrefix(rawMappingWithoutName, unixPrefix) {
+		m, err := parseSocketMapping(rawMappingWithoutName, name, hidden, rawMapping)
+		m.AppProtocol = appProtocol
+		return m, err
+	}
+	rawTargetIP, rawTargetPortNum, rawContainerPort := splitRawMapping(rawMappingWithoutName)
 
-	// Validate and parse rawTargetIP.
+	// Validate and parse rawTargetIP. DNS names are only validated here,
+	// they are resolved when connecting to the target.
 	targetIP, _, err := net.SplitHostPort(rawTargetIP + ":") // Strip [] from IPV6 addresses
 	if err != nil {
 		return Mapping{}, fmt.Errorf("Invalid ip address %v: \"%s\"", rawTargetIP, err)
 	}
 	if targetIP != "" && net.ParseIP(targetIP) == nil {
-		return Mapping{}, fmt.Errorf("Invalid ip address: \"%s\"", targetIP)
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(targetIP)); len(errs) > 0 {
+			return Mapping{}, fmt.Errorf("Invalid target host \"%s\": must be an ip address or a DNS name resolvable on this machine: %s", targetIP, strings.Join(errs, ", "))
+		}
 	}
 
 	// Validate rawTargetPortNum.
@@ -145,19 +253,10 @@ func ParseMapping(rawMapping string) (Mapping, error) {
 	if err != nil {
 		return Mapping{}, fmt.Errorf("Invalid container port number: \"%s\"", rawContainerPortNum)
 	}
-	var protocol Protocol
-	switch rawProtocol {
-	case "udp":
-		protocol = ProtocolUDP
-	case "tcp":
-		protocol = ProtocolTCP
-	case "sctp":
-		protocol = ProtocolSCTP
-	default:
-		// Note that rawProtocol comes as a return value from splitRawPort,
-		// however its always retuning "tcp" or what the user specifed,
-		// thus the error should make sense to the user.
-		return Mapping{}, fmt.Errorf("Invalid container port protocol: \"%s\"", rawProtocol)
+	// See ParsePort for the error message.
+	protocol, ok := parseProtocol(rawProtocol)
+	if !ok {
+		return Mapping{}, fmt.Errorf("Invalid container port protocol: \"%s\": must be one of \"tcp\", \"udp\" or \"sctp\"", rawProtocol)
 	}
 
 	mapping := Mapping{
@@ -165,11 +264,104 @@ func ParseMapping(rawMapping string) (Mapping, error) {
 		TargetPortNumber:    targetPortNum,
 		ContainerPortNumber: containerPortNum,
 		Protocol:            protocol,
+		ContainerPortName:   name,
+		AppProtocol:         appProtocol,
+		ServiceHidden:       hidden,
 		raw:                 rawMapping,
 	}
 	return mapping, nil
 }
 
+// unixPrefix marks the target of a raw mapping as the path of a Unix domain
+// socket.
+const unixPrefix = "unix:"
+
+// parseSocketMapping parses a raw mapping with a Unix domain socket target,
+// stripped of its port name and hidden marker.
+//
+// 	parseSocketMapping("unix:/var/run/app.sock:80", ...) -> "/var/run/app.sock", 80/tcp
+func parseSocketMapping(rawMapping, name string, hidden bool, raw string) (Mapping, error) {
+	if !unixSocketsSupported {
+		return Mapping{}, fmt.Errorf("Unix domain socket targets are not supported on %s", runtime.GOOS)
+	}
+	rest := strings.TrimPrefix(rawMapping, unixPrefix)
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return Mapping{}, fmt.Errorf("No port specified: \"%s:<empty>\"", rawMapping)
+	}
+	socket, rawContainerPort := rest[:i], rest[i+1:]
+	if socket == "" {
+		return Mapping{}, fmt.Errorf("No socket path specified: \"%s<empty>%s\"", unixPrefix, rest)
+	}
+	rawContainerPortNum, rawProtocol := splitRawPort(rawContainerPort)
+	containerPortNum, err := parsePortNumber(rawContainerPortNum)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("Invalid container port number: \"%s\"", rawContainerPortNum)
+	}
+	protocol, ok := parseProtocol(rawProtocol)
+	if !ok {
+		return Mapping{}, fmt.Errorf("Invalid container port protocol: \"%s\": must be one of \"tcp\", \"udp\" or \"sctp\"", rawProtocol)
+	}
+	if protocol != ProtocolTCP {
+		return Mapping{}, fmt.Errorf("Invalid container port protocol: \"%s\": only \"tcp\" can be forwarded to a Unix domain socket", rawProtocol)
+	}
+	return Mapping{
+		TargetSocket:        socket,
+		ContainerPortNumber: containerPortNum,
+		Protocol:            protocol,
+		ContainerPortName:   name,
+		ServiceHidden:       hidden,
+		raw:                 raw,
+	}, nil
+}
+
+// splitRawHidden splits off the optional trailing "!" that excludes a
+// mapping from the Service.
+//
+// 	splitRawHidden("8080:80!") -> "8080:80", true
+// 	splitRawHidden("8080:80") -> "8080:80", false
+func splitRawHidden(rawMapping string) (string, bool) {
+	if strings.HasSuffix(rawMapping, "!") {
+		return rawMapping[:len(rawMapping)-1], true
+	}
+	return rawMapping, false
+}
+
+// appProtocolRe matches the protocols of a raw mapping that are followed by
+// an app protocol.
+var appProtocolRe = regexp.MustCompile(`[0-9]/(?i:tcp|udp|sctp)(?:\+(?i:tcp|udp|sctp))*:`)
+
+// splitRawAppProtocol splits off the optional app protocol, which follows
+// the explicit protocol of a raw mapping string.
+//
+// 	splitRawAppProtocol("8080:80/tcp:http") -> "8080:80/tcp", "http"
+// 	splitRawAppProtocol("8080:80/tcp:kubernetes.io/h2c") -> "8080:80/tcp", "kubernetes.io/h2c"
+// 	splitRawAppProtocol("8080:80") -> "8080:80", ""
+//
+// Nothing is validated by splitRawAppProtocol.
+func splitRawAppProtocol(rawMapping string) (string, string) {
+	loc := appProtocolRe.FindAllStringIndex(rawMapping, -1)
+	if len(loc) == 0 {
+		return rawMapping, ""
+	}
+	i := loc[len(loc)-1][1]
+	return rawMapping[:i-1], rawMapping[i:]
+}
+
+// splitRawName splits off the optional port name from a raw mapping string.
+//
+// 	splitRawName("8080:80@http") -> "8080:80", "http"
+// 	splitRawName("8080:80") -> "8080:80", ""
+//
+// Nothing is validated by splitRawName.
+func splitRawName(rawMapping string) (string, string) {
+	i := strings.LastIndex(rawMapping, "@")
+	if i < 0 {
+		return rawMapping, ""
+	}
+	return rawMapping[:i], rawMapping[i+1:]
+}
+
 // splitParts splits up a raw mapping string into its parts. Returns the target
 // ip, target port number (without protocol) and the container port (if
 // specified, including protocol).
@@ -223,6 +415,19 @@ func splitRawPort(rawPort string) (string, string) {
 	return parts[0], parts[1]
 }
 
+// parseProtocol parses the protocol suffix of a raw port, ignoring its case.
+func parseProtocol(rawProtocol string) (Protocol, bool) {
+	switch strings.ToLower(rawProtocol) {
+	case "udp":
+		return ProtocolUDP, true
+	case "tcp":
+		return ProtocolTCP, true
+	case "sctp":
+		return ProtocolSCTP, true
+	}
+	return "", false
+}
+
 // parsePortNumber parses n and returns it as an integer. Any error from
 // strconv.ParseUint is returned.
 func parsePortNumber(n string) (int, error) {
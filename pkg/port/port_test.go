@@ -0,0 +1,128 @@
+package port
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMappingsProtocols(t *testing.T) {
+	tests := []struct {
+		raw  []string
+		want []Port
+	}{
+		{
+			raw:  []string{"53:53/udp", "80:80/tcp"},
+			want: []Port{{53, ProtocolUDP}, {80, ProtocolTCP}},
+		},
+		{
+			raw:  []string{"8080:80", "5353:53/udp", "3868:3868/sctp"},
+			want: []Port{{80, ProtocolTCP}, {53, ProtocolUDP}, {3868, ProtocolSCTP}},
+		},
+		{
+			raw:  []string{"8080:80/", "127.0.0.1:5353:53/UDP"},
+			want: []Port{{80, ProtocolTCP}, {53, ProtocolUDP}},
+		},
+		{
+			raw:  []string{"5353:53/tcp+udp", "9090:90/udp!"},
+			want: []Port{{53, ProtocolTCP}, {53, ProtocolUDP}, {90, ProtocolUDP}},
+		},
+	}
+	for _, tt := range tests {
+		mm, err := ParseMappings(tt.raw)
+		if err != nil {
+			t.Errorf("ParseMappings(%q) failed: %v", tt.raw, err)
+			continue
+		}
+		if len(mm) != len(tt.want) {
+			t.Errorf("ParseMappings(%q) returned %d mappings, want %d", tt.raw, len(mm), len(tt.want))
+			continue
+		}
+		for i, m := range mm {
+			if m.ContainerPort() != tt.want[i] {
+				t.Errorf("ParseMappings(%q)[%d] = %s, want %s", tt.raw, i, m.ContainerPort(), tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseMappingsInvalidProtocol(t *testing.T) {
+	for _, raw := range []string{"53:53/icmp", "80:80/tcp+http"} {
+		_, err := ParseMappings([]string{"8080:8080/tcp", raw})
+		if err == nil {
+			t.Errorf("ParseMappings(%q) succeeded, want an error", raw)
+			continue
+		}
+		if !strings.Contains(err.Error(), "Invalid container port protocol") {
+			t.Errorf("ParseMappings(%q) returned %q, want an invalid protocol error", raw, err)
+		}
+	}
+}
+
+func TestParseMappingsSocket(t *testing.T) {
+	tests := []struct {
+		raw    string
+		socket string
+		port   Port
+		hidden bool
+	}{
+		{raw: "unix:/var/run/app.sock:80", socket: "/var/run/app.sock", port: Port{80, ProtocolTCP}},
+		{raw: "unix:/tmp/a+b.sock:8080/tcp!", socket: "/tmp/a+b.sock", port: Port{8080, ProtocolTCP}, hidden: true},
+		{raw: "unix:app.sock:80@http", socket: "app.sock", port: Port{80, ProtocolTCP}},
+	}
+	for _, tt := range tests {
+		mm, err := ParseMappings([]string{tt.raw})
+		if err != nil {
+			t.Errorf("ParseMappings(%q) failed: %v", tt.raw, err)
+			continue
+		}
+		m := mm[0]
+		if m.TargetSocket != tt.socket || m.ContainerPort() != tt.port || m.ServiceHidden != tt.hidden {
+			t.Errorf("ParseMappings(%q) = socket %q, port %s, hidden %t, want %q, %s, %t", tt.raw, m.TargetSocket, m.ContainerPort(), m.ServiceHidden, tt.socket, tt.port, tt.hidden)
+		}
+		if m.TargetNetwork() != "unix" || m.TargetAddress() != tt.socket {
+			t.Errorf("ParseMappings(%q) dials %s %q, want unix %q", tt.raw, m.TargetNetwork(), m.TargetAddress(), tt.socket)
+		}
+	}
+
+	for _, raw := range []string{"unix:/var/run/app.sock:53/udp", "unix::80", "unix:/var/run/app.sock"} {
+		if _, err := ParseMappings([]string{raw}); err == nil {
+			t.Errorf("ParseMappings(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestParseMappingsAppProtocol(t *testing.T) {
+	tests := []struct {
+		raw         string
+		want        []Port
+		appProtocol string
+		name        string
+	}{
+		{raw: "8080:80/tcp:http", want: []Port{{80, ProtocolTCP}}, appProtocol: "http"},
+		{raw: "8443:443/TCP:kubernetes.io/h2c@h2c", want: []Port{{443, ProtocolTCP}}, appProtocol: "kubernetes.io/h2c", name: "h2c"},
+		{raw: "5353:53/tcp+udp:dns", want: []Port{{53, ProtocolTCP}, {53, ProtocolUDP}}, appProtocol: "dns"},
+		{raw: "unix:/var/run/app.sock:80/tcp:grpc", want: []Port{{80, ProtocolTCP}}, appProtocol: "grpc"},
+		{raw: "unix:/var/run/app.sock:80", want: []Port{{80, ProtocolTCP}}},
+		{raw: "8080:80", want: []Port{{80, ProtocolTCP}}},
+	}
+	for _, tt := range tests {
+		mm, err := ParseMappings([]string{tt.raw})
+		if err != nil {
+			t.Errorf("ParseMappings(%q) failed: %v", tt.raw, err)
+			continue
+		}
+		if len(mm) != len(tt.want) {
+			t.Errorf("ParseMappings(%q) returned %d mappings, want %d", tt.raw, len(mm), len(tt.want))
+			continue
+		}
+		for i, m := range mm {
+			if m.ContainerPort() != tt.want[i] || m.AppProtocol != tt.appProtocol || m.ContainerPortName != tt.name {
+				t.Errorf("ParseMappings(%q)[%d] = %s, app protocol %q, name %q, want %s, %q, %q", tt.raw, i, m.ContainerPort(), m.AppProtocol, m.ContainerPortName, tt.want[i], tt.appProtocol, tt.name)
+			}
+		}
+	}
+
+	if _, err := ParseMappings([]string{"8080:80/tcp:not valid"}); err == nil {
+		t.Errorf("ParseMappings with an invalid app protocol succeeded, want an error")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !plan9 && !js
+// +build !plan9,!js
+
+package port
+
+// unixSocketsSupported reports whether Unix domain socket targets can be
+// dialed on this platform.
+const unixSocketsSupported = true
@@ -0,0 +1,147 @@
+package portforward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrBufferLimitExceeded is returned when more data than allowed by
+// Forwarder.MaxBufferPerConn is waiting to be written to one side of a
+// forwarded connection.
+var ErrBufferLimitExceeded = errors.New("buffer limit exceeded")
+
+// maxChunkSize is the maximum size of a single read in boundedCopy. It
+// matches the buffer size used by io.Copy.
+const maxChunkSize = 32 * 1024
+
+// boundedCopy copies from src to dst until either EOF is reached on src or an
+// error occurs, like io.Copy does. Other than io.Copy, reading from src is
+// decoupled from writing to dst, so that a slow dst does not stall reading
+// from src. The data read but not yet written is buffered. If the buffered
+// data exceeds limit bytes, boundedCopy returns ErrBufferLimitExceeded.
+//
+// When boundedCopy returns with an error other than the one from src, the
+// read from src might still be in progress. The caller is expected to close
+// src in that case.
+func boundedCopy(dst io.Writer, src io.Reader, limit int) (written int64, err error) {
+	chunkSize := maxChunkSize
+	if limit < chunkSize {
+		chunkSize = limit
+	}
+
+	var (
+		mu       sync.Mutex
+		cond     = sync.NewCond(&mu)
+		queue    [][]byte
+		pending  int
+		readErr  error
+		readDone bool
+		exceeded bool
+		stopped  bool
+	)
+
+	go func() {
+		for {
+			buf := make([]byte, chunkSize)
+			n, err := src.Read(buf)
+
+			mu.Lock()
+			if stopped {
+				mu.Unlock()
+				return
+			}
+			if n > 0 {
+				pending += n
+				if pending > limit {
+					exceeded = true
+					cond.Signal()
+					mu.Unlock()
+					return
+				}
+				queue = append(queue, buf[:n])
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				readDone = true
+			}
+			cond.Signal()
+			mu.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}()
+
+	for {
+		mu.Lock()
+		for len(queue) == 0 && !readDone && !exceeded {
+			cond.Wait()
+		}
+		if exceeded {
+			mu.Unlock()
+			return written, ErrBufferLimitExceeded
+		}
+		if len(queue) == 0 {
+			// readDone is set and everything has been written.
+			mu.Unlock()
+			return written, readErr
+		}
+		chunk := queue[0]
+		queue = queue[1:]
+		mu.Unlock()
+
+		n, err := dst.Write(chunk)
+		written += int64(n)
+
+		mu.Lock()
+		pending -= len(chunk)
+		mu.Unlock()
+
+		if err != nil {
+			return written, err
+		}
+		if n != len(chunk) {
+			return written, io.ErrShortWrite
+		}
+	}
+}
+
+// copyBufferSize is the size of the buffers used by pooledCopy.
+const copyBufferSize = 256 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// pooledCopy copies from src to dst like io.Copy. Reads from SSH channels
+// return at most the data of the received packets, so io.Copy, which falls
+// back to a newly allocated 32 KiB buffer for them, issues many small writes
+// to dst. pooledCopy reads into a larger buffer from a pool instead, which
+// increases the throughput from the cluster to the target considerably, see
+// BenchmarkForwarderSSHThroughput. TCP sources are still copied by io.Copy,
+// which lets the kernel move the data where supported and did not benefit
+// from a larger buffer.
+func pooledCopy(dst, src net.Conn) (int64, error) {
+	if _, ok := src.(*net.TCPConn); ok {
+		return io.Copy(dst, src)
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hide io.ReaderFrom and io.WriterTo, which would make
+	// io.CopyBuffer ignore buf.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
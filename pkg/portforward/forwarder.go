@@ -2,12 +2,65 @@
 package portforward
 
 import (
+	"errors"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 )
 
+// ConnState represents the state of a connection handled by a Forwarder. It is
+// used by the optional Forwarder.ConnState hook.
+type ConnState int
+
+const (
+	// StateNew represents a connection that has just been accepted.
+	StateNew ConnState = iota
+
+	// StateClosed represents a connection that has been closed after
+	// forwarding finished or failed.
+	StateClosed
+
+	// StateRejected represents a connection that has been closed right
+	// after being accepted since its remote address is not allowed by
+	// the Forwarder's Allow and Deny lists.
+	StateRejected
+)
+
+var stateName = map[ConnState]string{
+	StateNew:      "new",
+	StateClosed:   "closed",
+	StateRejected: "rejected",
+}
+
+func (c ConnState) String() string {
+	return stateName[c]
+}
+
+// ConnInfo describes a connection handled by a Forwarder. It is passed to the
+// optional Forwarder.ConnState hook.
+type ConnInfo struct {
+	// Opened is the time the connection was accepted.
+	Opened time.Time
+
+	// BytesSent is the number of bytes forwarded from the target to the
+	// source connection and BytesReceived the number of bytes forwarded
+	// from the source to the target. Both are only set for StateClosed.
+	BytesSent     int64
+	BytesReceived int64
+
+	// Err is the error that caused forwarding of the connection to fail,
+	// if any. Only set for StateClosed.
+	Err error
+
+	// Sampled reports whether the connection was chosen for detailed
+	// logging, see Forwarder.SampleRate. It is the same for all states of
+	// a connection.
+	Sampled bool
+}
+
 // Forwarder forwards connections from a source listener to a target address.
 //
 // The zero value for Forwarder is a valid configuration that forwards incoming
@@ -15,15 +68,108 @@ import (
 type Forwarder struct {
 	// TargetAddr specifies the TCP address to forward incoming connections
 	// to, in the form "host:port". If empty, ":http" (port 80) is used.
-	// See net.Dial for details of the address format.
+	// See net.Dial for details of the address format. For the "unix"
+	// network it is the path of the socket.
 	TargetAddr string
 
+	// TargetNetwork is the network of TargetAddr, "tcp", "udp" or "unix".
+	// If empty, "tcp" is used. "unix" connections are handled like "tcp"
+	// ones.
+	//
+	// With "udp", every incoming connection gets its own UDP socket
+	// connected to TargetAddr. Each read from the incoming connection is
+	// sent as one datagram and each datagram received from the target is
+	// written to the incoming connection. Thus the incoming connections
+	// should carry datagrams without being merged or split, e.g. one
+	// connection per datagram. PrewarmConns and RewriteHost do not apply.
+	TargetNetwork string
+
+	// DialTimeout is the maximum amount of time a dial to TargetAddr will
+	// wait for a connection to complete. If zero, no timeout is applied
+	// (besides the ones enforced by the operating system).
+	DialTimeout time.Duration
+
+	// Workers limits the number of connections that are handled
+	// concurrently. When all workers are busy, Accept is not called until
+	// a worker becomes available, so new connections wait in the backlog
+	// of the source listener, e.g. in the SSH server for remote forwarded
+	// connections. A Close in the meantime takes effect once a worker
+	// becomes available. If zero, every accepted connection is handled in
+	// its own goroutine without any limit.
+	Workers int
+
+	// PrewarmConns is the number of idle connections to TargetAddr that
+	// are kept open while the forwarder is open. An accepted connection
+	// takes one of them instead of dialing the target, which hides the
+	// dial latency. The pool is refilled in the background. The target
+	// sees these connections even if no connection is accepted. Idle
+	// connections the target closed are dialed again, while data the
+	// target sent on them, e.g. a greeting, is kept for the accepted
+	// connection. If zero, the target is dialed for every accepted
+	// connection.
+	PrewarmConns int
+
+	// MaxBufferPerConn limits the amount of data in bytes that is
+	// buffered per direction of a forwarded connection when the receiving
+	// side reads slower than the sending side writes. Connections
+	// exceeding the limit are closed. If zero, data is copied directly
+	// without additional buffering.
+	MaxBufferPerConn int
+
+	// RewriteHost, if set, makes the forwarder treat incoming connections
+	// as HTTP/1.x and set the Host header of every request to RewriteHost
+	// before forwarding it. Use it for targets that serve multiple name
+	// based virtual hosts. Responses and upgraded connections are
+	// forwarded as is. MaxBufferPerConn does not apply to requests.
+	RewriteHost string
+
+	// Allow optionally restricts the remote addresses connections are
+	// accepted from. If non-empty, only connections from an IP contained
+	// in one of the networks are forwarded.
+	Allow []*net.IPNet
+
+	// Deny optionally lists networks that connections are never accepted
+	// from. Deny takes precedence over Allow.
+	Deny []*net.IPNet
+
 	// ErrorLog specifies an optional logger for errors accepting
 	// connections and errors while forwarding connections. If nil,
 	// logging is done via the log package's standard logger.
 	ErrorLog *log.Logger
 
-	lis *onceCloseListener
+	// ConnState specifies an optional callback function that is called
+	// when a connection changes state.
+	ConnState func(conn net.Conn, state ConnState, info ConnInfo)
+
+	// OnTraffic specifies an optional callback function that is called
+	// whenever data was read from either side of a forwarded connection,
+	// e.g. to detect idle connections. It is called for every read and
+	// must be cheap. Setting it disables the zero-copy path of TCP
+	// connections.
+	OnTraffic func()
+
+	// SampleRate is the fraction of connections, between 0 and 1, that
+	// are marked as Sampled in their ConnInfo when they are accepted. The
+	// ConnState hook is called for all connections regardless. If zero,
+	// all connections are sampled.
+	SampleRate float64
+
+	mu   sync.Mutex
+	lis  *onceCloseListener
+	done chan struct{} // Closed when Open returns.
+	pool *connPool
+
+	// conns holds the active connections, mapped to true for accepted
+	// ones and to false for the ones to the target. Once forceClosed is
+	// set, new connections are closed right away.
+	conns       map[net.Conn]bool
+	forceClosed bool
+
+	// Totals of all connections since the forwarder was created, see
+	// AcceptedConns, BytesSent and BytesReceived.
+	acceptedConns int64
+	bytesSent     int64
+	bytesReceived int64
 }
 
 func (f *Forwarder) String() string {
@@ -32,7 +178,8 @@ func (f *Forwarder) String() string {
 
 // Open accepts incoming connections on l, creating a new service goroutine for
 // each. The service goroutines open a new connection to f.TargetAddr and
-// forward the data read from the incoming connection.
+// forward the data read from the incoming connection. If f.Workers is set, at
+// most f.Workers connections are served concurrently.
 //
 // Open always closes l before returning. Any non-retryable error that occurs
 // while accepting connections will be returned. Errors occurring while
@@ -40,7 +187,14 @@ func (f *Forwarder) String() string {
 // logged using f.ErrorLog. If a Close causes the forwarder to stop and Open to
 // return, nil will be returned.
 func (f *Forwarder) Open(l net.Listener) error {
-	f.lis = &onceCloseListener{Listener: l}
+	lis := &onceCloseListener{Listener: l}
+	done := make(chan struct{})
+	defer close(done)
+	f.mu.Lock()
+	f.lis, f.done = lis, done
+	f.conns = make(map[net.Conn]bool)
+	f.forceClosed = false
+	f.mu.Unlock()
 	defer l.Close()
 
 	target := f.TargetAddr
@@ -48,16 +202,38 @@ func (f *Forwarder) Open(l net.Listener) error {
 		target = ":http"
 	}
 
+	if f.PrewarmConns > 0 && f.network() != "udp" {
+		f.pool = newConnPool(f.network(), target, f.PrewarmConns, f.DialTimeout)
+		defer f.pool.close()
+	}
+
 	// Waits for all connection handlers to finish.
 	var handlers sync.WaitGroup
 
-	// Loop until f.lis is closed.
+	// Bounds the number of concurrent connection handlers. Nil if the
+	// number of handlers is unbounded.
+	var workers chan struct{}
+	if f.Workers > 0 {
+		workers = make(chan struct{}, f.Workers)
+	}
+
+	// Loop until lis is closed.
 	for {
-		// f.lis.Accept waits for new connections. Unblocks with an
-		// io.EOF error if f.lis.Close is called. Earlier accepted
+		// Wait for a free worker before accepting the next connection.
+		// Pending connections are queued in the listeners backlog in
+		// the meantime.
+		if workers != nil {
+			workers <- struct{}{}
+		}
+
+		// lis.Accept waits for new connections. Unblocks with an
+		// io.EOF error if lis.Close is called. Earlier accepted
 		// connections can still finish.
-		conn, err := f.lis.Accept()
+		conn, err := lis.Accept()
 		if err != nil {
+			if workers != nil {
+				<-workers
+			}
 			// Any net package errors that are assured to be
 			// retry-able will conform to the net.Error interface,
 			// and return Temporary true.
@@ -67,49 +243,87 @@ func (f *Forwarder) Open(l net.Listener) error {
 			}
 			if err != io.EOF {
 				f.logf("accepting conn fatal error: %v\n", err)
-				f.lis.Close()
+				lis.Close()
 			}
 			handlers.Wait()
 			return err
 		}
 
+		if !f.allowed(conn.RemoteAddr()) {
+			f.logf("rejected connection from %s\n", conn.RemoteAddr())
+			conn.Close()
+			f.setState(conn, StateRejected, ConnInfo{Opened: time.Now(), Sampled: f.sample()})
+			if workers != nil {
+				<-workers
+			}
+			continue
+		}
+
 		// Handle connection.
 		handlers.Add(1)
 		go func() {
-			err := f.handleConnection(conn, target)
-			if err != nil {
-				f.logf("error forwarding connection: %v\n", err)
+			info := ConnInfo{Opened: time.Now(), Sampled: f.sample()}
+			f.setState(conn, StateNew, info)
+			if f.track(conn, true) {
+				info.Err = f.handleConnection(conn, target, &info)
+				if info.Err != nil {
+					f.logf("error forwarding connection: %v\n", info.Err)
+				}
 			}
+			f.untrack(conn)
+			f.count(info)
 			conn.Close()
+			f.setState(conn, StateClosed, info)
+			if workers != nil {
+				<-workers
+			}
 			handlers.Done()
 		}()
 	}
 }
 
-func (f *Forwarder) handleConnection(conn net.Conn, target string) error {
-	// Open connection to forwarder target.
-	targetConn, err := net.Dial("tcp", target)
+// handleConnection forwards conn to target and records the number of bytes
+// copied in each direction in info.
+func (f *Forwarder) handleConnection(conn net.Conn, target string, info *ConnInfo) error {
+	// Open connection to forwarder target. In case the dial fails (or
+	// times out) the incoming connection is closed by the caller, so the
+	// client on the other side sees a closed connection instead of a hang.
+	targetConn, err := f.dial(target)
 	if err != nil {
 		// TODO(fischor): Close the forwarder in case this is a
 		// non-retryable error?
-		return err
+		return withTargetHint(target, err)
+	}
+	if !f.track(targetConn, false) {
+		return nil
 	}
+	defer f.untrack(targetConn)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
-		_, err := io.Copy(conn, targetConn)
-		if err != nil {
+		var err error
+		info.BytesSent, err = f.copy(conn, f.traffic(targetConn))
+		// A UDP socket is closed as soon as the source is done, see
+		// closeWrite, which ends the read of the responses.
+		if err != nil && !(f.network() == "udp" && errors.Is(err, net.ErrClosed)) {
 			f.logf("error forwarding from source to target: %v", err)
 		}
+		closeWrite(conn)
 		wg.Done()
 	}()
 	go func() {
-		_, err := io.Copy(targetConn, conn)
+		var err error
+		if f.RewriteHost != "" && f.network() != "udp" {
+			info.BytesReceived, err = copyRequests(targetConn, f.traffic(conn), f.RewriteHost)
+		} else {
+			info.BytesReceived, err = f.copy(targetConn, f.traffic(conn))
+		}
 		if err != nil {
 			f.logf("error forwarding from source to target: %v\n", err)
 		}
+		closeWrite(targetConn)
 		wg.Done()
 	}()
 
@@ -118,6 +332,118 @@ func (f *Forwarder) handleConnection(conn net.Conn, target string) error {
 	return targetConn.Close()
 }
 
+// dial opens a connection to target, taking an idle one from f.pool if
+// available.
+func (f *Forwarder) dial(target string) (net.Conn, error) {
+	if f.pool != nil {
+		return f.pool.get()
+	}
+	return net.DialTimeout(f.network(), target, f.DialTimeout)
+}
+
+// traffic returns conn with reads reported to f.OnTraffic, if set.
+func (f *Forwarder) traffic(conn net.Conn) net.Conn {
+	if f.OnTraffic == nil {
+		return conn
+	}
+	return &trafficConn{Conn: conn, onTraffic: f.OnTraffic}
+}
+
+// trafficConn is a net.Conn that calls onTraffic after every read that
+// returned data.
+type trafficConn struct {
+	net.Conn
+	onTraffic func()
+}
+
+func (c *trafficConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.onTraffic()
+	}
+	return n, err
+}
+
+// sample decides whether an accepted connection is sampled.
+func (f *Forwarder) sample() bool {
+	return f.SampleRate <= 0 || f.SampleRate >= 1 || rand.Float64() < f.SampleRate
+}
+
+func (f *Forwarder) network() string {
+	if f.TargetNetwork == "" {
+		return "tcp"
+	}
+	return f.TargetNetwork
+}
+
+// copy copies from src to dst. If f.MaxBufferPerConn is set, the amount of
+// data buffered is bounded and both connections are closed once the limit is
+// exceeded.
+func (f *Forwarder) copy(dst, src net.Conn) (int64, error) {
+	if f.MaxBufferPerConn <= 0 {
+		return pooledCopy(dst, src)
+	}
+	n, err := boundedCopy(dst, src, f.MaxBufferPerConn)
+	if err == ErrBufferLimitExceeded {
+		f.logf("warning: closing connection %s -> %s: more than %d bytes buffered\n", src.RemoteAddr(), dst.RemoteAddr(), f.MaxBufferPerConn)
+		src.Close()
+		dst.Close()
+	}
+	return n, err
+}
+
+// allowed reports whether connections from addr may be forwarded according to
+// f.Allow and f.Deny. Addresses that are not IP addresses are only allowed if
+// neither f.Allow nor f.Deny is set.
+func (f *Forwarder) allowed(addr net.Addr) bool {
+	if len(f.Allow) == 0 && len(f.Deny) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, n := range f.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Forwarder) setState(conn net.Conn, state ConnState, info ConnInfo) {
+	if hook := f.ConnState; hook != nil {
+		hook(conn, state, info)
+	}
+}
+
+// closeWrite signals the peer of conn that no more data will be sent once the
+// copy to conn finished, i.e. the other side of the forwarded connection sent
+// its EOF. If conn does not support half-closing, it is closed entirely.
+// Without this, the copy in the opposite direction might never finish: a
+// client that half-closes after sending its request, e.g. "nc -N", or a
+// target that closes after sending its response would wait for the other
+// side forever, and so would the connection handler.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
 func (f *Forwarder) logf(format string, args ...interface{}) {
 	if f.ErrorLog != nil {
 		f.ErrorLog.Printf(format, args...)
@@ -135,12 +461,124 @@ func (f *Forwarder) logf(format string, args ...interface{}) {
 // When Close is called, Open does not return immediately. It will finish
 // handling all active connections before returning.
 func (f *Forwarder) Close() error {
-	if f.lis != nil {
-		return f.lis.Close()
+	f.mu.Lock()
+	lis := f.lis
+	f.mu.Unlock()
+	if lis != nil {
+		return lis.Close()
 	}
 	return nil
 }
 
+// Drain closes the forwarder like Close does and waits up to grace for the
+// active connections to finish. Connections that are still active after
+// grace are closed forcibly. Drain returns once Open returned.
+func (f *Forwarder) Drain(grace time.Duration) error {
+	f.mu.Lock()
+	lis, done := f.lis, f.done
+	f.mu.Unlock()
+	if lis == nil {
+		return nil
+	}
+	err := lis.Close()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return err
+	case <-timer.C:
+	}
+
+	f.mu.Lock()
+	f.forceClosed = true
+	var n int
+	for c, accepted := range f.conns {
+		if accepted {
+			n++
+		}
+		c.Close()
+	}
+	f.mu.Unlock()
+	if n > 0 {
+		f.logf("forcibly closed %d connections that did not finish within %v\n", n, grace)
+	}
+	<-done
+	return err
+}
+
+// ActiveConns returns the number of accepted connections that are
+// currently being forwarded.
+func (f *Forwarder) ActiveConns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, accepted := range f.conns {
+		if accepted {
+			n++
+		}
+	}
+	return n
+}
+
+// AcceptedConns returns the number of connections accepted and forwarded
+// since the forwarder was created. Rejected connections are not counted.
+func (f *Forwarder) AcceptedConns() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.acceptedConns
+}
+
+// BytesSent returns the number of bytes forwarded from the target to the
+// source connections since the forwarder was created, like
+// ConnInfo.BytesSent. The bytes of a connection are counted once it is
+// closed.
+func (f *Forwarder) BytesSent() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bytesSent
+}
+
+// BytesReceived returns the number of bytes forwarded from the source
+// connections to the target since the forwarder was created, like
+// ConnInfo.BytesReceived. The bytes of a connection are counted once it is
+// closed.
+func (f *Forwarder) BytesReceived() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bytesReceived
+}
+
+// track registers c as active connection. If the forwarder is being
+// drained forcibly, c is closed instead and track returns false.
+func (f *Forwarder) track(c net.Conn, accepted bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.forceClosed {
+		c.Close()
+		return false
+	}
+	f.conns[c] = accepted
+	if accepted {
+		f.acceptedConns++
+	}
+	return true
+}
+
+func (f *Forwarder) untrack(c net.Conn) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+}
+
+// count adds the bytes forwarded for a closed connection to the totals.
+func (f *Forwarder) count(info ConnInfo) {
+	f.mu.Lock()
+	f.bytesSent += info.BytesSent
+	f.bytesReceived += info.BytesReceived
+	f.mu.Unlock()
+}
+
 // onceCloseListener wraps a net.Listener, protecting it from
 // multiple Close calls.
 type onceCloseListener struct {
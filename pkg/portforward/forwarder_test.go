@@ -0,0 +1,477 @@
+package portforward
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// echoServer starts a TCP server on a random local port that echos back all
+// data it reads. It returns the listeners address.
+func echoServer(tb testing.TB) string {
+	addr, _ := countingEchoServer(tb)
+	return addr
+}
+
+// countingEchoServer is like echoServer and additionally returns the number of
+// goroutines currently serving a connection.
+func countingEchoServer(tb testing.TB) (string, *int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	var serving int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&serving, 1)
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+				atomic.AddInt64(&serving, -1)
+			}()
+		}
+	}()
+	return l.Addr().String(), &serving
+}
+
+// startForwarder opens f on a random local port and returns the address of
+// the listener.
+func startForwarder(tb testing.TB, f *Forwarder) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		f.Open(l)
+		close(done)
+	}()
+	tb.Cleanup(func() {
+		f.Close()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// TestForwarderHalfClose checks that the end of the data sent by one side of a
+// forwarded connection is passed on to the other side while the opposite
+// direction is still open.
+func TestForwarderHalfClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// serve handles the connection to the target.
+		serve func(conn net.Conn)
+		// client sends msg on conn and returns what it received.
+		client func(conn *net.TCPConn, msg string) ([]byte, error)
+	}{
+		{
+			// The target answers once the request is complete, like
+			// "nc -N" or a line based protocol terminated by EOF.
+			name: "source closes first",
+			serve: func(conn net.Conn) {
+				req, _ := io.ReadAll(conn)
+				conn.Write(req)
+			},
+			client: func(conn *net.TCPConn, msg string) ([]byte, error) {
+				conn.Write([]byte(msg))
+				conn.CloseWrite()
+				return io.ReadAll(conn)
+			},
+		},
+		{
+			// The target sends a response and closes its side, the
+			// client keeps its side open until it read the EOF.
+			name: "target closes first",
+			serve: func(conn net.Conn) {
+				buf := make([]byte, 64)
+				n, _ := conn.Read(buf)
+				conn.Write(buf[:n])
+				conn.(*net.TCPConn).CloseWrite()
+				io.Copy(io.Discard, conn)
+			},
+			client: func(conn *net.TCPConn, msg string) ([]byte, error) {
+				conn.Write([]byte(msg))
+				return io.ReadAll(conn)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				// Unblock the connection handler if the EOF
+				// is not passed on.
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				tt.serve(conn)
+			}()
+			addr := startForwarder(t, &Forwarder{
+				TargetAddr: l.Addr().String(),
+				ErrorLog:   log.New(io.Discard, "", 0),
+			})
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// Without passing on the EOF, both sides wait for each
+			// other forever.
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			got, err := tt.client(conn.(*net.TCPConn), "ping")
+			if err != nil {
+				t.Fatalf("error reading the response: %v", err)
+			}
+			if string(got) != "ping" {
+				t.Errorf("got response %q, want %q", got, "ping")
+			}
+		})
+	}
+}
+
+func TestForwarderOnTraffic(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	addr := startForwarder(t, &Forwarder{
+		TargetAddr: echoServer(t),
+		OnTraffic: func() {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	mu.Lock()
+	if calls != 0 {
+		t.Errorf("OnTraffic called %d times before any data was sent", calls)
+	}
+	mu.Unlock()
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The request and the echoed response.
+	if calls < 2 {
+		t.Errorf("OnTraffic called %d times, want at least 2", calls)
+	}
+}
+
+// BenchmarkForwarderConcurrentConns measures goroutine and memory usage of
+// the Forwarder while handling many concurrent connections with and without
+// a bounded number of workers. Both are reported as the peak above a baseline
+// taken while the clients are parked, excluding the clients and the target.
+func BenchmarkForwarderConcurrentConns(b *testing.B) {
+	const conns = 512
+	for _, workers := range []int{0, 16, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			target, serving := countingEchoServer(b)
+			addr := startForwarder(b, &Forwarder{
+				TargetAddr: target,
+				Workers:    workers,
+				ErrorLog:   log.New(io.Discard, "", 0),
+			})
+
+			msg := []byte("ping")
+			var maxGoroutines, maxForwarderGoroutines int
+			var maxHeap uint64
+			var mu sync.Mutex
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Park the clients until the baseline is taken,
+				// so that only the goroutines and memory of the
+				// forwarder are measured.
+				b.StopTimer()
+				start := make(chan struct{})
+				var parked, wg sync.WaitGroup
+				for c := 0; c < conns; c++ {
+					parked.Add(1)
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						parked.Done()
+						<-start
+						conn, err := net.Dial("tcp", addr)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						defer conn.Close()
+						buf := make([]byte, len(msg))
+						if _, err := conn.Write(msg); err != nil {
+							b.Error(err)
+							return
+						}
+						if _, err := io.ReadFull(conn, buf); err != nil {
+							b.Error(err)
+							return
+						}
+						// The goroutines of the target are
+						// not part of the forwarder.
+						mu.Lock()
+						if n := runtime.NumGoroutine() - int(atomic.LoadInt64(serving)); n > maxGoroutines {
+							maxGoroutines = n
+						}
+						mu.Unlock()
+					}()
+				}
+				parked.Wait()
+				runtime.GC()
+				baseGoroutines := runtime.NumGoroutine()
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				baseHeap := ms.HeapInuse
+				maxGoroutines = baseGoroutines
+				b.StartTimer()
+
+				// Sample the heap while the connections are
+				// handled.
+				stop := make(chan struct{})
+				sampled := make(chan uint64)
+				go func() {
+					var peak uint64
+					ticker := time.NewTicker(time.Millisecond)
+					defer ticker.Stop()
+					for {
+						var ms runtime.MemStats
+						runtime.ReadMemStats(&ms)
+						if ms.HeapInuse > peak {
+							peak = ms.HeapInuse
+						}
+						select {
+						case <-ticker.C:
+						case <-stop:
+							sampled <- peak
+							return
+						}
+					}
+				}()
+				close(start)
+				wg.Wait()
+				close(stop)
+				peak := <-sampled
+
+				// The sampler is not part of the baseline.
+				if n := maxGoroutines - baseGoroutines - 1; n > maxForwarderGoroutines {
+					maxForwarderGoroutines = n
+				}
+				if peak > baseHeap && peak-baseHeap > maxHeap {
+					maxHeap = peak - baseHeap
+				}
+			}
+			b.ReportMetric(float64(maxForwarderGoroutines), "max-forwarder-goroutines")
+			b.ReportMetric(float64(maxHeap), "max-heap-inuse-B")
+		})
+	}
+}
+
+// sshForwardListener returns a listener for remote forwarded connections of an
+// in-process SSH connection, like the one kubetnl uses in the tunnel pod, and a
+// function that opens a new connection to it from the server side.
+func sshForwardListener(tb testing.TB) (net.Listener, func() (ssh.Channel, error)) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	serverConns := make(chan ssh.Conn, 1)
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			close(serverConns)
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(nc, serverConfig)
+		if err != nil {
+			close(serverConns)
+			return
+		}
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels accepted")
+			}
+		}()
+		go func() {
+			for req := range reqs {
+				// Accept the "tcpip-forward" request of the client
+				// and report the port it asked for.
+				req.Reply(req.Type == "tcpip-forward", ssh.Marshal(struct{ Port uint32 }{1}))
+			}
+		}()
+		serverConns <- conn
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	server, ok := <-serverConns
+	if !ok {
+		tb.Fatal("SSH server failed")
+	}
+	tb.Cleanup(func() { server.Close() })
+
+	forward, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dial := func() (ssh.Channel, error) {
+		ch, reqs, err := server.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{"127.0.0.1", 1, "127.0.0.1", 50000}))
+		if err != nil {
+			return nil, err
+		}
+		go ssh.DiscardRequests(reqs)
+		return ch, nil
+	}
+	return forward, dial
+}
+
+// startForwarderOn opens f on l.
+func startForwarderOn(tb testing.TB, f *Forwarder, l net.Listener) {
+	done := make(chan struct{})
+	go func() {
+		f.Open(l)
+		close(done)
+	}()
+	tb.Cleanup(func() {
+		f.Close()
+		<-done
+	})
+}
+
+// BenchmarkForwarderSSHThroughput measures the throughput of a single
+// connection forwarded from an SSH channel to a local target, in both
+// directions. The results vary between machines: to detect regressions,
+// compare them with the ones of the previous revision using benchstat, e.g.
+//
+//	go test -run xxx -bench SSHThroughput -benchtime 20x -count 10 ./pkg/portforward
+func BenchmarkForwarderSSHThroughput(b *testing.B) {
+	const size = 64 << 20
+
+	// The target discards all data it receives and acknowledges the EOF
+	// with a single byte in the "upload" case and sends size bytes in the
+	// "download" case.
+	target := func(b *testing.B, upload bool) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					if upload {
+						io.Copy(io.Discard, conn)
+						conn.Write([]byte{1})
+						return
+					}
+					io.CopyN(conn, zeroReader{}, size)
+				}()
+			}
+		}()
+		return l.Addr().String()
+	}
+
+	for _, upload := range []bool{true, false} {
+		name := "download"
+		if upload {
+			name = "upload"
+		}
+		b.Run(name, func(b *testing.B) {
+			l, dial := sshForwardListener(b)
+			startForwarderOn(b, &Forwarder{
+				TargetAddr: target(b, upload),
+				ErrorLog:   log.New(io.Discard, "", 0),
+			}, l)
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch, err := dial()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if upload {
+					if _, err := io.CopyN(ch, zeroReader{}, size); err != nil {
+						b.Fatal(err)
+					}
+					ch.CloseWrite()
+					if _, err := io.ReadFull(ch, make([]byte, 1)); err != nil {
+						b.Fatal(err)
+					}
+				} else if n, err := io.Copy(io.Discard, ch); err != nil || n != size {
+					b.Fatalf("received %d bytes: %v", n, err)
+				}
+				ch.Close()
+			}
+		})
+	}
+}
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
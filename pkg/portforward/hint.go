@@ -0,0 +1,68 @@
+package portforward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// probeTimeout is the timeout for dialing a single local interface address
+// when looking for an alternative to an unreachable loopback target.
+const probeTimeout = 300 * time.Millisecond
+
+// CheckTarget dials target on network once to check whether it accepts
+// connections. The returned error includes a suggestion for a different target
+// address if target is a loopback address that cannot be reached while the
+// same port is open on another local address.
+func CheckTarget(network, target string, timeout time.Duration) error {
+	conn, err := net.DialTimeout(network, target, timeout)
+	if err != nil {
+		return withTargetHint(target, err)
+	}
+	return conn.Close()
+}
+
+// withTargetHint annotates err, the error returned when dialing target, with a
+// suggestion for a different target address. Errors resolving the host name of
+// target are annotated with where it is resolved. If target is a loopback address,
+// the same port is probed on the addresses of all local network interfaces,
+// since the service might only bind to one of these. err is returned unchanged
+// if target is not a loopback address or no alternative address accepts
+// connections.
+func withTargetHint(target string, err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return fmt.Errorf("%v (hint: the target host name is resolved on the machine running kubetnl, not in the cluster)", err)
+	}
+	host, port, splitErr := net.SplitHostPort(target)
+	if splitErr != nil || !isLoopback(host) {
+		return err
+	}
+	addrs, ifErr := net.InterfaceAddrs()
+	if ifErr != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		candidate := net.JoinHostPort(ipNet.IP.String(), port)
+		conn, dialErr := net.DialTimeout("tcp", candidate, probeTimeout)
+		if dialErr != nil {
+			continue
+		}
+		conn.Close()
+		return fmt.Errorf("%v (hint: %s accepts connections, the target might only listen on that address)", err, candidate)
+	}
+	return err
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
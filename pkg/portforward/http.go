@@ -0,0 +1,104 @@
+package portforward
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// copyRequests copies the HTTP/1.x requests read from src to dst, setting
+// the Host header of each request to host. Once a request asks to switch
+// protocols (e.g. a WebSocket upgrade) or uses the CONNECT method, the rest
+// of src is copied as is. It returns the number of bytes written to dst.
+//
+// Responses are not parsed, they are copied from the target as is. The
+// headers of a request are flushed before its body is read, so a client
+// sending "Expect: 100-continue" gets the "100 Continue" of the target before
+// it sends the body.
+func copyRequests(dst io.Writer, src io.Reader, host string) (int64, error) {
+	cw := &countingWriter{w: dst}
+	bw := bufio.NewWriter(cw)
+	br := bufio.NewReader(src)
+	for {
+		req, err := http.ReadRequest(br)
+		if err == io.EOF {
+			return cw.n, nil
+		}
+		if err != nil {
+			return cw.n, err
+		}
+		req.Host = host
+		// Request.Write adds a default User-Agent if there is none.
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+		body := req.Body
+		if expectsContinue(req.Header) {
+			req.Body = io.NopCloser(&flushingReader{r: body, w: bw})
+		}
+		err = req.Write(bw)
+		body.Close()
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			return cw.n, err
+		}
+		if req.Method == http.MethodConnect || isUpgrade(req.Header) {
+			_, err := io.Copy(cw, br)
+			return cw.n, err
+		}
+	}
+}
+
+// isUpgrade reports whether h requests to switch protocols.
+func isUpgrade(h http.Header) bool {
+	for _, v := range h["Connection"] {
+		for _, option := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expectsContinue reports whether h asks for a "100 Continue" before the
+// body is sent.
+func expectsContinue(h http.Header) bool {
+	for _, v := range h["Expect"] {
+		if strings.EqualFold(strings.TrimSpace(v), "100-continue") {
+			return true
+		}
+	}
+	return false
+}
+
+// flushingReader flushes w before each read from r. Request.Write only
+// flushes the headers early for some bodies, the client of a request
+// expecting "100 Continue" however waits for the target before it sends the
+// body.
+type flushingReader struct {
+	r io.Reader
+	w *bufio.Writer
+}
+
+func (f *flushingReader) Read(p []byte) (int, error) {
+	if err := f.w.Flush(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
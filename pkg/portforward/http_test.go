@@ -0,0 +1,132 @@
+package portforward
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyRequests(t *testing.T) {
+	type request struct {
+		method string
+		body   string
+	}
+	tests := []struct {
+		name string
+		in   string
+		want []request
+		// rest is the data expected after the last request.
+		rest string
+	}{
+		{
+			name: "keep-alive pipelining",
+			in: "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+				"POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+				"GET /c HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			want: []request{{method: "GET"}, {method: "POST", body: "hello"}, {method: "GET"}},
+		},
+		{
+			name: "chunked body",
+			in: "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n" +
+				"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			want: []request{{method: "POST", body: "hello world"}, {method: "GET"}},
+		},
+		{
+			name: "upgrade",
+			in: "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n" +
+				"GET /not-a-request\r\n\x81\x05hello",
+			want: []request{{method: "GET"}},
+			rest: "GET /not-a-request\r\n\x81\x05hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			n, err := copyRequests(&out, strings.NewReader(tt.in), "example.com")
+			if err != nil {
+				t.Fatalf("copyRequests failed: %v", err)
+			}
+			if n != int64(out.Len()) {
+				t.Errorf("copyRequests returned %d bytes, wrote %d", n, out.Len())
+			}
+
+			br := bufio.NewReader(&out)
+			for i, want := range tt.want {
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					t.Fatalf("error reading request %d: %v", i, err)
+				}
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Fatalf("error reading the body of request %d: %v", i, err)
+				}
+				if req.Host != "example.com" {
+					t.Errorf("request %d has host %q, want %q", i, req.Host, "example.com")
+				}
+				if req.Method != want.method || string(body) != want.body {
+					t.Errorf("request %d is %s with body %q, want %s with body %q", i, req.Method, body, want.method, want.body)
+				}
+			}
+			rest, _ := io.ReadAll(br)
+			if string(rest) != tt.rest {
+				t.Errorf("got %q after the requests, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestCopyRequestsExpectContinue(t *testing.T) {
+	src, client := net.Pipe()
+	target, dst := net.Pipe()
+	defer client.Close()
+	defer target.Close()
+	go func() {
+		copyRequests(dst, src, "example.com")
+		dst.Close()
+	}()
+	target.SetDeadline(time.Now().Add(5 * time.Second))
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The client sends the body only once the target answered with
+	// "100 Continue", so the headers must be forwarded before the body.
+	go client.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	br := bufio.NewReader(target)
+	var header []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading the headers, got %q so far: %v", header, err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		header = append(header, strings.TrimSpace(line))
+	}
+	if !contains(header, "Host: example.com") || !contains(header, "Expect: 100-continue") {
+		t.Errorf("forwarded headers %q, want Host example.com and Expect 100-continue", header)
+	}
+
+	go client.Write([]byte("hello"))
+	body := make([]byte, 5)
+	if _, err := io.ReadFull(br, body); err != nil {
+		t.Fatalf("error reading the body: %v", err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("got body %q, want %q", body, "hello")
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
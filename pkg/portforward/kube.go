@@ -8,13 +8,29 @@ import (
 	"sync"
 	"time"
 
-	"github.com/phayes/freeport"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	k8sportforward "k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
 	"k8s.io/klog/v2"
+
+	kubetnlnet "github.com/pschmitt/kubetnl/pkg/net"
+)
+
+const (
+	// DefaultRetryInterval is the default of
+	// KubeForwarderConfig.RetryInterval.
+	DefaultRetryInterval = 500 * time.Millisecond
+
+	// maxRetryInterval caps the exponential backoff between failed
+	// attempts.
+	maxRetryInterval = 30 * time.Second
+
+	// failingAttempts is the number of failed attempts to establish the
+	// first port-forward after which the failure is reported, see
+	// KubeForwarderConfig.OnFailing.
+	failingAttempts = 5
 )
 
 // KubeForwarder is a portforwarder for forwarding from a local port to a kubernetes Pod and port.
@@ -26,6 +42,47 @@ type KubeForwarderConfig struct {
 	LocalPort  int
 	RemotePort int
 
+	// LocalPortRange restricts the local port chosen if LocalPort is not
+	// set. Defaults to any free port.
+	LocalPortRange kubetnlnet.PortRange
+
+	// Addresses are the local addresses to listen on. Defaults to
+	// "127.0.0.1". See "kubectl port-forward --address".
+	Addresses []string
+
+	// MaxInitialAttempts limits the number of attempts to establish the
+	// first port-forward once the pod is ready. If all of them fail, the
+	// forwarder gives up: Done is closed and Err returns the reason. Zero
+	// means no limit. Failures after the port-forward was ready once are
+	// always retried.
+	MaxInitialAttempts int
+
+	// RetryInterval is the delay before (re-)establishing the
+	// port-forward. It doubles with every consecutive failed attempt, up
+	// to 30s, and is reset once an attempt became ready. Defaults to
+	// DefaultRetryInterval.
+	RetryInterval time.Duration
+
+	// MaxRetryDuration limits the time the port-forward may fail
+	// continuously, e.g. because the pod is gone, before the forwarder
+	// gives up: Done is closed and Err returns the reason. Zero means no
+	// limit.
+	MaxRetryDuration time.Duration
+
+	// PodReadyTimeout limits the time to wait for the pod to be ready
+	// before the port-forward is established. Zero means no limit.
+	PodReadyTimeout time.Duration
+
+	// OnReconnect is an optional callback that is called whenever the
+	// port-forward got interrupted and is about to be re-established.
+	OnReconnect func()
+
+	// OnFailing is an optional callback that is called with the last
+	// error once the first port-forward failed 5 times in a row. The
+	// failure is logged as a warning in any case and the forwarder keeps
+	// retrying until MaxInitialAttempts or MaxRetryDuration is exceeded.
+	OnFailing func(err error)
+
 	RESTConfig *rest.Config
 	ClientSet  *kubernetes.Clientset
 }
@@ -34,17 +91,19 @@ type KubeForwarder struct {
 	sync.Mutex
 
 	KubeForwarderConfig
-	readyCh     chan struct{}
-	doneCh      chan struct{}
-	shouldStop  bool
-	stopCh      chan struct{}
-	stopChClose sync.Once
+	readyCh      chan struct{}
+	doneCh       chan struct{}
+	shouldStop   bool
+	stopCh       chan struct{}
+	stopChClosed bool
+	err          error
+	lastErr      error
 }
 
 func NewKubeForwarder(cfg KubeForwarderConfig) (*KubeForwarder, error) {
 	var err error
 	if cfg.LocalPort == 0 {
-		cfg.LocalPort, err = freeport.GetFreePort()
+		cfg.LocalPort, err = kubetnlnet.GetFreeLocalPort(cfg.LocalPortRange)
 		if err != nil {
 			return nil, err
 		}
@@ -59,7 +118,14 @@ func NewKubeForwarder(cfg KubeForwarderConfig) (*KubeForwarder, error) {
 }
 
 func (o *KubeForwarder) Run(ctx context.Context) (chan struct{}, error) {
-	go func() error {
+	go func() (err error) {
+		defer func() {
+			o.Lock()
+			o.err = err
+			o.Unlock()
+			close(o.doneCh)
+		}()
+
 		klog.V(3).Infof("Starting port-forward from :%d --> %s/%s:%d: dialing...", o.LocalPort, o.PodNamespace, o.PodName, o.RemotePort)
 		req := o.ClientSet.CoreV1().RESTClient().Post().
 			Resource("pods").
@@ -78,6 +144,10 @@ func (o *KubeForwarder) Run(ctx context.Context) (chan struct{}, error) {
 			req.URL())
 
 		pfwdPorts := []string{fmt.Sprintf("%d:%d", o.LocalPort, o.RemotePort)}
+		addresses := o.Addresses
+		if len(addresses) == 0 {
+			addresses = []string{"127.0.0.1"}
+		}
 
 		streams := genericclioptions.IOStreams{
 			In:     os.Stdin,
@@ -86,19 +156,59 @@ func (o *KubeForwarder) Run(ctx context.Context) (chan struct{}, error) {
 		}
 
 		klog.V(3).Infof("Waiting until %s/%s is ready for establishing port-forward...", o.PodNamespace, o.PodName)
-		if err := WaitPodReady(ctx, o.RESTConfig, o.PodNamespace, o.PodName); err != nil {
+		if err := WaitPodReady(ctx, o.RESTConfig, o.PodNamespace, o.PodName, o.PodReadyTimeout); err != nil {
 			return err
 		}
 		klog.V(3).Infof("... %s/%s seems to be ready.", o.PodNamespace, o.PodName)
 
-		// loop forever, until the context is canceled.
+		// loop until the context is canceled or the port-forward failed
+		// for longer than MaxRetryDuration.
+		var attempts int
+		var wasReady bool
+		delay := o.retryInterval()
+		var failingSince time.Time
+		// failed records the error of a failed attempt and backs off. It
+		// returns an error once the forwarder gives up.
+		failed := func(err error) error {
+			o.Lock()
+			o.lastErr = err
+			o.Unlock()
+			if !wasReady {
+				attempts++
+				if o.MaxInitialAttempts > 0 && attempts >= o.MaxInitialAttempts {
+					return fmt.Errorf("unable to establish port-forward to %s/%s after %d attempts (check that you are allowed to create pods/portforward in namespace %q): %v", o.PodNamespace, o.PodName, attempts, o.PodNamespace, err)
+				}
+				if attempts == failingAttempts {
+					klog.Warningf("Port-forward to %s/%s failed %d times, retrying (check that you are allowed to create pods/portforward in namespace %q): %v", o.PodNamespace, o.PodName, attempts, o.PodNamespace, err)
+					if o.OnFailing != nil {
+						o.OnFailing(err)
+					}
+				}
+			}
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			} else if failing := time.Since(failingSince); o.MaxRetryDuration > 0 && failing >= o.MaxRetryDuration {
+				return fmt.Errorf("giving up port-forward to %s/%s after failing for %s: %v", o.PodNamespace, o.PodName, failing.Round(time.Second), err)
+			}
+			if delay *= 2; delay > maxRetryInterval {
+				delay = maxRetryInterval
+			}
+			return nil
+		}
 	loop:
 		for {
 			select {
-			case <-time.After(500 * time.Millisecond):
-				pfwd, err := k8sportforward.New(dialer, pfwdPorts, o.stopCh, o.readyCh, streams.Out, streams.ErrOut)
+			case <-time.After(delay):
+				o.Lock()
+				stopCh, readyCh := o.stopCh, o.readyCh
+				o.Unlock()
+
+				pfwd, err := k8sportforward.NewOnAddresses(dialer, addresses, pfwdPorts, stopCh, readyCh, streams.Out, streams.ErrOut)
 				if err != nil {
 					klog.V(3).Infof("error port-forwarding from :%d --> %d: %v", o.LocalPort, o.RemotePort, err)
+					if err := failed(err); err != nil {
+						return err
+					}
 					continue
 				}
 
@@ -106,30 +216,44 @@ func (o *KubeForwarder) Run(ctx context.Context) (chan struct{}, error) {
 				err = pfwd.ForwardPorts() // blocks
 				if err != nil {
 					klog.V(3).Infof("error port-forwarding from :%d --> %d: %v", o.LocalPort, o.RemotePort, err)
-					continue
 				}
-
-				o.Lock()
-				shouldStop := o.shouldStop
-				o.Unlock()
+				var ready bool
+				select {
+				case <-readyCh:
+					ready, wasReady = true, true
+				default:
+				}
+				if ready {
+					delay = o.retryInterval()
+					failingSince = time.Time{}
+					o.Lock()
+					o.lastErr = nil
+					o.Unlock()
+				} else if err != nil {
+					if err := failed(err); err != nil {
+						return err
+					}
+				}
 
 				// check if we are quitting because someone called Stop() or because the port-forward was broken
-				// in the last case, loop again
-				if shouldStop {
+				// or restarted. In the last cases, loop again on the same local port.
+				if !o.reset() {
 					klog.V(3).Infof("Port-forward from :%d --> %s/%s:%d is done.", o.LocalPort, o.PodNamespace, o.PodName, o.RemotePort)
 					break loop
 				}
+				if err != nil {
+					continue
+				}
 				klog.V(3).Infof("Port-forward from :%d --> %s/%s:%d interrupted: retrying...", o.LocalPort, o.PodNamespace, o.PodName, o.RemotePort)
-				o.readyCh = make(chan struct{})
-				o.doneCh = make(chan struct{})
-				o.stopCh = make(chan struct{}, 1)
+				if o.OnReconnect != nil {
+					o.OnReconnect()
+				}
 
 			case <-ctx.Done():
 				break loop
 			}
 		}
 
-		close(o.doneCh)
 		return nil
 	}()
 
@@ -148,20 +272,88 @@ func (o *KubeForwarder) Done() <-chan struct{} {
 	return o.doneCh
 }
 
+// Err returns the error that made the forwarder give up, if any. It is only
+// set once Done is closed.
+func (o *KubeForwarder) Err() error {
+	o.Lock()
+	defer o.Unlock()
+	return o.err
+}
+
+// LastError returns the error of the last attempt to establish the
+// port-forward if it failed, e.g. to report why the port-forward is not ready
+// yet. It returns nil once an attempt became ready.
+func (o *KubeForwarder) LastError() error {
+	o.Lock()
+	defer o.Unlock()
+	return o.lastErr
+}
+
+// Ready returns a channel that is closed once the current port-forward is
+// ready. After a Restart or reconnect, a new channel is returned.
 func (o *KubeForwarder) Ready() <-chan struct{} {
+	o.Lock()
+	defer o.Unlock()
 	return o.readyCh
 }
 
 func (o *KubeForwarder) Stop() error {
-	// Make sure we only close the stopCh once.
-	o.stopChClose.Do(func() {
+	o.Lock()
+	defer o.Unlock()
+	if !o.shouldStop {
 		klog.V(3).Infof("Stopping port-forward from :%d --> %s/%s:%d.", o.LocalPort, o.PodNamespace, o.PodName, o.RemotePort)
-
-		o.Lock()
 		o.shouldStop = true
-		o.Unlock()
+	}
+	o.closeStopCh()
+	return nil
+}
 
-		close(o.stopCh)
-	})
+// Restart stops the current port-forward and establishes a new one on the
+// same local port, so that clients can re-dial the same local address. Use
+// Ready to wait for the new port-forward.
+func (o *KubeForwarder) Restart() error {
+	o.Lock()
+	defer o.Unlock()
+	if o.shouldStop {
+		return fmt.Errorf("port-forward from :%d has been stopped", o.LocalPort)
+	}
+	klog.V(3).Infof("Restarting port-forward from :%d --> %s/%s:%d.", o.LocalPort, o.PodNamespace, o.PodName, o.RemotePort)
+	o.closeStopCh()
 	return nil
 }
+
+// closeStopCh stops the current port-forward. o must be locked.
+func (o *KubeForwarder) closeStopCh() {
+	if !o.stopChClosed {
+		close(o.stopCh)
+		o.stopChClosed = true
+	}
+}
+
+// retryInterval returns the initial delay between attempts.
+func (o *KubeForwarder) retryInterval() time.Duration {
+	if o.RetryInterval > 0 {
+		return o.RetryInterval
+	}
+	return DefaultRetryInterval
+}
+
+// reset prepares the channels for the next port-forward. It returns false if
+// the forwarder has been stopped.
+func (o *KubeForwarder) reset() bool {
+	o.Lock()
+	defer o.Unlock()
+	if o.shouldStop {
+		return false
+	}
+	if o.stopChClosed {
+		o.stopCh = make(chan struct{}, 1)
+		o.stopChClosed = false
+	}
+	select {
+	case <-o.readyCh:
+		o.readyCh = make(chan struct{})
+	default:
+	}
+	return true
+}
@@ -3,6 +3,7 @@ package portforward
 import (
 	"context"
 	"fmt"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -15,7 +16,9 @@ import (
 	"k8s.io/klog/v2"
 )
 
-func WaitPodReady(ctx context.Context, RESTConfig *rest.Config, namespace, name string) error {
+// WaitPodReady waits until the Pod name is ready. If timeout is non-zero,
+// waiting fails after it elapsed.
+func WaitPodReady(ctx context.Context, RESTConfig *rest.Config, namespace, name string, timeout time.Duration) error {
 	cs, err := kubernetes.NewForConfig(RESTConfig)
 	if err != nil {
 		return err
@@ -31,7 +34,13 @@ func WaitPodReady(ctx context.Context, RESTConfig *rest.Config, namespace, name
 		return fmt.Errorf("error watching Pod %s: %v", name, err)
 	}
 
-	_, err = watchtools.UntilWithoutRetry(ctx, podWatch, condPodReady)
+	readyCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		readyCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	_, err = watchtools.UntilWithoutRetry(readyCtx, podWatch, condPodReady)
 	if err != nil {
 		if err == watchtools.ErrWatchClosed {
 			return fmt.Errorf("error waiting for Pod ready: podWatch has been closed before pod ready event received")
@@ -44,8 +53,8 @@ func WaitPodReady(ctx context.Context, RESTConfig *rest.Config, namespace, name
 			return nil
 		}
 
-		if err == wait.ErrWaitTimeout {
-			return fmt.Errorf("error waiting for Pod ready: timed out after %d seconds", 300)
+		if readyCtx.Err() != nil || err == wait.ErrWaitTimeout {
+			return fmt.Errorf("error waiting for Pod ready: timed out after %s", timeout)
 		}
 
 		return fmt.Errorf("error waiting for Pod ready: received unknown error \"%f\"", err)
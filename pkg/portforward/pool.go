@@ -0,0 +1,135 @@
+package portforward
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// poolRetryInterval is the time a connPool waits before dialing again after
+// a failed dial.
+const poolRetryInterval = time.Second
+
+// idleCheckTimeout is the time checkIdle waits for data or the close of an
+// idle connection. A deadline in the past would fail the read without even
+// looking at the connection.
+const idleCheckTimeout = time.Millisecond
+
+// connPool keeps a number of idle connections to a target open, so that
+// forwarding a new connection does not have to wait for the target dial.
+type connPool struct {
+	network string
+	target  string
+	timeout time.Duration
+
+	// conns holds the idle connections. Together with the connection
+	// the refill goroutine holds while waiting to put it into conns, the
+	// pool keeps size connections open.
+	conns  chan net.Conn
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newConnPool(network, target string, size int, timeout time.Duration) *connPool {
+	p := &connPool{
+		network: network,
+		target:  target,
+		timeout: timeout,
+		conns:   make(chan net.Conn, size-1),
+		closed:  make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.refill()
+	return p
+}
+
+// refill dials the target whenever there is room in the pool until the pool
+// is closed.
+func (p *connPool) refill() {
+	defer p.wg.Done()
+	for {
+		conn, err := net.DialTimeout(p.network, p.target, p.timeout)
+		if err != nil {
+			select {
+			case <-time.After(poolRetryInterval):
+				continue
+			case <-p.closed:
+				return
+			}
+		}
+		select {
+		case p.conns <- conn:
+		case <-p.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// get returns an idle connection from the pool or dials a new one if there is
+// no usable idle connection.
+func (p *connPool) get() (net.Conn, error) {
+	for {
+		select {
+		case conn := <-p.conns:
+			if conn, ok := checkIdle(conn); ok {
+				return conn, nil
+			}
+		default:
+			return net.DialTimeout(p.network, p.target, p.timeout)
+		}
+	}
+}
+
+// close closes the pool and all idle connections.
+func (p *connPool) close() {
+	close(p.closed)
+	p.wg.Wait()
+	for {
+		select {
+		case conn := <-p.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// checkIdle reports whether the idle connection conn is still usable, i.e.
+// has not been closed by the target in the meantime. Data the target already
+// sent on conn, e.g. a greeting, is preserved in the returned connection.
+func checkIdle(conn net.Conn) (net.Conn, bool) {
+	conn.SetReadDeadline(time.Now().Add(idleCheckTimeout))
+	br := bufio.NewReader(conn)
+	_, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return conn, true
+	}
+	if err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &bufferedConn{Conn: conn, r: br}, true
+}
+
+// bufferedConn is a net.Conn that reads data buffered in r before reading
+// from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection if
+// it supports it.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
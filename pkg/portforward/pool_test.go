@@ -0,0 +1,110 @@
+package portforward
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// targetServer starts a TCP server on a random local port that calls serve for
+// every accepted connection. It returns the listeners address and the number
+// of accepted connections.
+func targetServer(tb testing.TB, serve func(conn net.Conn)) (string, *int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	var accepted int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			go serve(conn)
+		}
+	}()
+	return l.Addr().String(), &accepted
+}
+
+// eventually calls cond until it returns true or a second passed.
+func eventually(tb testing.TB, cond func() bool, msg string) {
+	tb.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckIdleClosed(t *testing.T) {
+	addr, _ := targetServer(t, func(conn net.Conn) { conn.Close() })
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// checkIdle does not consume anything from an open connection, so it
+	// can be called until the close of the target arrived.
+	eventually(t, func() bool {
+		_, ok := checkIdle(conn)
+		return !ok
+	}, "checkIdle reported a connection closed by the target as usable")
+}
+
+func TestCheckIdleGreeting(t *testing.T) {
+	addr, _ := targetServer(t, func(conn net.Conn) {
+		conn.Write([]byte("hello\n"))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var checked net.Conn
+	eventually(t, func() bool {
+		c, ok := checkIdle(conn)
+		if !ok {
+			t.Fatal("checkIdle reported an open connection with a greeting as unusable")
+		}
+		checked = c
+		return c != conn
+	}, "checkIdle did not notice the greeting")
+
+	// The greeting must not be lost.
+	checked.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(checked, buf); err != nil {
+		t.Fatalf("error reading the greeting: %v", err)
+	}
+	if string(buf) != "hello\n" {
+		t.Errorf("read %q, want the greeting %q", buf, "hello\n")
+	}
+}
+
+func TestConnPoolRefill(t *testing.T) {
+	addr, accepted := targetServer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	})
+	p := newConnPool("tcp", addr, 2, time.Second)
+	defer p.close()
+
+	eventually(t, func() bool { return atomic.LoadInt64(accepted) == 2 }, "pool did not open its idle connections")
+	conn, err := p.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	eventually(t, func() bool { return atomic.LoadInt64(accepted) == 3 }, "pool was not refilled after get")
+}
@@ -0,0 +1,73 @@
+// Package proc discovers the TCP ports local processes listen on.
+package proc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Listener is a listening TCP socket of a local process.
+type Listener struct {
+	PID  int
+	IP   net.IP
+	Port int
+}
+
+// TargetIP returns the IP address that connections to l should be made to.
+// For listeners bound to all interfaces the loopback address is returned.
+func (l Listener) TargetIP() net.IP {
+	if l.IP == nil || l.IP.IsUnspecified() {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	return l.IP
+}
+
+// ListeningPorts returns the TCP sockets the process identified by process
+// listens on. process is either a process ID or the name of the executable.
+// If multiple processes match the name, the sockets of all of them are
+// returned. An error is returned if no matching process is found or none of
+// the matching processes listens on a TCP port.
+func ListeningPorts(process string) ([]Listener, error) {
+	ll, err := listeningPorts(process)
+	if err != nil {
+		return nil, err
+	}
+	if len(ll) == 0 {
+		return nil, fmt.Errorf("process %q is not listening on any TCP port", process)
+	}
+	return dedupe(ll), nil
+}
+
+// dedupe removes listeners on the same port, e.g. a process listening on
+// both 0.0.0.0 and ::, and sorts the result by port number.
+func dedupe(ll []Listener) []Listener {
+	seen := make(map[int]int)
+	var out []Listener
+	for _, l := range ll {
+		if i, ok := seen[l.Port]; ok {
+			// Prefer the listener reachable on the IPv4 loopback address.
+			if out[i].IP.To4() == nil && l.IP.To4() != nil {
+				out[i] = l
+			}
+			continue
+		}
+		seen[l.Port] = len(out)
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Port < out[j].Port })
+	return out
+}
+
+// matchesName reports whether the executable name or path exe belongs to a
+// process named name.
+func matchesName(exe, name string) bool {
+	if exe == "" {
+		return false
+	}
+	if i := strings.LastIndex(exe, "/"); i >= 0 {
+		exe = exe[i+1:]
+	}
+	return exe == name
+}
@@ -0,0 +1,137 @@
+package proc
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the state of a listening socket in /proc/net/tcp.
+const tcpListen = "0A"
+
+func listeningPorts(process string) ([]Listener, error) {
+	pids, err := findPIDs(process)
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := make(map[string]int)
+	for _, pid := range pids {
+		fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+		if err != nil {
+			return nil, fmt.Errorf("error inspecting process %d: %v", pid, err)
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = pid
+		}
+	}
+
+	var ll []Listener
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		found, err := readTCPTable(table, inodes)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ll = append(ll, found...)
+	}
+	return ll, nil
+}
+
+// findPIDs returns the IDs of all processes matching process.
+func findPIDs(process string) ([]int, error) {
+	if pid, err := strconv.Atoi(process); err == nil {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+			return nil, fmt.Errorf("no process with ID %d", pid)
+		}
+		return []int{pid}, nil
+	}
+
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		comm, _ := ioutil.ReadFile(filepath.Join(dir, "comm"))
+		if matchesName(strings.TrimSpace(string(comm)), process) {
+			pids = append(pids, pid)
+			continue
+		}
+		// comm is truncated to 15 characters, so check the first
+		// argument of the command line as well.
+		cmdline, _ := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+		if argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]; matchesName(argv0, process) {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named %q found", process)
+	}
+	return pids, nil
+}
+
+// readTCPTable returns the listening sockets from a /proc/net/tcp{,6} table
+// whose inode is in inodes.
+func readTCPTable(path string, inodes map[string]int) ([]Listener, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ll []Listener
+	s := bufio.NewScanner(f)
+	s.Scan() // Skip the header.
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		pid, ok := inodes[fields[9]]
+		if !ok {
+			continue
+		}
+		ip, port, err := parseHexAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		ll = append(ll, Listener{PID: pid, IP: ip, Port: port})
+	}
+	return ll, s.Err()
+}
+
+// parseHexAddr parses an address in the format used by /proc/net/tcp, e.g.
+// "0100007F:1F90" for 127.0.0.1:8080. The IP address is stored as a sequence
+// of 32-bit words in host byte order.
+func parseHexAddr(s string) (net.IP, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in address %q", s)
+	}
+	return net.IP(b), int(port), nil
+}
@@ -0,0 +1,62 @@
+//go:build !linux
+// +build !linux
+
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// listeningPorts uses lsof to find the listening sockets of process on
+// platforms without a /proc filesystem.
+func listeningPorts(process string) ([]Listener, error) {
+	args := []string{"-nP", "-a", "-iTCP", "-sTCP:LISTEN", "-Fpn"}
+	if _, err := strconv.Atoi(process); err == nil {
+		args = append(args, "-p", process)
+	} else {
+		args = append(args, "-c", "/^"+regexp.QuoteMeta(process)+"$/")
+	}
+	out, err := exec.Command("lsof", args...).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok && len(out) == 0 {
+			// lsof exits with status 1 if nothing matched.
+			return nil, fmt.Errorf("no process %q found listening on a TCP port", process)
+		}
+		return nil, fmt.Errorf("error running lsof: %v", err)
+	}
+
+	var ll []Listener
+	pid := 0
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			pid, _ = strconv.Atoi(line[1:])
+		case 'n':
+			host, rawPort, err := net.SplitHostPort(line[1:])
+			if err != nil {
+				continue
+			}
+			port, err := strconv.Atoi(rawPort)
+			if err != nil {
+				continue
+			}
+			var ip net.IP
+			if host != "*" {
+				ip = net.ParseIP(host)
+			}
+			ll = append(ll, Listener{PID: pid, IP: ip, Port: port})
+		}
+	}
+	return ll, s.Err()
+}
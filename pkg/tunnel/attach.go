@@ -0,0 +1,222 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/pschmitt/kubetnl/pkg/port"
+)
+
+// attach sets up the tunnel to use the Service and Pod of the tunnel o.Name
+// that were created by another kubetnl process, e.g. one that was killed
+// before it could clean up. It validates that the resources exist, that the
+// Pod is ready and that they expose the port mappings. Without port mappings,
+// every container port of the Pod is forwarded to the same port on
+// 127.0.0.1.
+//
+// The resources are only deleted by Stop if AttachCleanup is set.
+func (o *Tunnel) attach(ctx context.Context) error {
+	o.serviceClient = o.ClientSet.CoreV1().Services(o.Namespace)
+	o.podClient = o.ClientSet.CoreV1().Pods(o.Namespace)
+	o.configMapClient = o.ClientSet.CoreV1().ConfigMaps(o.Namespace)
+	o.serviceAccountClient = o.ClientSet.CoreV1().ServiceAccounts(o.Namespace)
+
+	svc, err := o.serviceClient.Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("tunnel %q not found in namespace %q", o.Name, o.Namespace)
+		}
+		return fmt.Errorf("error getting Service %q: %v", o.Name, err)
+	}
+	if svc.Labels["io.github.kubetnl"] != o.Name {
+		return fmt.Errorf("Service %q has not been created by kubetnl", o.Name)
+	}
+
+	// The Pod of a tunnel that adopted a prewarmed pod has a different
+	// name, but it is labeled like the Service.
+	pods, err := o.podClient.List(ctx, metav1.ListOptions{LabelSelector: "io.github.kubetnl=" + o.Name})
+	if err != nil {
+		return fmt.Errorf("error listing the Pods of tunnel %q: %v", o.Name, err)
+	}
+	if len(pods.Items) != 1 {
+		return fmt.Errorf("expected one Pod for tunnel %q, found %d", o.Name, len(pods.Items))
+	}
+	pod := &pods.Items[0]
+	if !isPodReady(pod) {
+		return fmt.Errorf("Pod %q of tunnel %q is not ready", pod.Name, o.Name)
+	}
+	sshPort, ok := prewarmedPodSSHPort(pod)
+	if !ok {
+		return fmt.Errorf("Pod %q of tunnel %q does not run the kubetnl server image: its SSH port is unknown", pod.Name, o.Name)
+	}
+
+	if len(o.PortMappings) == 0 {
+		if o.PortMappings, err = containerPortMappings(pod, sshPort); err != nil {
+			return err
+		}
+	}
+	if err := checkAttachMappings(o.PortMappings, svc, pod); err != nil {
+		return fmt.Errorf("the port mappings do not match tunnel %q: %v", o.Name, err)
+	}
+	if o.udpRelays, err = podUDPRelays(o.PortMappings, pod); err != nil {
+		return err
+	}
+
+	if err := o.checkAttachCredentials(ctx, pod); err != nil {
+		return err
+	}
+
+	klog.V(2).Infof("Attaching to Pod %q with SSH port %d.", pod.Name, sshPort)
+	o.pod = pod
+	o.RemoteSSHPort = sshPort
+	if !o.AttachCleanup {
+		o.existingPod = true
+		return nil
+	}
+
+	// Take over the resources, so that Stop deletes them.
+	o.service = svc
+	for _, f := range svc.Finalizers {
+		if f == ProtectFinalizer {
+			o.Protect = true
+		}
+	}
+	o.serviceAccount, err = o.serviceAccountClient.Get(ctx, pod.Spec.ServiceAccountName, metav1.GetOptions{})
+	if err != nil || o.serviceAccount.Labels["io.github.kubetnl"] != o.Name {
+		klog.V(1).Infof("Not deleting ServiceAccount %q of Pod %q with the tunnel: %v", pod.Spec.ServiceAccountName, pod.Name, err)
+		o.serviceAccount = nil
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.ConfigMap == nil {
+			continue
+		}
+		o.configMap, err = o.configMapClient.Get(ctx, v.ConfigMap.Name, metav1.GetOptions{})
+		if err != nil || o.configMap.Labels["io.github.kubetnl"] != o.Name {
+			klog.V(1).Infof("Not deleting ConfigMap %q of Pod %q with the tunnel: %v", v.ConfigMap.Name, pod.Name, err)
+			o.configMap = nil
+		}
+	}
+	return nil
+}
+
+// checkAttachCredentials makes sure that the credentials of the tunnel are
+// accepted by the SSH server of pod. Passwords are read from the environment
+// of the pod. Keys are looked up in the authorized keys of the tunnel.
+func (o *Tunnel) checkAttachCredentials(ctx context.Context, pod *corev1.Pod) error {
+	if podEnv(pod, "USER_NAME") != o.credentials.User {
+		return fmt.Errorf("the SSH user of Pod %q is %q, not %q", pod.Name, podEnv(pod, "USER_NAME"), o.credentials.User)
+	}
+	if o.credentials.Signer == nil {
+		if podEnv(pod, "USER_PASSWORD") == "" {
+			return fmt.Errorf("Pod %q uses key authentication: set the private key of the tunnel with --ssh-private-key or --ssh-key-secret", pod.Name)
+		}
+		if !o.adoptCredentials(pod) {
+			return fmt.Errorf("the SSH password does not match the one of Pod %q", pod.Name)
+		}
+		return nil
+	}
+
+	for _, v := range pod.Spec.Volumes {
+		if v.Name != "authorized-keys" || v.ConfigMap == nil {
+			continue
+		}
+		cm, err := o.configMapClient.Get(ctx, v.ConfigMap.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("Unable to check that Pod %q accepts the SSH key: %v", pod.Name, err)
+			return nil
+		}
+		if !strings.Contains(cm.Data[authorizedKeysFilename], strings.TrimSpace(o.credentials.authorizedKey())) {
+			return fmt.Errorf("the SSH key is not authorized by Pod %q", pod.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("Pod %q uses password authentication: set the password of the tunnel with --ssh-password or omit the SSH key", pod.Name)
+}
+
+// containerPortMappings returns a mapping of every container port of pod to
+// the same port on 127.0.0.1. The port of the SSH server, sshPort, is
+// skipped; podPorts declares it as "ssh".
+func containerPortMappings(pod *corev1.Pod, sshPort int) ([]port.Mapping, error) {
+	var mm []port.Mapping
+	for _, cp := range pod.Spec.Containers[0].Ports {
+		if cp.Name == "ssh" || int(cp.ContainerPort) == sshPort {
+			continue
+		}
+		raw := fmt.Sprintf("127.0.0.1:%d:%d/%s", cp.ContainerPort, cp.ContainerPort, strings.ToLower(string(cp.Protocol)))
+		m, err := port.ParseMapping(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error mapping container port %q of Pod %q: %v", cp.Name, pod.Name, err)
+		}
+		mm = append(mm, m)
+	}
+	if len(mm) == 0 {
+		return nil, fmt.Errorf("Pod %q has no container ports to forward", pod.Name)
+	}
+	return mm, nil
+}
+
+// checkAttachMappings returns an error if a container port of mm is not
+// exposed by pod or, unless hidden from the service, by svc.
+func checkAttachMappings(mm []port.Mapping, svc *corev1.Service, pod *corev1.Pod) error {
+	for _, m := range mm {
+		protocol := protocolToCoreV1(m.Protocol)
+		exposed := false
+		for _, cp := range pod.Spec.Containers[0].Ports {
+			if int(cp.ContainerPort) == m.ContainerPortNumber && cp.Protocol == protocol {
+				exposed = true
+			}
+		}
+		if !exposed {
+			return fmt.Errorf("container port %d/%s is not exposed by Pod %q", m.ContainerPortNumber, protocol, pod.Name)
+		}
+		if m.ServiceHidden {
+			continue
+		}
+		exposed = false
+		for _, sp := range svc.Spec.Ports {
+			if sp.Protocol == protocol && (sp.TargetPort.IntValue() == m.ContainerPortNumber || (m.ContainerPortName != "" && sp.TargetPort.StrVal == m.ContainerPortName)) {
+				exposed = true
+			}
+		}
+		if !exposed {
+			return fmt.Errorf("container port %d/%s is not targeted by Service %q", m.ContainerPortNumber, protocol, svc.Name)
+		}
+	}
+	return nil
+}
+
+// podUDPRelays returns the relay ports of the UDP mappings of mm as set in
+// the UDP_FORWARDS environment variable of pod.
+func podUDPRelays(mm []port.Mapping, pod *corev1.Pod) (map[port.Port]int, error) {
+	forwards := map[int]int{}
+	for _, f := range strings.Fields(podEnv(pod, "UDP_FORWARDS")) {
+		parts := strings.Split(f, ":")
+		if len(parts) != 2 {
+			continue
+		}
+		containerPort, err1 := strconv.Atoi(parts[0])
+		relay, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil {
+			forwards[containerPort] = relay
+		}
+	}
+	relays := make(map[port.Port]int)
+	for _, m := range mm {
+		if m.Protocol != port.ProtocolUDP {
+			continue
+		}
+		relay, ok := forwards[m.ContainerPortNumber]
+		if !ok {
+			return nil, fmt.Errorf("Pod %q does not relay UDP port %d", pod.Name, m.ContainerPortNumber)
+		}
+		relays[m.ContainerPort()] = relay
+	}
+	return relays, nil
+}
@@ -1,6 +1,93 @@
 package tunnel
 
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
 const (
 	// DefaultTunnelImage is the default image used for running the tunnel
 	DefaultTunnelImage = "ghcr.io/linuxserver/openssh-server:latest"
+
+	// DefaultProbeInitialDelay, DefaultProbePeriod and
+	// DefaultProbeFailureThreshold are the default timings of the readiness
+	// and liveness probes on the SSH port of the tunnel pod.
+	DefaultProbeInitialDelay     = 5 * time.Second
+	DefaultProbePeriod           = 5 * time.Second
+	DefaultProbeFailureThreshold = 3
+
+	// DefaultSeccompProfile is the default seccomp profile of the tunnel
+	// pod, see TunnelConfig.SeccompProfile.
+	DefaultSeccompProfile = string(corev1.SeccompProfileTypeRuntimeDefault)
+
+	// DefaultSSHConnectTimeout is the default maximum duration of a single
+	// attempt to establish the SSH connection, see
+	// TunnelConfig.SSHConnectTimeout.
+	DefaultSSHConnectTimeout = 10 * time.Second
 )
+
+// DefaultSSHDialBackoff is the default backoff between the attempts to
+// establish the SSH connection: 8 attempts within about two minutes.
+var DefaultSSHDialBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    8,
+}
+
+// sshdCapabilities are the capabilities the SSH server of the default image
+// needs while running as root, e.g. to switch to the SSH user, to chroot for
+// privilege separation and to listen on ports below 1024. The "baseline" Pod
+// Security Standard allows all of them.
+var sshdCapabilities = []corev1.Capability{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL",
+	"NET_BIND_SERVICE", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+}
+
+// DefaultSecurityContext returns the default security context of the
+// container of the tunnel pod. It drops all capabilities except the ones of
+// sshdCapabilities, which together with DefaultSeccompProfile satisfies the
+// "baseline" Pod Security Standard.
+func DefaultSecurityContext() *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+			Add:  append([]corev1.Capability(nil), sshdCapabilities...),
+		},
+	}
+}
+
+// NonRootSecurityContexts returns the security contexts of the tunnel pod and
+// its container that satisfy the "restricted" Pod Security Standard together
+// with DefaultSeccompProfile. The pod only starts if the image runs as a
+// non-root user, which the default image does not.
+func NonRootSecurityContexts() (*corev1.PodSecurityContext, *corev1.SecurityContext) {
+	runAsNonRoot, allowPrivilegeEscalation := true, false
+	podContext := &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+	}
+	containerContext := &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+			Add:  []corev1.Capability{"NET_BIND_SERVICE"},
+		},
+	}
+	return podContext, containerContext
+}
+
+// DefaultPodResources returns the default resource requirements of the tunnel
+// pod. The requests are small enough for the pod to schedule on constrained
+// clusters while satisfying LimitRanges and ResourceQuotas that require
+// requests to be set.
+func DefaultPodResources() corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("10m"),
+			corev1.ResourceMemory: resource.MustParse("16Mi"),
+		},
+	}
+}
@@ -7,6 +7,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
+
+	"github.com/pschmitt/kubetnl/pkg/graceful"
 )
 
 const (
@@ -17,38 +19,95 @@ const (
 if [[ ! -z "${PORT}" ]]; then
   echo "Port ${PORT}\n" >> /etc/ssh/sshd_config
 fi
+if [[ ! -z "${SSH_MAX_SESSIONS}" ]]; then
+  sed -i '/^MaxSessions /d' /etc/ssh/sshd_config
+  echo "MaxSessions ${SSH_MAX_SESSIONS}" >> /etc/ssh/sshd_config
+fi
+if [[ ! -z "${SSH_MAX_STARTUPS}" ]]; then
+  sed -i '/^MaxStartups /d' /etc/ssh/sshd_config
+  echo "MaxStartups ${SSH_MAX_STARTUPS}" >> /etc/ssh/sshd_config
+fi
 
 sed -i 's/#AllowAgentForwarding yes/AllowAgentForwarding yes/g' /etc/ssh/sshd_config
 sed -i 's/AllowTcpForwarding no/AllowTcpForwarding yes/g' /etc/ssh/sshd_config
-sed -i 's/GatewayPorts no/GatewayPorts yes/g' /etc/ssh/sshd_config
+sed -i 's/GatewayPorts no/GatewayPorts clientspecified/g' /etc/ssh/sshd_config
 sed -i 's/X11Forwarding no/X11Forwarding yes/g' /etc/ssh/sshd_config
+
+if [[ ! -z "${UDP_FORWARDS}" ]] && ! command -v socat > /dev/null; then
+  apk add --no-cache socat
+fi
+
+if [[ -f /kubetnl/authorized_keys ]]; then
+  mkdir -p /config/.ssh
+  cat /kubetnl/authorized_keys >> /config/.ssh/authorized_keys
+  chmod 700 /config/.ssh
+  chmod 600 /config/.ssh/authorized_keys
+  chown -R "${USER_NAME}" /config/.ssh
+fi
 `
 	scriptDirectory = "/custom-cont-init.d"
+
+	// The UDP relay runs as service supervised by the init system of the
+	// kubetnl server image.
+	udpRelayFilename = "udp-relay"
+	udpRelayContents = `#!/bin/bash
+if [[ -z "${UDP_FORWARDS}" ]]; then
+  exec sleep infinity
+fi
+for f in ${UDP_FORWARDS}; do
+  socat -T 30 UDP4-RECVFROM:${f%%:*},fork,reuseaddr TCP4:127.0.0.1:${f##*:} &
+done
+wait
+`
+	serviceDirectory = "/custom-services.d"
+
+	// The authorized keys are mounted outside of the scriptDirectory,
+	// since all files in there are executed.
+	authorizedKeysFilename  = "authorized_keys"
+	authorizedKeysDirectory = "/kubetnl"
 )
 
-func getConfigMap(name string) *corev1.ConfigMap {
-	return &corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
-			Labels: map[string]string{
-				"io.github.kubetnl": name,
-			},
-		},
+// getConfigMap returns the ConfigMap with the init script of the SSH server
+// and, if authorizedKey is set, the authorized_keys file.
+func getConfigMap(meta metav1.ObjectMeta, authorizedKey string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: meta,
 		Data: map[string]string{
-			"ssh-init.sh": scriptContents,
+			"ssh-init.sh":    scriptContents,
+			udpRelayFilename: udpRelayContents,
 		},
 	}
+	if authorizedKey != "" {
+		cm.Data[authorizedKeysFilename] = authorizedKey
+	}
+	return cm
 }
 
+// CreateConfigMap creates the ConfigMap returned by getConfigMap. Nothing is
+// created with NoInitScript, the pod does not mount it then.
 func (o *Tunnel) CreateConfigMap(ctx context.Context) error {
 	var err error
 
+	if o.NoInitScript {
+		return nil
+	}
 	o.configMapClient = o.ClientSet.CoreV1().ConfigMaps(o.Namespace)
-	o.configMap = getConfigMap(o.Name)
+	o.configMap = getConfigMap(o.objectMeta(), o.credentials.authorizedKey())
+
+	if ctx.Err() != nil {
+		o.configMap = nil
+		return graceful.Interrupted
+	}
 
 	klog.V(3).Infof("Creating ConfigMap %q...", o.Name)
 	o.configMap, err = o.configMapClient.Create(ctx, o.configMap, metav1.CreateOptions{})
 	if err != nil {
+		o.configMap = nil
+		// The request fails with a context error if the interrupt
+		// context was canceled while it was in flight.
+		if ctx.Err() != nil {
+			return graceful.Interrupted
+		}
 		return fmt.Errorf("error creating configMap: %v", err)
 	}
 
@@ -60,10 +119,12 @@ func (o *Tunnel) CleanupConfigMap(ctx context.Context) error {
 	deletePolicy := metav1.DeletePropagationForeground
 	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &deletePolicy}
 
-	klog.V(2).Infof("Cleanup: deleting config map %s ...", o.configMap.Name)
-	if err := o.configMapClient.Delete(ctx, o.configMap.Name, deleteOptions); err != nil {
-		klog.V(1).Infof("Cleanup: error deleting config map: %v. That configMap probably still runs. You can use kubetnl cleanup to clean up all resources created by kubetnl.", err)
-		fmt.Fprintf(o.ErrOut, "Failed to delete config map %q. Use \"kubetnl cleanup\" to delete any leftover resources created by kubetnl.\n", o.Name)
+	if o.configMap != nil {
+		klog.V(2).Infof("Cleanup: deleting config map %s ...", o.configMap.Name)
+		if err := o.configMapClient.Delete(ctx, o.configMap.Name, deleteOptions); err != nil {
+			klog.V(1).Infof("Cleanup: error deleting config map: %v. That configMap probably still runs. You can use kubetnl cleanup to clean up all resources created by kubetnl.", err)
+			fmt.Fprintf(o.ErrOut, "Failed to delete config map %q. Use \"kubetnl cleanup\" to delete any leftover resources created by kubetnl.\n", o.Name)
+		}
 	}
 
 	return nil
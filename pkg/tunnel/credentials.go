@@ -0,0 +1,231 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Credentials is the SSH authentication material for a tunnel. The SSH server
+// in the tunnel pod is configured to accept them and the SSH client uses them
+// to authenticate.
+//
+// If Signer is set, public key authentication is used and the public key of
+// Signer is added to the authorized keys of the SSH server. Otherwise the
+// SSH server accepts Password.
+type Credentials struct {
+	User     string
+	Password string
+	Signer   ssh.Signer
+}
+
+// CredentialProvider provides the Credentials for a tunnel. Implement it to
+// source credentials from e.g. a secrets manager or the environment.
+//
+// Credentials is called once per tunnel before the pod is created.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// StaticCredentials is a CredentialProvider that always returns itself.
+type StaticCredentials Credentials
+
+func (c StaticCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	return Credentials(c), nil
+}
+
+// DefaultCredentials are used by SSHTunnels that do not set Credentials.
+var DefaultCredentials = StaticCredentials{User: "user", Password: "password"}
+
+// DefaultSSHUser is the SSH user of tunnels that set neither a
+// CredentialProvider nor an SSHUser.
+const DefaultSSHUser = "user"
+
+// generatePassword returns a random password that is safe to use in
+// environment variables and shell scripts.
+func generatePassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// generateSigner returns a new ed25519 key for a single tunnel.
+func generateSigner() (ssh.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// loadSigner reads the private key at path. Encrypted keys are decrypted
+// with passphrase.
+func loadSigner(path, passphrase string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSigner(path, data, passphrase)
+}
+
+// loadSecretSigner reads the private key referenced by ref, see
+// TunnelConfig.SSHKeySecret, from the namespace of the tunnel.
+func (o *Tunnel) loadSecretSigner(ctx context.Context, ref string) (ssh.Signer, error) {
+	name, key, err := parseSecretKeyRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := o.ClientSet.CoreV1().Secrets(o.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf("Secret %q not found in namespace %q", name, o.Namespace)
+		}
+		return nil, fmt.Errorf("error getting Secret %q: %v", name, err)
+	}
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("Secret %q has no key %q", name, key)
+	}
+	return parseSigner(ref, data, o.SSHKeyPassphrase)
+}
+
+// parseSigner parses the private key data read from source.
+func parseSigner(source string, data []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		return signer, nil
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("%s: the private key is encrypted, set its passphrase", source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return signer, nil
+}
+
+// parseSecretKeyRef splits ref in the format "<name>/<key>".
+func parseSecretKeyRef(ref string) (name, key string, err error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid Secret key reference %q: must be in the format NAME/KEY", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// ValidateSSHKeySecret returns an error if ref is not a valid
+// TunnelConfig.SSHKeySecret.
+func ValidateSSHKeySecret(ref string) error {
+	_, _, err := parseSecretKeyRef(ref)
+	return err
+}
+
+// authMethods returns the SSH client auth methods for c.
+func (c Credentials) authMethods() []ssh.AuthMethod {
+	if c.Signer != nil {
+		return []ssh.AuthMethod{ssh.PublicKeys(c.Signer)}
+	}
+	return []ssh.AuthMethod{ssh.Password(c.Password)}
+}
+
+// authorizedKey returns the line for the authorized_keys file of the SSH
+// server that accepts c, or an empty string for password authentication.
+func (c Credentials) authorizedKey() string {
+	if c.Signer == nil {
+		return ""
+	}
+	return string(ssh.MarshalAuthorizedKey(c.Signer.PublicKey()))
+}
+
+// resolveCredentials fetches the credentials of the tunnel from its
+// CredentialProvider. Without a CredentialProvider, o.SSHUser is used with
+// o.SSHPassword or the key at o.SSHPrivateKeyPath or in o.SSHKeySecret. If
+// none is set, an
+// ephemeral key is generated for the tunnel.
+//
+// Pods that are not created by the tunnel itself, i.e. existing, attached and
+// prewarmed pods, can not be configured with the public key of an ephemeral
+// key. For these a random password is generated instead, which is replaced
+// by the password of the pod in adoptCredentials.
+func (o *Tunnel) resolveCredentials(ctx context.Context) error {
+	provider := o.CredentialProvider
+	if provider == nil {
+		static := StaticCredentials{User: o.SSHUser, Password: o.SSHPassword}
+		if static.User == "" {
+			static.User = DefaultSSHUser
+		}
+		switch {
+		case static.Password != "":
+		case o.SSHPrivateKeyPath != "":
+			signer, err := loadSigner(o.SSHPrivateKeyPath, o.SSHKeyPassphrase)
+			if err != nil {
+				return fmt.Errorf("error reading SSH private key: %v", err)
+			}
+			static.Signer = signer
+		case o.SSHKeySecret != "":
+			signer, err := o.loadSecretSigner(ctx, o.SSHKeySecret)
+			if err != nil {
+				return fmt.Errorf("error reading SSH private key: %v", err)
+			}
+			static.Signer = signer
+		case !o.prewarm && !o.UsePrewarmed && !o.Attach && o.ExistingPod == "":
+			signer, err := generateSigner()
+			if err != nil {
+				return fmt.Errorf("error generating SSH key: %v", err)
+			}
+			static.Signer = signer
+		default:
+			password, err := generatePassword()
+			if err != nil {
+				return fmt.Errorf("error generating SSH password: %v", err)
+			}
+			static.Password = password
+			o.generatedPassword = true
+		}
+		provider = static
+	}
+	creds, err := provider.Credentials(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting SSH credentials: %v", err)
+	}
+	if creds.User == "" {
+		return fmt.Errorf("error getting SSH credentials: no user name")
+	}
+	if creds.Password == "" && creds.Signer == nil {
+		return fmt.Errorf("error getting SSH credentials: neither a password nor a key")
+	}
+	o.credentials = creds
+	return nil
+}
+
+// adoptCredentials makes the tunnel use the SSH credentials of pod if the
+// password of the tunnel was generated and thus can not match the one of a
+// pod that was not created by the tunnel itself. It returns false if the
+// credentials of the pod differ from the ones of the tunnel.
+func (o *Tunnel) adoptCredentials(pod *corev1.Pod) bool {
+	if o.credentials.Signer != nil {
+		// There is no way to tell whether the pod accepts the key.
+		return false
+	}
+	user, password := podEnv(pod, "USER_NAME"), podEnv(pod, "USER_PASSWORD")
+	if o.generatedPassword && user == o.credentials.User && password != "" {
+		o.credentials.Password = password
+		return true
+	}
+	return user == o.credentials.User && password == o.credentials.Password
+}
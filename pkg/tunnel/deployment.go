@@ -0,0 +1,215 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/klog/v2"
+
+	"github.com/pschmitt/kubetnl/pkg/graceful"
+	"github.com/pschmitt/kubetnl/pkg/portforward"
+)
+
+// Values of TunnelConfig.Controller.
+const (
+	ControllerPod        = "pod"
+	ControllerDeployment = "deployment"
+)
+
+// ValidateController returns an error if c is not a valid
+// TunnelConfig.Controller.
+func ValidateController(c string) error {
+	switch c {
+	case "", ControllerPod, ControllerDeployment:
+		return nil
+	}
+	return fmt.Errorf("invalid controller %q: must be %q or %q", c, ControllerPod, ControllerDeployment)
+}
+
+// getDeployment returns a Deployment running a single replica of pod.
+func getDeployment(meta metav1.ObjectMeta, pod *corev1.Pod) *appsv1.Deployment {
+	replicas := int32(1)
+	return &appsv1.Deployment{
+		ObjectMeta: meta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"io.github.kubetnl": meta.Name,
+				},
+			},
+			// The tunnel is connected to a single SSH server, a
+			// second pod would receive traffic it can not forward.
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RecreateDeploymentStrategyType,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.Labels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+}
+
+// CreateDeployment creates the Deployment running the tunnel pod and waits
+// for its pod to be ready.
+func (o *Tunnel) CreateDeployment(ctx context.Context) error {
+	var err error
+
+	if err := o.createServiceAccount(ctx); err != nil {
+		return err
+	}
+
+	pod := getPod(o.objectMeta(), &o.TunnelConfig, o.credentials, o.podPorts(), o.udpRelays)
+	o.deploymentClient = o.ClientSet.AppsV1().Deployments(o.Namespace)
+	o.podClient = o.ClientSet.CoreV1().Pods(o.Namespace)
+
+	klog.V(2).Infof("Creating Deployment %q...", o.Name)
+	o.deployment, err = o.deploymentClient.Create(ctx, getDeployment(o.objectMeta(), pod), metav1.CreateOptions{})
+	if err != nil {
+		o.deployment = nil
+		return fmt.Errorf("error creating Deployment: %v", err)
+	}
+	klog.V(3).Infof("Created Deployment %q.", o.deployment.Name)
+
+	o.pod, err = o.waitForDeploymentPod(ctx, "")
+	if err != nil {
+		return err
+	}
+	// The pod is only known once it is ready.
+	o.followLogs(ctx, o.pod)
+	return nil
+}
+
+// waitForDeploymentPod waits until a pod of the Deployment other than
+// previous is ready and returns it.
+func (o *Tunnel) waitForDeploymentPod(ctx context.Context, previous string) (*corev1.Pod, error) {
+	klog.V(3).Infof("Waiting for a Pod of Deployment %q to be ready before setting up a SSH connection.", o.deployment.Name)
+	readyCtx := ctx
+	if o.PodReadyTimeout > 0 {
+		var readyCancel context.CancelFunc
+		readyCtx, readyCancel = context.WithTimeout(ctx, o.PodReadyTimeout)
+		defer readyCancel()
+	}
+	pullCtx, pullCancel := context.WithCancel(readyCtx)
+	defer pullCancel()
+	pullTimer := newImagePullTimer(o.ImagePullTimeout, pullCancel)
+	defer pullTimer.stop()
+
+	listOptions := metav1.ListOptions{LabelSelector: "io.github.kubetnl=" + o.Name}
+	pods, err := o.podClient.List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the Pods of Deployment %q: %v", o.deployment.Name, err)
+	}
+	replacement := func(pod *corev1.Pod) bool {
+		return pod.Name != previous && pod.DeletionTimestamp == nil && isPodReady(pod)
+	}
+	for i := range pods.Items {
+		if replacement(&pods.Items[i]) {
+			return &pods.Items[i], nil
+		}
+	}
+
+	listOptions.ResourceVersion = pods.ResourceVersion
+	podWatch, err := o.podClient.Watch(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error watching the Pods of Deployment %q: %v", o.deployment.Name, err)
+	}
+	var ready *corev1.Pod
+	_, err = watchtools.UntilWithoutRetry(pullCtx, podWatch, func(event watch.Event) (bool, error) {
+		pod, ok := event.Object.(*corev1.Pod)
+		if !ok || event.Type == watch.Deleted || pod.Name == previous {
+			return false, nil
+		}
+		pullTimer.update(pod)
+		if err := o.checkScheduling(pod); err != nil {
+			return false, err
+		}
+		if err := o.checkImagePull(pod); err != nil {
+			return false, err
+		}
+		if replacement(pod) {
+			ready = pod
+		}
+		return ready != nil, nil
+	})
+	if err != nil {
+		if pullTimer.exceeded() {
+			return nil, fmt.Errorf("error waiting for Pod ready: image pull exceeded %s for image %q", o.ImagePullTimeout, o.Image)
+		}
+		if ctx.Err() != nil {
+			return nil, graceful.Interrupted
+		}
+		if readyCtx.Err() != nil {
+			return nil, fmt.Errorf("error waiting for Pod ready: timed out after %s", o.PodReadyTimeout)
+		}
+		if err == watchtools.ErrWatchClosed {
+			return nil, fmt.Errorf("error waiting for Pod ready: the watch has been closed before a Pod was ready")
+		}
+		return nil, fmt.Errorf("error waiting for Pod ready: %v", err)
+	}
+
+	klog.V(2).Infof("Pod %q of Deployment %q ready...", ready.Name, o.deployment.Name)
+	return ready, nil
+}
+
+// replacePod moves the running tunnel to the pod the Deployment creates to
+// replace the pod that terminated because of reason. The port-forward is
+// re-established to the new pod and the SSH connection is marked as lost, so
+// that reconnectSSH connects to the SSH server of the new pod.
+func (o *Tunnel) replacePod(ctx context.Context, reason error) error {
+	previous := o.pod.Name
+	klog.Warningf("%v: waiting for Deployment %q to replace it...", reason, o.deployment.Name)
+	pod, err := o.waitForDeploymentPod(ctx, previous)
+	if err != nil {
+		return fmt.Errorf("%v and no replacement is ready: %v", reason, err)
+	}
+
+	// The new port-forward listens on the same local port.
+	o.kubeForwarder.Stop()
+	<-o.kubeForwarder.Done()
+	kf, err := portforward.NewKubeForwarder(o.kubeForwarderConfig(pod))
+	if err != nil {
+		return err
+	}
+	if _, err := kf.Run(ctx); err != nil {
+		return err
+	}
+
+	o.sshMu.Lock()
+	o.pod = pod
+	o.kubeForwarder = kf
+	current := o.sshTunnel
+	o.sshMu.Unlock()
+	go o.watchPortForward(ctx, kf)
+	klog.Infof("Moving the tunnel from Pod %q to its replacement %q.", previous, pod.Name)
+	o.followLogs(ctx, pod)
+	current.lost(fmt.Errorf("Pod %q has been replaced by %q", previous, pod.Name))
+	return nil
+}
+
+// CleanupDeployment deletes the Deployment of the tunnel, if any, along with
+// its pods.
+func (o *Tunnel) CleanupDeployment(ctx context.Context) error {
+	if o.deployment == nil {
+		return nil
+	}
+	deletePolicy := metav1.DeletePropagationForeground
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &deletePolicy}
+
+	klog.V(2).Infof("Cleanup: deleting deployment %s ...", o.deployment.Name)
+	if err := o.deploymentClient.Delete(ctx, o.deployment.Name, deleteOptions); err != nil && !errors.IsNotFound(err) {
+		klog.V(1).Infof("Cleanup: error deleting Deployment: %v. You can use kubetnl cleanup to clean up all resources created by kubetnl.", err)
+		fmt.Fprintf(o.ErrOut, "Failed to delete Deployment %q. Use \"kubetnl cleanup\" to delete any leftover resources created by kubetnl.\n", o.deployment.Name)
+	}
+	return nil
+}
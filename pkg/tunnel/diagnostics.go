@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRecentEvents is the number of events kept for diagnostics.
+	maxRecentEvents = 100
+
+	// maxLastErrors is the number of errors kept for diagnostics.
+	maxLastErrors = 10
+)
+
+// Diagnostics is a snapshot of the state of a running tunnel.
+type Diagnostics struct {
+	Time         time.Time     `json:"time"`
+	Name         string        `json:"name"`
+	Namespace    string        `json:"namespace"`
+	Pod          string        `json:"pod,omitempty"`
+	Mappings     []MappingInfo `json:"mappings"`
+	Stats        Stats         `json:"stats"`
+	SSH          SSHStatus     `json:"ssh"`
+	LastErrors   []Event       `json:"lastErrors"`
+	RecentEvents []Event       `json:"recentEvents"`
+}
+
+// MappingInfo describes a port mapping of a tunnel.
+type MappingInfo struct {
+	ContainerPort string   `json:"containerPort"`
+	Target        string   `json:"target"`
+	AllowCIDRs    []string `json:"allowCIDRs,omitempty"`
+	DenyCIDRs     []string `json:"denyCIDRs,omitempty"`
+}
+
+// eventHistory keeps the most recent events and errors of a tunnel.
+type eventHistory struct {
+	mu     sync.Mutex
+	events []Event
+	errors []Event
+}
+
+func (h *eventHistory) record(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = appendBounded(h.events, e, maxRecentEvents)
+	if e.Error != "" {
+		h.errors = appendBounded(h.errors, e, maxLastErrors)
+	}
+}
+
+func (h *eventHistory) snapshot() (events, errors []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Event{}, h.events...), append([]Event{}, h.errors...)
+}
+
+func appendBounded(ee []Event, e Event, max int) []Event {
+	ee = append(ee, e)
+	if len(ee) > max {
+		ee = ee[len(ee)-max:]
+	}
+	return ee
+}
+
+// Diagnostics returns a snapshot of the current state of the tunnel.
+func (o *Tunnel) Diagnostics() Diagnostics {
+	d := Diagnostics{
+		Time:      time.Now(),
+		Name:      o.Name,
+		Namespace: o.Namespace,
+		Stats:     o.Stats(),
+	}
+	o.sshMu.Lock()
+	if o.pod != nil {
+		d.Pod = o.pod.Name
+	}
+	o.sshMu.Unlock()
+	for _, m := range o.PortMappings {
+		info := MappingInfo{
+			ContainerPort: m.ContainerPort().String(),
+			Target:        m.TargetAddress(),
+		}
+		for _, n := range m.AllowCIDRs {
+			info.AllowCIDRs = append(info.AllowCIDRs, n.String())
+		}
+		for _, n := range m.DenyCIDRs {
+			info.DenyCIDRs = append(info.DenyCIDRs, n.String())
+		}
+		d.Mappings = append(d.Mappings, info)
+	}
+	if sshTunnel := o.currentSSHTunnel(); sshTunnel != nil {
+		d.SSH = sshTunnel.Status()
+	}
+	d.RecentEvents, d.LastErrors = o.history.snapshot()
+	return d
+}
+
+// WriteDiagnostics writes a snapshot of the current state of the tunnel as
+// JSON to a timestamped file in dir and returns the path of the file.
+func (o *Tunnel) WriteDiagnostics(dir string) (string, error) {
+	d := o.Diagnostics()
+	name := fmt.Sprintf("kubetnl-%s-diagnostics-%s.json", o.Name, d.Time.Format("20060102T150405"))
+	path := filepath.Join(dir, name)
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("error writing diagnostics: %v", err)
+	}
+	return path, nil
+}
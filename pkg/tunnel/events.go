@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// eventBufferSize is the number of events buffered for each subscriber of
+// Tunnel.Events.
+const eventBufferSize = 128
+
+// EventType is the type of an Event emitted by a Tunnel.
+type EventType string
+
+const (
+	// EventReady is emitted once the tunnel is ready to forward
+	// connections.
+	EventReady EventType = "ready"
+
+	// EventConnectionOpened is emitted when a new connection was accepted
+	// for a port mapping.
+	EventConnectionOpened EventType = "connection-opened"
+
+	// EventConnectionClosed is emitted when a forwarded connection was
+	// closed.
+	EventConnectionClosed EventType = "connection-closed"
+
+	// EventConnectionRejected is emitted when a connection was rejected
+	// because its source address is not allowed for the port mapping.
+	EventConnectionRejected EventType = "connection-rejected"
+
+	// EventReconnect is emitted when the port-forward to the tunnel pod
+	// or the SSH connection got interrupted and is re-established.
+	EventReconnect EventType = "reconnect"
+
+	// EventError is emitted when an error occurs that does not
+	// immediately stop the tunnel, e.g. a failure to forward a single
+	// connection.
+	EventError EventType = "error"
+
+	// EventShuttingDown is emitted when the tunnel is stopped and starts
+	// to clean up its resources.
+	EventShuttingDown EventType = "shutting-down"
+)
+
+// Event describes something significant that happened while running a
+// tunnel. Events are passed to the TunnelConfig.OnEvent callback and sent to
+// all subscribers of Tunnel.Events.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+
+	// Tunnel is the name of the tunnel the event belongs to.
+	Tunnel string `json:"tunnel"`
+
+	// ContainerPort and Target identify the port mapping for connection
+	// related events.
+	ContainerPort int    `json:"containerPort,omitempty"`
+	Target        string `json:"target,omitempty"`
+
+	// RemoteAddr is the address of the in-cluster peer for connection
+	// related events.
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+
+	// BytesSent and BytesReceived are the number of bytes forwarded to
+	// and from the in-cluster peer and Duration is the lifetime of the
+	// connection in seconds. Only set for EventConnectionClosed events.
+	BytesSent     int64   `json:"bytesSent,omitempty"`
+	BytesReceived int64   `json:"bytesReceived,omitempty"`
+	Duration      float64 `json:"durationSeconds,omitempty"`
+
+	// Error holds the error message for EventError events and for
+	// EventConnectionClosed events of connections that failed.
+	Error string `json:"error,omitempty"`
+
+	// sampled is set for connection related events of connections that
+	// are recorded in the connection ledger.
+	sampled bool
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// eventBus fans out events to any number of subscribers. Sending never
+// blocks: events are dropped for subscribers that do not keep up.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   []*subscriber
+	closed bool
+}
+
+type subscriber struct {
+	ch      chan Event
+	dropped int
+}
+
+// subscribe returns a new channel that receives all events published from
+// now on. The channel is closed when the bus is closed.
+func (b *eventBus) subscribe() <-chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs = append(b.subs, &subscriber{ch: ch})
+	return ch
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	for _, s := range b.subs {
+		select {
+		case s.ch <- e:
+			if s.dropped > 0 {
+				klog.Warningf("Dropped %d events for a slow event subscriber.", s.dropped)
+				s.dropped = 0
+			}
+		default:
+			if s.dropped == 0 {
+				klog.Warningf("Event subscriber is not keeping up: dropping events.")
+			}
+			s.dropped++
+		}
+	}
+}
+
+// close closes the channels of all subscribers. Events published afterwards
+// are discarded.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, s := range b.subs {
+		close(s.ch)
+	}
+	b.subs = nil
+}
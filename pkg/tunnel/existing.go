@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/pschmitt/kubetnl/pkg/net"
+)
+
+// useExistingPod sets up the tunnel to use o.ExistingPod instead of creating
+// resources in the cluster. It validates that the Pod is ready and exposes an
+// SSH port that is not used by any of the port mappings. Unless a password is
+// set, the SSH credentials are read from the environment of the Pod.
+func (o *Tunnel) useExistingPod(ctx context.Context) error {
+	o.podClient = o.ClientSet.CoreV1().Pods(o.Namespace)
+	pod, err := o.podClient.Get(ctx, o.ExistingPod, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("existing Pod %q not found in namespace %q", o.ExistingPod, o.Namespace)
+		}
+		return fmt.Errorf("error getting existing Pod %q: %v", o.ExistingPod, err)
+	}
+	if !isPodReady(pod) {
+		return fmt.Errorf("existing Pod %q is not ready", pod.Name)
+	}
+
+	sshPort := 0
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == "ssh" {
+				sshPort = int(p.ContainerPort)
+			}
+		}
+	}
+	if sshPort == 0 {
+		// Fall back to the PORT environment variable the kubetnl
+		// server image reads its SSH port from.
+		var ok bool
+		if sshPort, ok = prewarmedPodSSHPort(pod); !ok {
+			return fmt.Errorf("existing Pod %q does not expose an SSH port: name the container port of the SSH server \"ssh\"", pod.Name)
+		}
+	}
+	if net.IsInUse(o.PortMappings, sshPort) {
+		return fmt.Errorf("the SSH port %d of existing Pod %q is used by a port mapping", sshPort, pod.Name)
+	}
+
+	// The kubetnl server image reads the credentials from its
+	// environment. Use them unless a password was set explicitly.
+	if o.generatedPassword && !o.adoptCredentials(pod) {
+		return fmt.Errorf("unable to get the SSH credentials of existing Pod %q: set the SSH password of the pod explicitly", pod.Name)
+	}
+
+	klog.V(2).Infof("Using existing Pod %q with SSH port %d.", pod.Name, sshPort)
+	o.pod = pod
+	o.existingPod = true
+	o.RemoteSSHPort = sshPort
+	return nil
+}
@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// hostKeyCommand prints the ed25519 host key of the SSH server. The kubetnl
+// server image keeps its host keys in /config/ssh_host_keys, other images
+// usually in /etc/ssh.
+var hostKeyCommand = []string{"sh", "-c", "cat /config/ssh_host_keys/ssh_host_ed25519_key.pub 2>/dev/null || cat /etc/ssh/ssh_host_ed25519_key.pub"}
+
+// fetchHostKey reads the host key of the SSH server by executing
+// hostKeyCommand in the container of the pod that runs the SSH server.
+func (o *Tunnel) fetchHostKey(ctx context.Context) (ssh.PublicKey, error) {
+	req := o.ClientSet.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(o.pod.Namespace).
+		Name(o.pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: sshContainer(o.pod),
+			Command:   hostKeyCommand,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	exec, err := remotecommand.NewSPDYExecutor(o.RESTConfig, "POST", req.URL())
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- exec.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	}()
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing host key: %v", err)
+	}
+	return key, nil
+}
+
+// sshContainer returns the name of the container of pod that exposes the SSH
+// port, falling back to its first container.
+func sshContainer(pod *corev1.Pod) string {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == "ssh" {
+				return c.Name
+			}
+		}
+	}
+	return pod.Spec.Containers[0].Name
+}
@@ -0,0 +1,217 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// InfoAPIVersion and InfoKind identify TunnelInfo objects when they
+	// are printed. They are never stored in the cluster.
+	InfoAPIVersion = "io.github.kubetnl/v1alpha1"
+	InfoKind       = "Tunnel"
+)
+
+// TunnelInfo describes a tunnel as seen from the cluster, assembled from the
+// resources carrying the "io.github.kubetnl" label.
+type TunnelInfo struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TunnelInfoSpec   `json:"spec"`
+	Status TunnelInfoStatus `json:"status"`
+}
+
+type TunnelInfoSpec struct {
+	Image   string               `json:"image,omitempty"`
+	SSHPort int32                `json:"sshPort,omitempty"`
+	Ports   []corev1.ServicePort `json:"ports,omitempty"`
+}
+
+type TunnelInfoStatus struct {
+	Pod       string          `json:"pod,omitempty"`
+	Phase     corev1.PodPhase `json:"phase,omitempty"`
+	Ready     bool            `json:"ready"`
+	Node      string          `json:"node,omitempty"`
+	Service   string          `json:"service,omitempty"`
+	ClusterIP string          `json:"clusterIP,omitempty"`
+}
+
+// ListTunnels returns information about all tunnels in namespace. If namespace
+// is empty, tunnels of all namespaces are listed. Tunnels are identified by
+// the value of the "io.github.kubetnl" label of their Services and Pods.
+func ListTunnels(ctx context.Context, cs kubernetes.Interface, namespace string) ([]TunnelInfo, error) {
+	listOptions := metav1.ListOptions{LabelSelector: tunnelSelector()}
+
+	services, err := cs.CoreV1().Services(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing Services: %v", err)
+	}
+	pods, err := cs.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing Pods: %v", err)
+	}
+	return tunnelInfos(services.Items, pods.Items), nil
+}
+
+// WatchTunnels calls onChange with the information about all tunnels in
+// namespace, like returned by ListTunnels, once the Services and Pods have
+// been listed and again whenever they change. Changes in quick succession are
+// reported once. WatchTunnels blocks until ctx is done.
+//
+// The resources are watched with informers, which list them again if a watch
+// ends or its resource version has expired. Thus no change is missed.
+func WatchTunnels(ctx context.Context, cs kubernetes.Interface, namespace string, onChange func([]TunnelInfo)) error {
+	selector := tunnelSelector()
+	serviceInformer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return cs.CoreV1().Services(namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return cs.CoreV1().Services(namespace).Watch(ctx, options)
+		},
+	}, &corev1.Service{}, 0, cache.Indexers{})
+	podInformer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return cs.CoreV1().Pods(namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return cs.CoreV1().Pods(namespace).Watch(ctx, options)
+		},
+	}, &corev1.Pod{}, 0, cache.Indexers{})
+
+	changed := make(chan struct{}, 1)
+	notify := func(interface{}) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj interface{}) { notify(obj) },
+		DeleteFunc: notify,
+	}
+	serviceInformer.AddEventHandler(handler)
+	podInformer.AddEventHandler(handler)
+
+	go serviceInformer.Run(ctx.Done())
+	go podInformer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), serviceInformer.HasSynced, podInformer.HasSynced) {
+		return ctx.Err()
+	}
+
+	for {
+		var services []corev1.Service
+		for _, obj := range serviceInformer.GetStore().List() {
+			services = append(services, *obj.(*corev1.Service))
+		}
+		var pods []corev1.Pod
+		for _, obj := range podInformer.GetStore().List() {
+			pods = append(pods, *obj.(*corev1.Pod))
+		}
+		onChange(tunnelInfos(services, pods))
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+		// Wait for related changes, e.g. of the Service and the Pod of
+		// a tunnel that is created, to report them at once.
+		select {
+		case <-time.After(watchSettleDelay):
+		case <-ctx.Done():
+			return nil
+		}
+		select {
+		case <-changed:
+		default:
+		}
+	}
+}
+
+// watchSettleDelay is the time WatchTunnels waits for further changes before
+// reporting a change.
+const watchSettleDelay = 200 * time.Millisecond
+
+// tunnelSelector returns the label selector of the resources of all tunnels.
+func tunnelSelector() string {
+	req, _ := labels.NewRequirement("io.github.kubetnl", selection.Exists, []string{})
+	return labels.NewSelector().Add(*req).String()
+}
+
+// tunnelInfos assembles the information about the tunnels the services and
+// pods belong to.
+func tunnelInfos(services []corev1.Service, pods []corev1.Pod) []TunnelInfo {
+	infos := make(map[string]*TunnelInfo)
+	get := func(obj metav1.Object) *TunnelInfo {
+		name := obj.GetLabels()["io.github.kubetnl"]
+		key := obj.GetNamespace() + "/" + name
+		if i, ok := infos[key]; ok {
+			return i
+		}
+		i := &TunnelInfo{
+			TypeMeta: metav1.TypeMeta{APIVersion: InfoAPIVersion, Kind: InfoKind},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         obj.GetNamespace(),
+				CreationTimestamp: obj.GetCreationTimestamp(),
+				Labels:            obj.GetLabels(),
+			},
+		}
+		infos[key] = i
+		return i
+	}
+
+	for i := range services {
+		svc := &services[i]
+		info := get(svc)
+		info.Spec.Ports = svc.Spec.Ports
+		info.Status.Service = svc.Name
+		info.Status.ClusterIP = svc.Spec.ClusterIP
+	}
+	for i := range pods {
+		pod := &pods[i]
+		info := get(pod)
+		if len(pod.Spec.Containers) > 0 {
+			info.Spec.Image = pod.Spec.Containers[0].Image
+			for _, p := range pod.Spec.Containers[0].Ports {
+				if p.Name == "ssh" {
+					info.Spec.SSHPort = p.ContainerPort
+				}
+			}
+		}
+		info.Status.Pod = pod.Name
+		info.Status.Phase = pod.Status.Phase
+		info.Status.Ready = isPodReady(pod)
+		info.Status.Node = pod.Spec.NodeName
+	}
+
+	var result []TunnelInfo
+	for _, i := range infos {
+		result = append(result, *i)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if result[a].Namespace != result[b].Namespace {
+			return result[a].Namespace < result[b].Namespace
+		}
+		return result[a].Name < result[b].Name
+	})
+	return result
+}
@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LedgerEntry is a single record in a connection ledger. One entry is
+// written for every connection handled by a port mapping.
+type LedgerEntry struct {
+	Time          time.Time `json:"time"`
+	Tunnel        string    `json:"tunnel"`
+	ContainerPort int       `json:"containerPort"`
+	Target        string    `json:"target"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	Rejected      bool      `json:"rejected,omitempty"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+	Duration      float64   `json:"durationSeconds"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// connectionLedger appends LedgerEntries as JSON lines to a file. Every
+// entry is synced to disk before the write returns so that the ledger
+// survives a crash of kubetnl.
+type connectionLedger struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openConnectionLedger(path string) (*connectionLedger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening connection log: %v", err)
+	}
+	return &connectionLedger{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record writes a ledger entry for e if e describes a closed or rejected
+// connection that was sampled.
+func (l *connectionLedger) record(e Event) error {
+	if e.Type != EventConnectionClosed && e.Type != EventConnectionRejected {
+		return nil
+	}
+	if !e.sampled {
+		return nil
+	}
+	entry := LedgerEntry{
+		Time:          e.Time,
+		Tunnel:        e.Tunnel,
+		ContainerPort: e.ContainerPort,
+		Target:        e.Target,
+		RemoteAddr:    e.RemoteAddr,
+		Rejected:      e.Type == EventConnectionRejected,
+		BytesSent:     e.BytesSent,
+		BytesReceived: e.BytesReceived,
+		Duration:      e.Duration,
+		Error:         e.Error,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *connectionLedger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+)
+
+// followLogsRetryInterval is the time to wait before requesting the logs of a
+// container again that has not started yet.
+const followLogsRetryInterval = time.Second
+
+// followLogs streams the logs of the SSH server container of pod to ErrOut in
+// the background if FollowLogs is set. Each line is prefixed with the name of
+// the container. Streaming stops when ctx is done or the container
+// terminates, e.g. because the pod is deleted.
+func (o *Tunnel) followLogs(ctx context.Context, pod *corev1.Pod) {
+	if !o.FollowLogs {
+		return
+	}
+	go o.streamLogs(ctx, pod.Namespace, pod.Name, sshContainer(pod))
+}
+
+// streamLogs writes the logs of container to ErrOut until the log stream ends.
+// Until the container has started, requesting its logs fails and is retried.
+func (o *Tunnel) streamLogs(ctx context.Context, namespace, name, container string) {
+	req := o.ClientSet.CoreV1().Pods(namespace).GetLogs(name, &corev1.PodLogOptions{
+		Container: container,
+		Follow:    true,
+	})
+	for {
+		stream, err := req.Stream(ctx)
+		if err == nil {
+			defer stream.Close()
+			scanner := bufio.NewScanner(stream)
+			for scanner.Scan() {
+				fmt.Fprintf(o.ErrOut, "[%s] %s\n", container, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil && ctx.Err() == nil {
+				klog.V(2).Infof("Error streaming the logs of Pod %q: %v", name, err)
+			}
+			return
+		}
+		if errors.IsNotFound(err) || ctx.Err() != nil {
+			return
+		}
+		klog.V(3).Infof("Waiting for the logs of Pod %q: %v", name, err)
+		select {
+		case <-time.After(followLogsRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
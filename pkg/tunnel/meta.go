@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultResourceTTLAnnotation is the default annotation key used to
+	// mark resources with a time to live for external garbage collection
+	// tools like kube-janitor.
+	DefaultResourceTTLAnnotation = "janitor/ttl"
+
+	// ProtectFinalizer is the finalizer that keeps the Service of a
+	// protected tunnel from being deleted while the tunnel runs.
+	ProtectFinalizer = "io.github.kubetnl/protect"
+
+	// ManagedAnnotation marks Services created by kubetnl. Services reused
+	// with TunnelConfig.ReuseService that lack it are left in place when
+	// the tunnel is stopped.
+	ManagedAnnotation = "io.github.kubetnl/managed"
+)
+
+// objectMeta returns the metadata that is shared by all resources created for
+// the tunnel.
+func (o *Tunnel) objectMeta() metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name:   o.Name,
+		Labels: map[string]string{},
+	}
+	for k, v := range o.Labels {
+		meta.Labels[k] = v
+	}
+	meta.Labels["io.github.kubetnl"] = o.Name
+	if o.prewarm {
+		meta.Labels[PrewarmedLabel] = "true"
+	}
+	if len(o.Annotations) > 0 {
+		meta.Annotations = map[string]string{}
+		for k, v := range o.Annotations {
+			meta.Annotations[k] = v
+		}
+	}
+	if o.ResourceTTL > 0 {
+		key := o.ResourceTTLAnnotation
+		if key == "" {
+			key = DefaultResourceTTLAnnotation
+		}
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[key] = formatTTL(o.ResourceTTL)
+	}
+	return meta
+}
+
+// formatTTL formats d using the largest unit that represents it exactly, e.g.
+// "2h" instead of "2h0m0s". This is the format understood by kube-janitor.
+func formatTTL(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", (d+time.Second-1)/time.Second)
+	}
+}
@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+// metricsRecorder records Prometheus metrics from connection events, like
+// statsRecorder. Byte counts are added when a connection is closed. All
+// methods are no-ops on a nil *metricsRecorder, i.e. if metrics are disabled.
+type metricsRecorder struct {
+	registry *prometheus.Registry
+
+	connections          *prometheus.CounterVec
+	rejected             *prometheus.CounterVec
+	active               *prometheus.GaugeVec
+	bytesSent            *prometheus.CounterVec
+	bytesReceived        *prometheus.CounterVec
+	sshReconnects        *prometheus.CounterVec
+	portForwardReconnect *prometheus.CounterVec
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	mappingLabels := []string{"tunnel", "container_port"}
+	r := &metricsRecorder{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubetnl_connections_total",
+			Help: "Number of connections accepted per port mapping.",
+		}, mappingLabels),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubetnl_connections_rejected_total",
+			Help: "Number of connections rejected by the source address filters per port mapping.",
+		}, mappingLabels),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubetnl_active_connections",
+			Help: "Number of currently open connections per port mapping.",
+		}, mappingLabels),
+		bytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubetnl_sent_bytes_total",
+			Help: "Bytes forwarded to the in-cluster peers of closed connections per port mapping.",
+		}, mappingLabels),
+		bytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubetnl_received_bytes_total",
+			Help: "Bytes received from the in-cluster peers of closed connections per port mapping.",
+		}, mappingLabels),
+		sshReconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubetnl_ssh_reconnects_total",
+			Help: "Number of times the SSH connection to the tunnel pod was re-established.",
+		}, []string{"tunnel"}),
+		portForwardReconnect: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubetnl_port_forward_reconnects_total",
+			Help: "Number of times the port-forward to the tunnel pod was re-established.",
+		}, []string{"tunnel"}),
+	}
+	r.registry.MustRegister(
+		r.connections,
+		r.rejected,
+		r.active,
+		r.bytesSent,
+		r.bytesReceived,
+		r.sshReconnects,
+		r.portForwardReconnect,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return r
+}
+
+// record updates the metrics from a connection event. Other events are
+// ignored.
+func (r *metricsRecorder) record(e Event) {
+	if r == nil {
+		return
+	}
+	labels := prometheus.Labels{"tunnel": e.Tunnel, "container_port": strconv.Itoa(e.ContainerPort)}
+	switch e.Type {
+	case EventConnectionOpened:
+		r.connections.With(labels).Inc()
+		r.active.With(labels).Inc()
+	case EventConnectionClosed:
+		r.active.With(labels).Dec()
+		r.bytesSent.With(labels).Add(float64(e.BytesSent))
+		r.bytesReceived.With(labels).Add(float64(e.BytesReceived))
+	case EventConnectionRejected:
+		r.rejected.With(labels).Inc()
+	}
+}
+
+func (r *metricsRecorder) sshReconnected(tunnel string) {
+	if r != nil {
+		r.sshReconnects.WithLabelValues(tunnel).Inc()
+	}
+}
+
+func (r *metricsRecorder) portForwardReconnected(tunnel string) {
+	if r != nil {
+		r.portForwardReconnect.WithLabelValues(tunnel).Inc()
+	}
+}
+
+// serve serves the metrics on addr under /metrics until ctx is done. It
+// returns once the listener is open.
+func (r *metricsRecorder) serve(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for metrics on %s: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Error serving metrics: %v", err)
+		}
+	}()
+	klog.V(2).Infof("Serving metrics on http://%s/metrics", l.Addr())
+	return nil
+}
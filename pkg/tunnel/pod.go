@@ -3,7 +3,10 @@ package tunnel
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -12,6 +15,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
 	watchtools "k8s.io/client-go/tools/watch"
 	"k8s.io/klog/v2"
 
@@ -19,108 +23,320 @@ import (
 	"github.com/pschmitt/kubetnl/pkg/port"
 )
 
-var kubetnlPodContainerName = "main"
+// kubetnlPodContainerName is the default name of the container of the tunnel
+// pod.
+const kubetnlPodContainerName = "main"
 
-func getServiceAccount(name string) *corev1.ServiceAccount {
+// SeccompLocalhostPrefix is the prefix of TunnelConfig.SeccompProfile values
+// that refer to a profile on the node.
+const SeccompLocalhostPrefix = "localhost/"
+
+func getServiceAccount(meta metav1.ObjectMeta) *corev1.ServiceAccount {
 	return &corev1.ServiceAccount{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
-			Labels: map[string]string{
-				"io.github.kubetnl": name,
-			},
-		},
+		ObjectMeta: meta,
 	}
 }
 
-func getPod(name, image string, sshPort int, ports []corev1.ContainerPort) *corev1.Pod {
-	return &corev1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
-			Labels: map[string]string{
-				"io.github.kubetnl": name,
-			},
-		},
+func getPod(meta metav1.ObjectMeta, cfg *TunnelConfig, creds Credentials, ports []corev1.ContainerPort, udpRelays map[port.Port]int) *corev1.Pod {
+	sshPort := cfg.RemoteSSHPort
+	pod := &corev1.Pod{
+		ObjectMeta: meta,
 		Spec: corev1.PodSpec{
-			ServiceAccountName: string(name),
+			ServiceAccountName: cfg.serviceAccountName(meta.Name),
 			Containers: []corev1.Container{{
-				Name:            kubetnlPodContainerName,
-				Image:           image,
+				Name:            cfg.containerName(),
+				Image:           cfg.Image,
 				ImagePullPolicy: corev1.PullPolicy(corev1.PullIfNotPresent),
 				Ports:           ports,
+				Resources:       cfg.PodResources,
 				Env: []corev1.EnvVar{
 					{Name: "PORT", Value: strconv.Itoa(sshPort)},
-					{Name: "PASSWORD_ACCESS", Value: "true"},
-					{Name: "USER_NAME", Value: "user"},
-					{Name: "USER_PASSWORD", Value: "password"},
+					{Name: "USER_NAME", Value: creds.User},
 				},
-				VolumeMounts: []corev1.VolumeMount{{
-					Name:      "scripts",
-					MountPath: scriptDirectory,
-				}},
-				ReadinessProbe: &corev1.Probe{
-					ProbeHandler: corev1.ProbeHandler{
-						TCPSocket: &corev1.TCPSocketAction{
-							Port: intstr.FromInt(sshPort),
+				ReadinessProbe: sshProbe(cfg),
+				LivenessProbe:  sshProbe(cfg),
+			}},
+		},
+	}
+
+	env := &pod.Spec.Containers[0].Env
+	if !cfg.NoInitScript {
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "scripts",
+			MountPath: scriptDirectory,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "scripts",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: meta.Name,
+					},
+					Items: []corev1.KeyToPath{
+						{
+							Key:  scriptFilename,
+							Path: scriptFilename,
 						},
 					},
-					InitialDelaySeconds: 5,
-					PeriodSeconds:       5,
-					FailureThreshold:    3,
 				},
-			}},
-			Volumes: []corev1.Volume{{
-				Name: "scripts",
-				VolumeSource: corev1.VolumeSource{
-					ConfigMap: &corev1.ConfigMapVolumeSource{
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: name,
-						},
-						Items: []corev1.KeyToPath{
-							{
-								Key:  scriptFilename,
-								Path: scriptFilename,
-							},
-						},
+			},
+		})
+	}
+	if creds.Signer != nil {
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "authorized-keys",
+			MountPath: authorizedKeysDirectory,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "authorized-keys",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: meta.Name,
 					},
+					Items: []corev1.KeyToPath{{
+						Key:  authorizedKeysFilename,
+						Path: authorizedKeysFilename,
+					}},
 				},
-			}},
+			},
+		})
+	} else {
+		*env = append(*env,
+			corev1.EnvVar{Name: "PASSWORD_ACCESS", Value: "true"},
+			corev1.EnvVar{Name: "USER_PASSWORD", Value: creds.Password},
+		)
+	}
+	if cfg.SSHMaxSessions > 0 {
+		*env = append(*env, corev1.EnvVar{Name: "SSH_MAX_SESSIONS", Value: maxSessionsEnv(cfg.SSHMaxSessions)})
+	}
+	if cfg.SSHMaxStartups != "" {
+		*env = append(*env, corev1.EnvVar{Name: "SSH_MAX_STARTUPS", Value: cfg.SSHMaxStartups})
+	}
+
+	if len(udpRelays) > 0 {
+		*env = append(*env, corev1.EnvVar{Name: "UDP_FORWARDS", Value: udpForwardsEnv(udpRelays)})
+		mode := int32(0755)
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "services",
+			MountPath: serviceDirectory,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "services",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: meta.Name,
+					},
+					Items: []corev1.KeyToPath{{
+						Key:  udpRelayFilename,
+						Path: udpRelayFilename,
+					}},
+					DefaultMode: &mode,
+				},
+			},
+		})
+	}
+
+	*env = mergeEnv(*env, cfg.ExtraEnv)
+
+	pod.Spec.SecurityContext, pod.Spec.Containers[0].SecurityContext = securityContexts(cfg)
+
+	pod.Spec.NodeSelector = cfg.NodeSelector
+	pod.Spec.NodeName = cfg.NodeName
+	pod.Spec.Tolerations = cfg.Tolerations
+	for _, name := range cfg.ImagePullSecrets {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	}
+	if cfg.PodMaxLifetime > 0 {
+		seconds := int64((cfg.PodMaxLifetime + time.Second - 1) / time.Second)
+		pod.Spec.ActiveDeadlineSeconds = &seconds
+	}
+
+	if cfg.HostNetwork {
+		pod.Spec.HostNetwork = true
+		// Keep resolving cluster internal names, e.g. for targets of
+		// port mappings that are Services.
+		pod.Spec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+	}
+
+	if cfg.StartupProbe {
+		// While the startup probe did not succeed, the readiness
+		// probe is not run. Thus a slow starting SSH server does not
+		// cause the pod to be restarted or reported as not ready.
+		pod.Spec.Containers[0].StartupProbe = &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				TCPSocket: &corev1.TCPSocketAction{
+					Port: intstr.FromInt(sshPort),
+				},
+			},
+			PeriodSeconds:    5,
+			FailureThreshold: cfg.StartupProbeFailureThreshold,
+		}
+	}
+
+	return pod
+}
+
+// containerName returns the name of the container of the tunnel pod.
+func (c *TunnelConfig) containerName() string {
+	if c.ContainerName == "" {
+		return kubetnlPodContainerName
+	}
+	return c.ContainerName
+}
+
+// mergeEnv appends extra to env. Variables of extra replace the variables of
+// the same name in env.
+func mergeEnv(env, extra []corev1.EnvVar) []corev1.EnvVar {
+	for _, e := range extra {
+		replaced := false
+		for i := range env {
+			if env[i].Name == e.Name {
+				env[i] = e
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// securityContexts returns the security contexts of the tunnel pod and its
+// container with the seccomp profile of cfg.
+func securityContexts(cfg *TunnelConfig) (*corev1.PodSecurityContext, *corev1.SecurityContext) {
+	podContext, containerContext := cfg.PodSecurityContext.DeepCopy(), cfg.SecurityContext.DeepCopy()
+	if profile := seccompProfile(cfg.SeccompProfile); profile != nil {
+		if podContext == nil {
+			podContext = &corev1.PodSecurityContext{}
+		}
+		if containerContext == nil {
+			containerContext = &corev1.SecurityContext{}
+		}
+		podContext.SeccompProfile = profile
+		containerContext.SeccompProfile = profile.DeepCopy()
+	}
+	return podContext, containerContext
+}
+
+// sshProbe returns a TCP probe on the SSH port with the probe timings of cfg.
+func sshProbe(cfg *TunnelConfig) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			TCPSocket: &corev1.TCPSocketAction{
+				Port: intstr.FromInt(cfg.RemoteSSHPort),
+			},
 		},
+		InitialDelaySeconds: probeSeconds(cfg.ProbeInitialDelay),
+		PeriodSeconds:       probeSeconds(cfg.ProbePeriod),
+		FailureThreshold:    cfg.ProbeFailureThreshold,
 	}
 }
 
-func (o *Tunnel) CreatePod(ctx context.Context) error {
-	var err error
+// probeSeconds rounds d up to whole seconds.
+func probeSeconds(d time.Duration) int32 {
+	return int32((d + time.Second - 1) / time.Second)
+}
+
+// seccompProfile returns the seccomp profile for the value of
+// TunnelConfig.SeccompProfile or nil if it is empty.
+func seccompProfile(s string) *corev1.SeccompProfile {
+	switch {
+	case s == "":
+		return nil
+	case strings.HasPrefix(s, SeccompLocalhostPrefix):
+		path := strings.TrimPrefix(s, SeccompLocalhostPrefix)
+		return &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &path}
+	default:
+		return &corev1.SeccompProfile{Type: corev1.SeccompProfileType(s)}
+	}
+}
+
+// ValidateSeccompProfile checks that s is a valid value for
+// TunnelConfig.SeccompProfile.
+func ValidateSeccompProfile(s string) error {
+	switch {
+	case s == "", s == string(corev1.SeccompProfileTypeRuntimeDefault), s == string(corev1.SeccompProfileTypeUnconfined):
+		return nil
+	case strings.HasPrefix(s, SeccompLocalhostPrefix) && len(s) > len(SeccompLocalhostPrefix):
+		return nil
+	}
+	return fmt.Errorf("invalid seccomp profile %q: must be %q, %q or %q followed by the path of the profile", s, corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeUnconfined, SeccompLocalhostPrefix)
+}
 
-	// Create the service for incoming traffic within the cluster. The pod
-	// exposes all ports that are in mentioned in
-	// o.PortMappings[*].ContainerPortNumber using the specied protocol.
-	// Additionally it exposes the port for the ssh conn.
-	ports := append(containerPorts(o.PortMappings), corev1.ContainerPort{
+// podSecurityHint annotates err with the flags to use if the Pod was rejected
+// by the PodSecurity admission controller. The error of the API server
+// already names the violated policy and the offending fields.
+func podSecurityHint(err error) error {
+	if !errors.IsForbidden(err) || !strings.Contains(err.Error(), "violates PodSecurity") {
+		return err
+	}
+	return fmt.Errorf("%v (hint: the \"baseline\" level requires a --seccomp-profile other than \"Unconfined\" and no --host-network, the \"restricted\" level additionally --run-as-non-root with an --image that runs as a non-root user)", err)
+}
+
+// podPorts returns the container ports of the tunnel pod. The pod exposes
+// all ports that are in mentioned in o.PortMappings[*].ContainerPortNumber
+// using the specied protocol. Additionally it exposes the port for the ssh
+// conn.
+func (o *Tunnel) podPorts() []corev1.ContainerPort {
+	return append(containerPorts(o.PortMappings), corev1.ContainerPort{
 		Name:          "ssh",
 		ContainerPort: int32(o.RemoteSSHPort),
 	})
+}
 
+// serviceAccountName returns the name of the ServiceAccount the pod of the
+// tunnel name runs as.
+func (c *TunnelConfig) serviceAccountName(name string) string {
+	if c.ServiceAccount != "" {
+		return c.ServiceAccount
+	}
+	return name
+}
+
+// createServiceAccount creates the ServiceAccount the tunnel pod runs as,
+// unless an existing one is set with ServiceAccount.
+func (o *Tunnel) createServiceAccount(ctx context.Context) error {
+	var err error
+	if o.ServiceAccount != "" {
+		klog.V(2).Infof("Using ServiceAccount %q.", o.ServiceAccount)
+		return nil
+	}
 	o.serviceAccountClient = o.ClientSet.CoreV1().ServiceAccounts(o.Namespace)
-	o.serviceAccount = getServiceAccount(o.Name)
+	o.serviceAccount = getServiceAccount(o.objectMeta())
 
 	klog.V(2).Infof("Creating ServiceAccount %q...", o.Name)
 	o.serviceAccount, err = o.serviceAccountClient.Create(ctx, o.serviceAccount, metav1.CreateOptions{})
 	if err != nil {
+		o.serviceAccount = nil
 		if !errors.IsAlreadyExists(err) {
-			return fmt.Errorf("error creating ServiceAccount %q: %v", o.serviceAccount.Name, err)
+			return fmt.Errorf("error creating ServiceAccount %q: %v", o.Name, err)
 		}
 	}
+	return nil
+}
+
+func (o *Tunnel) CreatePod(ctx context.Context) error {
+	var err error
+
+	if err := o.createServiceAccount(ctx); err != nil {
+		return err
+	}
 
 	o.podClient = o.ClientSet.CoreV1().Pods(o.Namespace)
-	o.pod = getPod(o.Name, o.Image, o.RemoteSSHPort, ports)
+	o.pod = getPod(o.objectMeta(), &o.TunnelConfig, o.credentials, o.podPorts(), o.udpRelays)
 
 	klog.V(2).Infof("Creating Pod %q...", o.Name)
 	o.pod, err = o.podClient.Create(ctx, o.pod, metav1.CreateOptions{})
 	if err != nil {
-		return fmt.Errorf("error creating Pod: %v", err)
+		o.pod = nil
+		return fmt.Errorf("error creating Pod: %v", podSecurityHint(err))
 	}
 
-	klog.V(3).Infof("Created Pod %q.", o.service.GetObjectMeta().GetName())
+	klog.V(3).Infof("Created Pod %q.", o.pod.GetObjectMeta().GetName())
+	o.followLogs(ctx, o.pod)
 
 	klog.V(3).Infof("Waiting for the Pod to be ready before setting up a SSH connection.")
 	watchOptions := metav1.ListOptions{}
@@ -131,10 +347,34 @@ func (o *Tunnel) CreatePod(ctx context.Context) error {
 		return fmt.Errorf("error watching Pod %s: %v", o.Name, err)
 	}
 
-	_, err = watchtools.UntilWithoutRetry(ctx, podWatch, condPodReady)
+	readyCtx := ctx
+	if o.PodReadyTimeout > 0 {
+		var readyCancel context.CancelFunc
+		readyCtx, readyCancel = context.WithTimeout(ctx, o.PodReadyTimeout)
+		defer readyCancel()
+	}
+	pullCtx, pullCancel := context.WithCancel(readyCtx)
+	defer pullCancel()
+	pullTimer := newImagePullTimer(o.ImagePullTimeout, pullCancel)
+	defer pullTimer.stop()
+
+	_, err = watchtools.UntilWithoutRetry(pullCtx, podWatch, func(event watch.Event) (bool, error) {
+		pod := event.Object.(*corev1.Pod)
+		pullTimer.update(pod)
+		if err := o.checkScheduling(pod); err != nil {
+			return false, err
+		}
+		if err := o.checkImagePull(pod); err != nil {
+			return false, err
+		}
+		return condPodReady(event)
+	})
 	if err != nil {
+		if pullTimer.exceeded() {
+			return fmt.Errorf("error waiting for Pod ready: image pull exceeded %s for image %q%s", o.ImagePullTimeout, o.Image, o.warningEvents(ctx))
+		}
 		if err == watchtools.ErrWatchClosed {
-			return fmt.Errorf("error waiting for Pod ready: podWatch has been closed before pod ready event received")
+			return fmt.Errorf("error waiting for Pod ready: podWatch has been closed before pod ready event received%s", o.warningEvents(ctx))
 		}
 
 		// err will be wait.ErrWatchClosed is the context passed to
@@ -143,10 +383,15 @@ func (o *Tunnel) CreatePod(ctx context.Context) error {
 		if ctx.Err() != nil {
 			return graceful.Interrupted
 		}
+		if readyCtx.Err() != nil {
+			return fmt.Errorf("error waiting for Pod ready: timed out after %s%s", o.PodReadyTimeout, o.warningEvents(ctx))
+		}
 		if err == wait.ErrWaitTimeout {
-			return fmt.Errorf("error waiting for Pod ready: timed out after %d seconds", 300)
+			return fmt.Errorf("error waiting for Pod ready: timed out%s", o.warningEvents(ctx))
 		}
-		return fmt.Errorf("error waiting for Pod ready: received unknown error \"%f\"", err)
+		// The errors of checkScheduling and checkImagePull already
+		// name the reason.
+		return fmt.Errorf("error waiting for Pod ready: %v", err)
 	}
 
 	klog.V(2).Infof("Pod ready...")
@@ -157,7 +402,9 @@ func (o *Tunnel) CleanupPod(ctx context.Context) error {
 	deletePolicy := metav1.DeletePropagationForeground
 	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &deletePolicy}
 
-	if o.pod != nil {
+	// The pods of a Deployment are deleted with it, see
+	// CleanupDeployment.
+	if o.pod != nil && !o.existingPod && o.deployment == nil {
 		klog.V(2).Infof("Cleanup: deleting pod %s ...", o.pod.Name)
 		if err := o.podClient.Delete(ctx, o.pod.Name, deleteOptions); err != nil {
 			klog.V(1).Infof("Cleanup: error deleting Pod: %v. That pod probably still runs. You can use kubetnl cleanup to clean up all resources created by kubetnl.", err)
@@ -179,7 +426,12 @@ func (o *Tunnel) CleanupPod(ctx context.Context) error {
 func containerPorts(mappings []port.Mapping) []corev1.ContainerPort {
 	var ports []corev1.ContainerPort
 	for _, m := range mappings {
+		name := m.ContainerPortName
+		if name == "" {
+			name = portName(m)
+		}
 		ports = append(ports, corev1.ContainerPort{
+			Name:          name,
 			ContainerPort: int32(m.ContainerPortNumber),
 			Protocol:      protocolToCoreV1(m.Protocol),
 			// TODO: HostIP?
@@ -188,6 +440,226 @@ func containerPorts(mappings []port.Mapping) []corev1.ContainerPort {
 	return ports
 }
 
+// imagePullWaitingReasons are the reasons of a waiting container that
+// indicate that its image is still being pulled.
+var imagePullWaitingReasons = map[string]bool{
+	"ContainerCreating": true,
+	"ImagePulling":      true,
+	"ErrImagePull":      true,
+	"ImagePullBackOff":  true,
+}
+
+// imagePullTimer calls a cancel function if the tunnel container is waiting
+// for its image to be pulled for longer than a timeout.
+type imagePullTimer struct {
+	timeout  time.Duration
+	cancel   func()
+	timer    *time.Timer
+	timedOut chan struct{}
+}
+
+func newImagePullTimer(timeout time.Duration, cancel func()) *imagePullTimer {
+	return &imagePullTimer{
+		timeout:  timeout,
+		cancel:   cancel,
+		timedOut: make(chan struct{}),
+	}
+}
+
+// update starts the timer once the tunnel container of pod waits for its image
+// to be pulled and stops it once the container is no longer waiting.
+func (t *imagePullTimer) update(pod *corev1.Pod) {
+	if t.timeout <= 0 {
+		return
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != sshContainer(pod) {
+			continue
+		}
+		pulling := status.State.Waiting != nil && imagePullWaitingReasons[status.State.Waiting.Reason]
+		switch {
+		case pulling && t.timer == nil:
+			klog.V(3).Infof("Tunnel pod check: waiting for image to be pulled (%s).", status.State.Waiting.Reason)
+			t.timer = time.AfterFunc(t.timeout, func() {
+				close(t.timedOut)
+				t.cancel()
+			})
+		case !pulling && t.timer != nil:
+			t.stop()
+		}
+	}
+}
+
+func (t *imagePullTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// exceeded reports whether the timeout was exceeded.
+func (t *imagePullTimer) exceeded() bool {
+	select {
+	case <-t.timedOut:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchPodTermination watches the pod of the running tunnel and ends the
+// tunnel, see Done, once the pod terminated or was deleted. Tunnels backed by
+// a Deployment move to the replacement pod instead, see replacePod. It
+// returns without ending the tunnel when ctx is done.
+func (o *Tunnel) watchPodTermination(ctx context.Context) {
+	for {
+		reason := o.podTerminated(ctx)
+		if reason == nil {
+			return
+		}
+		if o.deployment == nil {
+			o.end(reason)
+			return
+		}
+		if err := o.replacePod(ctx, reason); err != nil {
+			if ctx.Err() == nil {
+				o.end(err)
+			}
+			return
+		}
+	}
+}
+
+// podTerminated watches the pod of the running tunnel until it terminated or
+// was deleted and returns the reason. It returns nil if ctx is done or the
+// pod can not be watched.
+func (o *Tunnel) podTerminated(ctx context.Context) error {
+	lw := &cache.ListWatch{
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", o.pod.Name).String()
+			return o.podClient.Watch(ctx, options)
+		},
+	}
+	var reason error
+	_, err := watchtools.Until(ctx, o.pod.ResourceVersion, lw, func(event watch.Event) (bool, error) {
+		pod, ok := event.Object.(*corev1.Pod)
+		if !ok {
+			return false, nil
+		}
+		switch {
+		case event.Type == watch.Deleted:
+			reason = fmt.Errorf("Pod %q has been deleted", pod.Name)
+		case pod.Status.Phase == corev1.PodFailed && pod.Status.Reason == "DeadlineExceeded":
+			reason = fmt.Errorf("Pod %q has been terminated after its maximum lifetime of %s", pod.Name, o.PodMaxLifetime)
+		case pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded:
+			reason = fmt.Errorf("Pod %q terminated: %s %s", pod.Name, pod.Status.Reason, pod.Status.Message)
+		case pod.DeletionTimestamp != nil:
+			reason = fmt.Errorf("Pod %q is being deleted", pod.Name)
+		}
+		return reason != nil, nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		klog.V(1).Infof("Error watching Pod %q: %v", o.pod.Name, err)
+		return nil
+	}
+	return reason
+}
+
+// maxWarningEvents is the maximum number of events reported by warningEvents.
+const maxWarningEvents = 5
+
+// warningEvents returns the latest warning events of the pod, e.g. the
+// reasons the scheduler could not place it or the image could not be pulled,
+// formatted to be appended to an error message. It returns an empty string if
+// there are none or they can not be listed.
+func (o *Tunnel) warningEvents(ctx context.Context) string {
+	selector := fields.Set{
+		"involvedObject.kind": "Pod",
+		"involvedObject.name": o.pod.Name,
+		"involvedObject.uid":  string(o.pod.UID),
+		"type":                corev1.EventTypeWarning,
+	}.AsSelector().String()
+	events, err := o.ClientSet.CoreV1().Events(o.Namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		klog.V(1).Infof("Error listing the events of Pod %q: %v", o.pod.Name, err)
+		return ""
+	}
+	items := events.Items
+	sort.SliceStable(items, func(i, j int) bool {
+		return eventTime(&items[i]).Before(eventTime(&items[j]))
+	})
+	if len(items) > maxWarningEvents {
+		items = items[len(items)-maxWarningEvents:]
+	}
+	var msgs []string
+	for _, e := range items {
+		msg := fmt.Sprintf("%s: %s", e.Reason, strings.TrimSpace(e.Message))
+		if e.Count > 1 {
+			msg += fmt.Sprintf(" (x%d)", e.Count)
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return ""
+	}
+	return ":\n\t" + strings.Join(msgs, "\n\t")
+}
+
+// eventTime returns the time e occurred last.
+func eventTime(e *corev1.Event) time.Time {
+	switch {
+	case e.Series != nil:
+		return e.Series.LastObservedTime.Time
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+// checkScheduling returns an error if pod can not run because of the node
+// constraints of the tunnel: The scheduler found no node matching the
+// NodeSelector or the kubelet of NodeName rejected the pod. Pods without node
+// constraints are not checked since the cluster might still add nodes for
+// them.
+func (o *Tunnel) checkScheduling(pod *corev1.Pod) error {
+	if len(o.NodeSelector) == 0 && o.NodeName == "" {
+		return nil
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		return fmt.Errorf("Pod failed to start on node %q: %s: %s", pod.Spec.NodeName, pod.Status.Reason, pod.Status.Message)
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse && cond.Reason == corev1.PodReasonUnschedulable {
+			return fmt.Errorf("Pod can not be scheduled (check --node-selector): %s", cond.Message)
+		}
+	}
+	return nil
+}
+
+// checkImagePull returns an error if the kubelet backs off pulling the image
+// of the tunnel container. Pulling is retried with an increasing delay, so
+// waiting for the pod to become ready is pointless.
+func (o *Tunnel) checkImagePull(pod *corev1.Pod) error {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != sshContainer(pod) || status.State.Waiting == nil {
+			continue
+		}
+		switch status.State.Waiting.Reason {
+		case "ImagePullBackOff", "InvalidImageName":
+			hint := "check --image and --image-pull-secret"
+			if len(o.ImagePullSecrets) == 0 {
+				hint = "if the image is in a private registry, set --image-pull-secret"
+			}
+			return fmt.Errorf("unable to pull image %q (%s): %s: %s", o.Image, hint, status.State.Waiting.Reason, status.State.Waiting.Message)
+		}
+	}
+	return nil
+}
+
 func condPodReady(event watch.Event) (bool, error) {
 	pod := event.Object.(*corev1.Pod)
 	for _, cond := range pod.Status.Conditions {
@@ -0,0 +1,273 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/pschmitt/kubetnl/pkg/net"
+)
+
+const (
+	// PrewarmedLabel marks pods (and their ServiceAccount and ConfigMap)
+	// that have been created by "kubetnl prewarm" and have not been
+	// adopted by a tunnel yet.
+	PrewarmedLabel = "io.github.kubetnl/prewarmed"
+)
+
+// Prewarm creates the ConfigMap, ServiceAccount and Pod for a tunnel without
+// creating a Service or forwarding any ports. It waits for the Pod to become
+// ready (and thus for its image to be pulled) and leaves it running idle.
+//
+// A later tunnel started with UsePrewarmed set adopts a prewarmed Pod instead
+// of creating a new one.
+func (o *Tunnel) Prewarm(ctx context.Context) error {
+	o.prewarm = true
+	if err := o.resolveCredentials(ctx); err != nil {
+		return err
+	}
+	if err := o.CreateConfigMap(ctx); err != nil {
+		return err
+	}
+	return o.CreatePod(ctx)
+}
+
+// adoptPrewarmed tries to find a ready prewarmed Pod that runs o.Image in the
+// network namespace requested by o.HostNetwork and claims it for the tunnel.
+// It returns false if there is no Pod that can be adopted.
+func (o *Tunnel) adoptPrewarmed(ctx context.Context) (bool, error) {
+	o.podClient = o.ClientSet.CoreV1().Pods(o.Namespace)
+	o.configMapClient = o.ClientSet.CoreV1().ConfigMaps(o.Namespace)
+	o.serviceAccountClient = o.ClientSet.CoreV1().ServiceAccounts(o.Namespace)
+
+	pods, err := o.podClient.List(ctx, metav1.ListOptions{
+		LabelSelector: PrewarmedLabel + "=true",
+	})
+	if err != nil {
+		return false, fmt.Errorf("error listing prewarmed Pods: %v", err)
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		sshPort, ok := prewarmedPodSSHPort(pod)
+		if !ok || pod.Spec.Containers[0].Image != o.Image || pod.Spec.HostNetwork != o.HostNetwork || !isPodReady(pod) {
+			continue
+		}
+		if !o.adoptCredentials(pod) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it uses different SSH credentials.", pod.Name)
+			continue
+		}
+		if podEnv(pod, "SSH_MAX_SESSIONS") != maxSessionsEnv(o.SSHMaxSessions) || podEnv(pod, "SSH_MAX_STARTUPS") != o.SSHMaxStartups {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: its SSH server uses different limits.", pod.Name)
+			continue
+		}
+		if pod.Spec.Containers[0].Name != o.containerName() || !hasEnv(pod, o.ExtraEnv) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it has a different container name or does not set the extra environment variables.", pod.Name)
+			continue
+		}
+		if podEnv(pod, "UDP_FORWARDS") != udpForwardsEnv(o.udpRelays) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it does not relay the UDP port mappings.", pod.Name)
+			continue
+		}
+		if !equality.Semantic.DeepEqual(pod.Spec.NodeSelector, o.NodeSelector) || (o.NodeName != "" && pod.Spec.NodeName != o.NodeName) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it does not match the node constraints.", pod.Name)
+			continue
+		}
+		if o.PodMaxLifetime > 0 {
+			// The lifetime counts from the start of the pod, so a
+			// prewarmed pod can not be limited to it.
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: a maximum pod lifetime is set.", pod.Name)
+			continue
+		}
+		if !equality.Semantic.DeepEqual(pod.Spec.Containers[0].Resources, o.PodResources) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it has different resource requests or limits.", pod.Name)
+			continue
+		}
+		if !equality.Semantic.DeepEqual(podSeccompProfile(pod), seccompProfile(o.SeccompProfile)) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it uses a different seccomp profile.", pod.Name)
+			continue
+		}
+		if podContext, containerContext := securityContexts(&o.TunnelConfig); !equality.Semantic.DeepEqual(pod.Spec.SecurityContext, podContext) || !equality.Semantic.DeepEqual(pod.Spec.Containers[0].SecurityContext, containerContext) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it uses a different security context.", pod.Name)
+			continue
+		}
+		if !sameProbeTimings(pod.Spec.Containers[0].LivenessProbe, sshProbe(&o.TunnelConfig)) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: it uses different probe timings.", pod.Name)
+			continue
+		}
+		if net.IsInUse(o.PortMappings, sshPort) {
+			klog.V(3).Infof("Not adopting prewarmed Pod %q: its SSH port %d is used by a port mapping.", pod.Name, sshPort)
+			continue
+		}
+
+		// Claim the pod. The resourceVersion in the patch makes sure
+		// that the claim fails if another tunnel claimed it in the
+		// meantime.
+		claimed, err := o.podClient.Patch(ctx, pod.Name, types.MergePatchType, o.claimPatch(pod.ResourceVersion), metav1.PatchOptions{})
+		if err != nil {
+			if errors.IsConflict(err) {
+				continue
+			}
+			return false, fmt.Errorf("error adopting prewarmed Pod %q: %v", pod.Name, err)
+		}
+		klog.V(2).Infof("Adopted prewarmed Pod %q.", pod.Name)
+		o.pod = claimed
+		o.RemoteSSHPort = sshPort
+		o.followLogs(ctx, claimed)
+
+		// Take over the ServiceAccount and ConfigMap of the pod as
+		// well, so that they are cleaned up with the tunnel.
+		o.serviceAccount, err = o.serviceAccountClient.Patch(ctx, pod.Spec.ServiceAccountName, types.MergePatchType, o.claimPatch(""), metav1.PatchOptions{})
+		if err != nil {
+			klog.V(1).Infof("Error adopting ServiceAccount of prewarmed Pod %q: %v", pod.Name, err)
+			o.serviceAccount = nil
+		}
+		for _, v := range pod.Spec.Volumes {
+			if v.ConfigMap == nil {
+				continue
+			}
+			o.configMap, err = o.configMapClient.Patch(ctx, v.ConfigMap.Name, types.MergePatchType, o.claimPatch(""), metav1.PatchOptions{})
+			if err != nil {
+				klog.V(1).Infof("Error adopting ConfigMap of prewarmed Pod %q: %v", pod.Name, err)
+				o.configMap = nil
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// claimPatch returns a merge patch that removes the PrewarmedLabel and
+// assigns the resource to the tunnel, including its custom labels and
+// annotations. If resourceVersion is non-empty, the patch only applies to
+// that version of the resource.
+func (o *Tunnel) claimPatch(resourceVersion string) []byte {
+	labels := map[string]interface{}{}
+	for k, v := range o.Labels {
+		labels[k] = v
+	}
+	labels["io.github.kubetnl"] = o.Name
+	labels[PrewarmedLabel] = nil
+	metadata := map[string]interface{}{
+		"labels": labels,
+	}
+	if len(o.Annotations) > 0 {
+		metadata["annotations"] = o.Annotations
+	}
+	if resourceVersion != "" {
+		metadata["resourceVersion"] = resourceVersion
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"metadata": metadata})
+	return patch
+}
+
+// prewarmedPodSSHPort returns the port the SSH server of a prewarmed pod
+// listens on.
+func prewarmedPodSSHPort(pod *corev1.Pod) (int, bool) {
+	p, err := strconv.Atoi(podEnv(pod, "PORT"))
+	return p, err == nil
+}
+
+// maxSessionsEnv returns the value of the SSH_MAX_SESSIONS environment
+// variable for n.
+func maxSessionsEnv(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// podEnv returns the value of the environment variable name of the first
+// container of pod.
+func podEnv(pod *corev1.Pod, name string) string {
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+	for _, env := range pod.Spec.Containers[0].Env {
+		if env.Name == name {
+			return env.Value
+		}
+	}
+	return ""
+}
+
+// hasEnv reports whether the first container of pod sets all variables of
+// env to the same values.
+func hasEnv(pod *corev1.Pod, env []corev1.EnvVar) bool {
+	for _, e := range env {
+		if podEnv(pod, e.Name) != e.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// podSeccompProfile returns the pod level seccomp profile of pod.
+func podSeccompProfile(pod *corev1.Pod) *corev1.SeccompProfile {
+	if pod.Spec.SecurityContext == nil {
+		return nil
+	}
+	return pod.Spec.SecurityContext.SeccompProfile
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanupPrewarmed deletes all Pods, ConfigMaps and ServiceAccounts in
+// namespace that have been created by Prewarm and have not been adopted by a
+// tunnel. It returns the names of the deleted Pods.
+func CleanupPrewarmed(ctx context.Context, cs kubernetes.Interface, namespace string) ([]string, error) {
+	listOptions := metav1.ListOptions{LabelSelector: PrewarmedLabel + "=true"}
+	deletePolicy := metav1.DeletePropagationForeground
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &deletePolicy}
+
+	pods, err := cs.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing prewarmed Pods: %v", err)
+	}
+	var deleted []string
+	for _, pod := range pods.Items {
+		klog.V(2).Infof("Cleanup: deleting prewarmed Pod %s ...", pod.Name)
+		if err := cs.CoreV1().Pods(namespace).Delete(ctx, pod.Name, deleteOptions); err != nil && !errors.IsNotFound(err) {
+			return deleted, fmt.Errorf("error deleting prewarmed Pod %q: %v", pod.Name, err)
+		}
+		deleted = append(deleted, pod.Name)
+	}
+	if err := cs.CoreV1().ConfigMaps(namespace).DeleteCollection(ctx, deleteOptions, listOptions); err != nil {
+		return deleted, fmt.Errorf("error deleting prewarmed ConfigMaps: %v", err)
+	}
+	sas, err := cs.CoreV1().ServiceAccounts(namespace).List(ctx, listOptions)
+	if err != nil {
+		return deleted, fmt.Errorf("error listing prewarmed ServiceAccounts: %v", err)
+	}
+	for _, sa := range sas.Items {
+		if err := cs.CoreV1().ServiceAccounts(namespace).Delete(ctx, sa.Name, deleteOptions); err != nil && !errors.IsNotFound(err) {
+			return deleted, fmt.Errorf("error deleting prewarmed ServiceAccount %q: %v", sa.Name, err)
+		}
+	}
+	return deleted, nil
+}
+
+// sameProbeTimings reports whether the probes a and b run with the same
+// timings. Probes of pods created before liveness probes were added are nil.
+func sameProbeTimings(a, b *corev1.Probe) bool {
+	return a != nil && b != nil &&
+		a.InitialDelaySeconds == b.InitialDelaySeconds &&
+		a.PeriodSeconds == b.PeriodSeconds &&
+		a.FailureThreshold == b.FailureThreshold
+}
@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// Render returns the objects Run creates for the tunnel, in the order they
+// are created, without creating them. If serverDryRun is set, the objects are
+// sent to the API server in dry-run mode, so that they are validated and
+// defaulted without being persisted, and the objects returned by the server
+// are returned instead.
+//
+// The SSH credentials are resolved as by Run, so that the objects carry the
+// same authorized key or password.
+func (o *Tunnel) Render(ctx context.Context, serverDryRun bool) ([]runtime.Object, error) {
+	if o.ExistingPod != "" || o.Attach {
+		return nil, fmt.Errorf("no resources are created for an existing pod")
+	}
+	if err := o.resolveCredentials(ctx); err != nil {
+		return nil, err
+	}
+	o.udpRelays = udpRelayPorts(o.PortMappings, o.RemoteSSHPort)
+
+	meta := o.objectMeta()
+	meta.Namespace = o.Namespace
+	objs := []runtime.Object{getService(meta, &o.TunnelConfig, servicePorts(o.PortMappings))}
+	if !o.NoInitScript {
+		objs = append(objs, getConfigMap(meta, o.credentials.authorizedKey()))
+	}
+	if o.ServiceAccount == "" {
+		objs = append(objs, getServiceAccount(meta))
+	}
+	pod := getPod(meta, &o.TunnelConfig, o.credentials, o.podPorts(), o.udpRelays)
+	if o.Controller == ControllerDeployment {
+		objs = append(objs, getDeployment(meta, pod))
+	} else {
+		objs = append(objs, pod)
+	}
+
+	for i, obj := range objs {
+		if err := setKind(obj); err != nil {
+			return nil, err
+		}
+		if !serverDryRun {
+			continue
+		}
+		created, err := o.createDryRun(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		// Objects returned by the clients do not carry their kind.
+		if err := setKind(created); err != nil {
+			return nil, err
+		}
+		objs[i] = created
+	}
+	return objs, nil
+}
+
+// setKind sets the apiVersion and kind of obj, which the object builders and
+// clients leave empty.
+func setKind(obj runtime.Object) error {
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	return nil
+}
+
+// createDryRun creates obj in dry-run mode and returns the object returned by
+// the API server.
+func (o *Tunnel) createDryRun(ctx context.Context, obj runtime.Object) (runtime.Object, error) {
+	opts := metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}}
+	var created runtime.Object
+	var err error
+	switch obj := obj.(type) {
+	case *corev1.Service:
+		created, err = o.ClientSet.CoreV1().Services(o.Namespace).Create(ctx, obj, opts)
+	case *corev1.ConfigMap:
+		created, err = o.ClientSet.CoreV1().ConfigMaps(o.Namespace).Create(ctx, obj, opts)
+	case *corev1.ServiceAccount:
+		created, err = o.ClientSet.CoreV1().ServiceAccounts(o.Namespace).Create(ctx, obj, opts)
+	case *corev1.Pod:
+		created, err = o.ClientSet.CoreV1().Pods(o.Namespace).Create(ctx, obj, opts)
+	case *appsv1.Deployment:
+		created, err = o.ClientSet.AppsV1().Deployments(o.Namespace).Create(ctx, obj, opts)
+	default:
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s %q in dry-run mode: %v", obj.GetObjectKind().GroupVersionKind().Kind, o.Name, podSecurityHint(err))
+	}
+	return created, nil
+}
@@ -5,28 +5,50 @@ import (
 	"fmt"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 
+	"github.com/pschmitt/kubetnl/pkg/graceful"
 	"github.com/pschmitt/kubetnl/pkg/port"
 )
 
-func getService(name string, ports []corev1.ServicePort) *corev1.Service {
-	return &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
-			Labels: map[string]string{
-				"io.github.kubetnl": name,
-			},
-		},
+func getService(meta metav1.ObjectMeta, cfg *TunnelConfig, ports []corev1.ServicePort) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: meta,
 		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceType(cfg.ServiceType),
 			Selector: map[string]string{
-				"io.github.kubetnl": name,
+				"io.github.kubetnl": meta.Name,
 			},
 			Ports: ports,
 		},
 	}
+	if cfg.Protect {
+		// Pods are stopped once their deletion is requested regardless
+		// of finalizers, thus only the Service can be protected.
+		svc.ObjectMeta.Finalizers = []string{ProtectFinalizer}
+	}
+	annotations := make(map[string]string, len(meta.Annotations)+len(cfg.ServiceAnnotations)+1)
+	for k, v := range meta.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range cfg.ServiceAnnotations {
+		annotations[k] = v
+	}
+	annotations[ManagedAnnotation] = "true"
+	svc.ObjectMeta.Annotations = annotations
+	if cfg.InternalTrafficPolicy != "" {
+		policy := corev1.ServiceInternalTrafficPolicyType(cfg.InternalTrafficPolicy)
+		svc.Spec.InternalTrafficPolicy = &policy
+	}
+	return svc
 }
 
 // CreateService creates the `Service` that will listen at the list of port mappings
@@ -40,23 +62,232 @@ func (o *Tunnel) CreateService(ctx context.Context) error {
 	o.serviceClient = o.ClientSet.CoreV1().Services(o.Namespace)
 
 	svcPorts := servicePorts(o.PortMappings)
-	o.service = getService(o.Name, svcPorts)
+	o.service = getService(o.objectMeta(), &o.TunnelConfig, svcPorts)
+
+	if ctx.Err() != nil {
+		o.service = nil
+		return graceful.Interrupted
+	}
 
 	klog.V(3).Infof("Creating Service %q...", o.Name)
-	o.service, err = o.serviceClient.Create(ctx, o.service, metav1.CreateOptions{})
+	desired := o.service
+	o.service, err = o.serviceClient.Create(ctx, desired, metav1.CreateOptions{})
+	if err != nil && errors.IsAlreadyExists(err) && o.ReuseService {
+		o.service, err = o.reuseService(ctx, desired)
+	}
 	if err != nil {
+		o.service = nil
+		// The request fails with a context error if the interrupt
+		// context was canceled while it was in flight.
+		if ctx.Err() != nil {
+			return graceful.Interrupted
+		}
 		return fmt.Errorf("error creating Service: %v", err)
 	}
 
+	// API servers without the ServiceInternalTrafficPolicy feature gate
+	// silently drop the field.
+	if o.InternalTrafficPolicy != "" && o.service.Spec.InternalTrafficPolicy == nil {
+		klog.Warningf("The cluster does not support the internalTrafficPolicy of Services: ignoring %q.", o.InternalTrafficPolicy)
+	}
+
 	klog.V(3).Infof("Created Service %q.", o.service.GetObjectMeta().GetName())
+	o.printNodePorts()
+	if o.service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		go o.waitForLoadBalancer(ctx)
+	}
+	return nil
+}
+
+// reuseService updates the existing Service named like desired to the ports,
+// selector and type of desired. The Service must carry the "io.github.kubetnl"
+// label. If it lacks the ManagedAnnotation, it is not deleted with the tunnel
+// and "kubetnl cleanup" skips it as well, although it keeps the label.
+func (o *Tunnel) reuseService(ctx context.Context, desired *corev1.Service) (*corev1.Service, error) {
+	var reused *corev1.Service
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		svc, err := o.serviceClient.Get(ctx, desired.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if _, ok := svc.Labels["io.github.kubetnl"]; !ok {
+			return fmt.Errorf("Service %q already exists without the label \"io.github.kubetnl\": add the label to reuse it", svc.Name)
+		}
+		ports := append([]corev1.ServicePort(nil), desired.Spec.Ports...)
+		keepNodePorts(ports, svc.Spec.Ports)
+		svc.Spec.Ports = ports
+		svc.Spec.Selector = desired.Spec.Selector
+		if desired.Spec.Type != "" {
+			svc.Spec.Type = desired.Spec.Type
+		}
+		if o.Protect && !hasFinalizer(svc, ProtectFinalizer) {
+			svc.Finalizers = append(svc.Finalizers, ProtectFinalizer)
+		}
+		reused, err = o.serviceClient.Update(ctx, svc, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.keepService = reused.Annotations[ManagedAnnotation] != "true"
+	klog.V(2).Infof("Reusing existing Service %q (created by kubetnl: %t).", reused.Name, !o.keepService)
+	return reused, nil
+}
+
+func hasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForLoadBalancer watches the Service until the cloud provider assigned
+// an external IP or hostname to its load balancer and prints it. Since this
+// may take minutes or never happen if the cluster has no load balancer
+// implementation, the tunnel does not wait for it. It returns once ctx is
+// done.
+func (o *Tunnel) waitForLoadBalancer(ctx context.Context) {
+	watchOptions := metav1.ListOptions{}
+	watchOptions.FieldSelector = fields.OneTermEqualSelector("metadata.name", o.service.Name).String()
+	watchOptions.ResourceVersion = o.service.GetResourceVersion()
+	lw := &cache.ListWatch{
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = watchOptions.FieldSelector
+			return o.serviceClient.Watch(ctx, options)
+		},
+	}
+	klog.V(2).Infof("Waiting for the load balancer of Service %q...", o.service.Name)
+	event, err := watchtools.Until(ctx, watchOptions.ResourceVersion, lw, func(event watch.Event) (bool, error) {
+		if event.Type == watch.Deleted {
+			return false, fmt.Errorf("Service %q has been deleted", o.service.Name)
+		}
+		svc, ok := event.Object.(*corev1.Service)
+		return ok && len(svc.Status.LoadBalancer.Ingress) > 0, nil
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			klog.Warningf("Error waiting for the load balancer of Service %q: %v", o.service.Name, err)
+		}
+		return
+	}
+	for _, ingress := range event.Object.(*corev1.Service).Status.LoadBalancer.Ingress {
+		addr := ingress.IP
+		if ingress.Hostname != "" {
+			addr = ingress.Hostname
+		}
+		fmt.Fprintf(o.ErrOut, "Load balancer %s\n", addr)
+	}
+}
+
+// waitForEndpoints waits until the Endpoints of the Service of the tunnel have
+// at least one ready address. The endpoints controller populates them only
+// after the Pod became ready, so requests sent right after that may fail.
+func (o *Tunnel) waitForEndpoints(ctx context.Context) error {
+	endpointsClient := o.ClientSet.CoreV1().Endpoints(o.Namespace)
+	waitCtx := ctx
+	if o.PodReadyTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, o.PodReadyTimeout)
+		defer cancel()
+	}
+
+	// The Endpoints may not exist yet, so they are listed to get the
+	// resource version to watch from.
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", o.Name).String()
+	list, err := endpointsClient.List(waitCtx, metav1.ListOptions{FieldSelector: fieldSelector})
+	if err != nil {
+		return fmt.Errorf("error getting Endpoints %q: %v", o.Name, err)
+	}
+	for i := range list.Items {
+		if hasReadyAddress(&list.Items[i]) {
+			return nil
+		}
+	}
+	lw := &cache.ListWatch{
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return endpointsClient.Watch(waitCtx, options)
+		},
+	}
+	klog.V(2).Infof("Waiting for the Endpoints of Service %q...", o.Name)
+	_, err = watchtools.Until(waitCtx, list.ResourceVersion, lw, func(event watch.Event) (bool, error) {
+		endpoints, ok := event.Object.(*corev1.Endpoints)
+		return ok && event.Type != watch.Deleted && hasReadyAddress(endpoints), nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return graceful.Interrupted
+		}
+		if waitCtx.Err() != nil {
+			return fmt.Errorf("error waiting for the Endpoints of Service %q: no ready address after %s", o.Name, o.PodReadyTimeout)
+		}
+		return fmt.Errorf("error waiting for the Endpoints of Service %q: %v", o.Name, err)
+	}
+	klog.V(2).Infof("Service %q has endpoints.", o.Name)
 	return nil
 }
 
+// hasReadyAddress reports whether endpoints has at least one ready address.
+func hasReadyAddress(endpoints *corev1.Endpoints) bool {
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// printNodePorts prints the node ports assigned to the ports of the Service,
+// which clients outside of the cluster connect to.
+func (o *Tunnel) printNodePorts() {
+	for _, p := range o.service.Spec.Ports {
+		if p.NodePort != 0 {
+			fmt.Fprintf(o.ErrOut, "Node port %d/%s --> kube:%d\n", p.NodePort, p.Protocol, p.Port)
+		}
+	}
+}
+
+// ValidateServiceType returns an error if t is not a valid
+// TunnelConfig.ServiceType.
+func ValidateServiceType(t string) error {
+	switch corev1.ServiceType(t) {
+	case "", corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+		return nil
+	}
+	return fmt.Errorf("invalid service type %q: must be \"ClusterIP\", \"NodePort\" or \"LoadBalancer\"", t)
+}
+
+// keepNodePorts sets the node ports of ports to the ones of the matching
+// ports of current, so that clients outside of the cluster can still reach
+// them after the Service is updated.
+func keepNodePorts(ports, current []corev1.ServicePort) {
+	for i := range ports {
+		for _, c := range current {
+			if c.Port == ports[i].Port && c.Protocol == ports[i].Protocol {
+				ports[i].NodePort = c.NodePort
+			}
+		}
+	}
+}
+
 func (o *Tunnel) CleanupService(ctx context.Context) error {
 	deletePolicy := metav1.DeletePropagationForeground
 	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &deletePolicy}
 
 	if o.service != nil {
+		if o.Protect {
+			klog.V(2).Infof("Cleanup: removing finalizer of Service %s ...", o.service.Name)
+			if err := o.removeProtectFinalizer(ctx); err != nil {
+				klog.V(1).Infof("Cleanup: error removing finalizer of Service: %v", err)
+				fmt.Fprintf(o.ErrOut, "Failed to remove the finalizer %q of service %q. Use \"kubetnl cleanup\" to delete any leftover resources created by kubetnl.\n", ProtectFinalizer, o.Name)
+			}
+		}
+		if o.keepService {
+			klog.V(2).Infof("Cleanup: keeping reused Service %s that has not been created by kubetnl.", o.service.Name)
+			return nil
+		}
 		klog.V(2).Infof("Cleanup: deleting Service %s ...", o.service.Name)
 		err := o.serviceClient.Delete(ctx, o.service.Name, deleteOptions)
 		if err != nil {
@@ -68,15 +299,54 @@ func (o *Tunnel) CleanupService(ctx context.Context) error {
 	return nil
 }
 
+// removeProtectFinalizer removes the ProtectFinalizer from the Service.
+func (o *Tunnel) removeProtectFinalizer(ctx context.Context) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		svc, err := o.serviceClient.Get(ctx, o.service.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var finalizers []string
+		for _, f := range svc.Finalizers {
+			if f != ProtectFinalizer {
+				finalizers = append(finalizers, f)
+			}
+		}
+		if len(finalizers) == len(svc.Finalizers) {
+			return nil
+		}
+		svc.Finalizers = finalizers
+		_, err = o.serviceClient.Update(ctx, svc, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// targetPort returns the target port of the service port for m. Named
+// container ports are targeted by their name.
+func targetPort(m port.Mapping) intstr.IntOrString {
+	if m.ContainerPortName != "" {
+		return intstr.FromString(m.ContainerPortName)
+	}
+	return intstr.FromInt(m.ContainerPortNumber)
+}
+
 func servicePorts(mappings []port.Mapping) []corev1.ServicePort {
 	var ports []corev1.ServicePort
-	for i, m := range mappings {
-		ports = append(ports, corev1.ServicePort{
-			Name:       fmt.Sprint(i),
+	for _, m := range mappings {
+		if m.ServiceHidden {
+			continue
+		}
+		sp := corev1.ServicePort{
+			Name:       portName(m),
 			Port:       int32(m.ContainerPortNumber),
-			TargetPort: intstr.FromInt(m.ContainerPortNumber),
+			TargetPort: targetPort(m),
 			Protocol:   protocolToCoreV1(m.Protocol),
-		})
+		}
+		if m.AppProtocol != "" {
+			appProtocol := m.AppProtocol
+			sp.AppProtocol = &appProtocol
+		}
+		ports = append(ports, sp)
 	}
 	return ports
 }
@@ -2,12 +2,18 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
@@ -16,16 +22,120 @@ import (
 	"github.com/pschmitt/kubetnl/pkg/portforward"
 )
 
+// targetCheckTimeout is the timeout for checking whether the target of a port
+// mapping accepts connections when the tunnel starts.
+const targetCheckTimeout = time.Second
+
+// remoteListenAttempts is the number of times listening on a container port
+// is tried before giving up. The first retry happens after
+// remoteListenBackoff, which is doubled for every further one.
+const (
+	remoteListenAttempts = 4
+	remoteListenBackoff  = 500 * time.Millisecond
+)
+
+// ErrHostKeyMismatch is returned by Dial if the SSH server presents another
+// host key than HostKey.
+var ErrHostKeyMismatch = errors.New("ssh: host key mismatch")
+
 type SSHTunnelForwarderWithListener struct {
 	f *portforward.Forwarder
 	l net.Listener
+	m port.Mapping
 }
 
 type SSHTunnel struct {
 	LocalSSHPort          int
 	RemoteSSHPort         int
 	ContinueOnTunnelError bool
-	sshClient             *ssh.Client
+
+	// RequireAllMappings makes RunPortMappings fail if any mapping can
+	// not be forwarded. Otherwise it fails only if none can be forwarded.
+	RequireAllMappings bool
+
+	// TargetDialTimeout is the timeout used when dialing the target of a
+	// port mapping for every incoming connection.
+	TargetDialTimeout time.Duration
+
+	// ForwarderWorkers limits the number of concurrently handled
+	// connections per port mapping. Zero means unlimited.
+	ForwarderWorkers int
+
+	// PrewarmConns is the number of idle connections kept open to the
+	// target of each port mapping.
+	PrewarmConns int
+
+	// MaxBufferPerConn limits the data buffered per forwarded connection
+	// and direction. Zero means no additional buffering.
+	MaxBufferPerConn int
+
+	// DrainTimeout is the time active connections are given to finish
+	// when a port mapping is closed, e.g. on shutdown. Connections that
+	// are still active afterwards are closed forcibly. Zero means to wait
+	// for all connections to finish.
+	DrainTimeout time.Duration
+
+	// ConnectionLogSample is the fraction of connections whose events
+	// are recorded in the connection ledger. Zero records all.
+	ConnectionLogSample float64
+
+	// OnEvent is an optional callback that receives connection related
+	// events of all port mappings.
+	OnEvent func(Event)
+
+	// OnTraffic is an optional callback that is called whenever data is
+	// forwarded by any port mapping, see portforward.Forwarder.OnTraffic.
+	OnTraffic func()
+
+	// Credentials are used to authenticate to the SSH server. Defaults
+	// to DefaultCredentials if empty.
+	Credentials Credentials
+
+	// HostKey is the expected host key of the SSH server. If nil, any
+	// host key is accepted, which allows to intercept the connection.
+	HostKey ssh.PublicKey
+
+	// UDPRelayPorts maps the container ports of UDP mappings to the TCP
+	// ports in the pod the datagrams are relayed to. UDP mappings without
+	// relay port are not forwarded.
+	UDPRelayPorts map[port.Port]int
+
+	// KeepaliveInterval is the interval keepalive requests are sent to
+	// the SSH server at. If a request fails or is not answered within the
+	// interval, the connection is considered dead, see Done. Zero disables
+	// keepalives.
+	KeepaliveInterval time.Duration
+
+	// DialTimeout, if non-zero, is the maximum duration Dial retries to
+	// establish the SSH connection for.
+	DialTimeout time.Duration
+
+	// DialBackoff is the backoff between the attempts of Dial. Its Steps
+	// are the maximum number of attempts. Defaults to
+	// DefaultSSHDialBackoff if Steps is zero.
+	DialBackoff wait.Backoff
+
+	// ConnectTimeout is the maximum duration of a single attempt of Dial,
+	// including the SSH handshake. Defaults to DefaultSSHConnectTimeout if
+	// zero.
+	ConnectTimeout time.Duration
+
+	// RemoteBindAddress is the address in the pod the remote listeners of
+	// TCP mappings are bound to. Defaults to 0.0.0.0 if empty.
+	RemoteBindAddress string
+
+	sshClient *ssh.Client
+	doneCh    chan struct{}
+	stopCh    chan struct{}
+	doneOnce  sync.Once
+	err       error
+
+	// updateMu serializes UpdatePortMappings, which must not hold mu
+	// while it waits for the remote listeners.
+	updateMu sync.Mutex
+	mu       sync.Mutex
+	ctx      context.Context
+	active   map[port.Port]*SSHTunnelForwarderWithListener
 }
 
 func NewSSHTunnel(localSSHPort, remoteSSHPort int, continueOnTunnelError bool) SSHTunnel {
@@ -44,15 +154,33 @@ func (o *SSHTunnel) Dial(ctx context.Context) error {
 	var err error
 
 	// Establish SSH connection over the forwarded port.
-	// Retry establishing the connection in case of failure every second.
+	// Retry establishing the connection in case of failure with an
+	// exponential backoff until the attempts or DialTimeout are exhausted.
 	sshAddr := fmt.Sprintf("localhost:%d", o.LocalSSHPort)
 	klog.V(2).Infof("Establishing SSH connection to %s...", sshAddr)
 
+	backoff := o.DialBackoff
+	if backoff.Steps == 0 {
+		backoff = DefaultSSHDialBackoff
+	}
+	dialCtx := ctx
+	if o.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, o.DialTimeout)
+		defer cancel()
+	}
+	start := time.Now()
 	sshAttempts := 0
-	err = wait.PollImmediateInfinite(time.Second, func() (bool, error) {
+	var lastErr error
+	err = wait.ExponentialBackoffWithContext(dialCtx, backoff, func() (bool, error) {
 		sshAttempts++
 		var err error
-		o.sshClient, err = sshDialContext(ctx, "tcp", sshAddr, o.sshConfig())
+		o.sshClient, err = sshDialContext(dialCtx, "tcp", sshAddr, o.sshConfig())
+		if errors.Is(err, ErrHostKeyMismatch) {
+			// Retrying does not help, the port-forward leads to
+			// another SSH server than expected.
+			return false, err
+		}
 		if err != nil {
 			// HACK: net.DialContext does neither return nor wraps
 			// the context.Canceled error. Checking if the error
@@ -61,6 +189,9 @@ func (o *SSHTunnel) Dial(ctx context.Context) error {
 			if ctx.Err() != nil {
 				return false, ctx.Err()
 			}
+			if dialCtx.Err() == nil {
+				lastErr = err
+			}
 			if sshAttempts > 3 {
 				klog.V(2).Infof("Failed to dial ssh %q: %v. Retrying...", sshAddr, err)
 			}
@@ -70,19 +201,128 @@ func (o *SSHTunnel) Dial(ctx context.Context) error {
 	})
 
 	if err != nil {
-		if err == ctx.Err() {
+		if ctx.Err() != nil {
 			klog.V(2).Info("Interrupted while establishing SSH connection")
 			return graceful.Interrupted
 		}
-		// Should not happen since we retry on all errors except for
-		// the ctx.Err().
-		return fmt.Errorf("error dialing ssh: %v", err)
+		if err == wait.ErrWaitTimeout || err == dialCtx.Err() {
+			return fmt.Errorf("error dialing ssh %q: giving up after %d attempt(s) within %s: %v", sshAddr, sshAttempts, time.Since(start).Round(10*time.Millisecond), lastErr)
+		}
+		return fmt.Errorf("error dialing ssh: %w", err)
 	}
 
+	o.doneCh = make(chan struct{})
+	o.stopCh = make(chan struct{})
+	if o.KeepaliveInterval > 0 {
+		go o.keepalive(ctx)
+	}
 	return nil
 }
 
+// Done returns a channel that is closed when the SSH connection is considered
+// dead because a keepalive request failed. Err returns the reason afterwards.
+// The channel is not closed by Close.
+func (o *SSHTunnel) Done() <-chan struct{} {
+	return o.doneCh
+}
+
+// Err returns the reason the SSH connection is considered dead once Done is
+// closed.
+func (o *SSHTunnel) Err() error {
+	select {
+	case <-o.doneCh:
+		return o.err
+	default:
+		return nil
+	}
+}
+
+// keepalive sends a keepalive request every KeepaliveInterval until ctx is
+// done, the tunnel is closed or a request fails or times out.
+func (o *SSHTunnel) keepalive(ctx context.Context) {
+	ticker := time.NewTicker(o.KeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			// The server may reject the request. Any reply shows
+			// that the connection is alive.
+			_, _, err := o.sshClient.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		var err error
+		select {
+		case err = <-replied:
+		case <-time.After(o.KeepaliveInterval):
+			err = fmt.Errorf("no reply to keepalive request within %s", o.KeepaliveInterval)
+		case <-o.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			klog.V(1).Infof("SSH keepalive to %s failed: %v", o, err)
+			o.lost(err)
+			return
+		}
+	}
+}
+
+// lost marks the SSH connection as dead because of err, see Done.
+func (o *SSHTunnel) lost(err error) {
+	o.doneOnce.Do(func() {
+		o.err = fmt.Errorf("SSH connection lost: %v", err)
+		close(o.doneCh)
+	})
+}
+
+// SSHStatus describes the state of the SSH connection of a tunnel.
+type SSHStatus struct {
+	LocalSSHPort  int    `json:"localSSHPort"`
+	RemoteSSHPort int    `json:"remoteSSHPort"`
+	Connected     bool   `json:"connected"`
+	ServerVersion string `json:"serverVersion,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Status returns the state of the SSH connection. The connection is checked
+// by sending a keepalive request to the server.
+func (o *SSHTunnel) Status() SSHStatus {
+	s := SSHStatus{
+		LocalSSHPort:  o.LocalSSHPort,
+		RemoteSSHPort: o.RemoteSSHPort,
+	}
+	if o.sshClient == nil {
+		s.Error = "not connected"
+		return s
+	}
+	s.ServerVersion = string(o.sshClient.ServerVersion())
+	if _, _, err := o.sshClient.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Connected = true
+	return s
+}
+
 func (o *SSHTunnel) Close() error {
+	if o.stopCh != nil {
+		o.mu.Lock()
+		select {
+		case <-o.stopCh:
+		default:
+			close(o.stopCh)
+		}
+		o.mu.Unlock()
+	}
 	if o.sshClient != nil {
 		return o.sshClient.Close()
 	}
@@ -95,30 +335,58 @@ func (o *SSHTunnel) RunPortMappings(ctx context.Context, portMappings []port.Map
 
 	for _, m := range portMappings {
 		// TODO: Check for interrupt and ctx.Done in every iteration.
-		// TODO Support remote ips: Note that it does not work without the 0.0.0.0 here.
-		target := m.TargetAddress()
-		remote := fmt.Sprintf("0.0.0.0:%d", m.ContainerPortNumber)
-		l, err := o.sshClient.Listen("tcp", remote)
+		p, err := o.listen(ctx, m)
 		if err != nil {
 			if !o.ContinueOnTunnelError {
 				// Close all created listeners.
 				for _, p := range pairs {
 					p.l.Close()
 				}
-				klog.V(2).Infof("Failed to tunnel from kube:%d --> %s", m.ContainerPortNumber, target)
-				return fmt.Errorf("failed to listen on remote %s: %v", remote, err)
+				klog.V(2).Infof("Failed to tunnel from kube:%d --> %s", m.ContainerPortNumber, m.TargetAddress())
+				return err
 			}
-			klog.Errorf("failed to listen on remote %s: %v. No tunnel created.", remote, err)
+			klog.Errorf("%v. No tunnel created.", err)
+			o.emit(Event{
+				Type:          EventError,
+				ContainerPort: m.ContainerPortNumber,
+				Target:        m.TargetAddress(),
+				Error:         err.Error(),
+			})
+			continue
+		}
+		if p == nil {
+			continue
 		}
+		pairs = append(pairs, *p)
+	}
 
-		pairs = append(pairs,
-			SSHTunnelForwarderWithListener{
-				f: &portforward.Forwarder{TargetAddr: target},
-				l: l,
-			})
-		klog.V(2).Infof("Tunneling from kube:%d --> %s", m.ContainerPortNumber, target)
+	// Do not report the tunnel as running if it does not forward
+	// anything or less than required.
+	var missing error
+	switch {
+	case len(pairs) == 0 && len(portMappings) > 0:
+		missing = fmt.Errorf("none of the %d port mappings can be forwarded", len(portMappings))
+	case o.RequireAllMappings && len(pairs) < len(portMappings):
+		missing = fmt.Errorf("only %d of %d port mappings can be forwarded", len(pairs), len(portMappings))
+	}
+	if missing != nil {
+		for _, p := range pairs {
+			p.l.Close()
+		}
+		return missing
+	}
+	if len(pairs) < len(portMappings) {
+		klog.Warningf("Forwarding only %d of %d port mappings.", len(pairs), len(portMappings))
 	}
 
+	o.mu.Lock()
+	o.ctx = ctx
+	o.active = make(map[port.Port]*SSHTunnelForwarderWithListener)
+	for i := range pairs {
+		o.active[pairs[i].m.ContainerPort()] = &pairs[i]
+	}
+	o.mu.Unlock()
+
 	// Open tunnels.
 	klog.V(2).Infof("Opening group of tunnels...")
 	g, tctx := errgroup.WithContext(ctx)
@@ -133,9 +401,7 @@ func (o *SSHTunnel) RunPortMappings(ctx context.Context, portMappings []port.Map
 
 	closeAll := func() {
 		klog.V(2).Infof("Closing all the tunnels...")
-		for _, p := range pairs {
-			p.f.Close()
-		}
+		o.ClosePortMappings()
 		g.Wait()
 	}
 
@@ -157,17 +423,296 @@ func (o *SSHTunnel) RunPortMappings(ctx context.Context, portMappings []port.Map
 	return nil
 }
 
-func (o *SSHTunnel) sshConfig() *ssh.ClientConfig {
-	return &ssh.ClientConfig{
-		User: "user",
-		Auth: []ssh.AuthMethod{
-			ssh.Password("password"),
+// ActiveConns returns the number of connections currently forwarded by
+// the port mappings of the tunnel.
+func (o *SSHTunnel) ActiveConns() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, a := range o.active {
+		n += a.f.ActiveConns()
+	}
+	return n
+}
+
+// ClosePortMappings stops the port mappings from accepting new connections.
+// Active connections are closed forcibly after DrainTimeout, if set. It does
+// not wait for them, see ActiveConns.
+func (o *SSHTunnel) ClosePortMappings() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, a := range o.active {
+		o.closeForwarder(a)
+	}
+}
+
+// closeForwarder stops a from accepting new connections. Active
+// connections are closed forcibly after o.DrainTimeout, if set.
+//
+// The remote listener is closed before closeForwarder returns, so the port
+// can be listened on again right away. Only the active connections are
+// drained in the background.
+func (o *SSHTunnel) closeForwarder(a *SSHTunnelForwarderWithListener) {
+	a.f.Close()
+	if o.DrainTimeout > 0 {
+		go a.f.Drain(o.DrainTimeout)
+	}
+}
+
+// listenRemote listens on host:containerPort in the pod. The SSH server only
+// reports that the request was denied, which usually means that the port is
+// still bound, e.g. by a connection of a previous tunnel in a reused pod
+// that has not been torn down yet. Thus the request is retried a few times
+// with backoff before giving up.
+func (o *SSHTunnel) listenRemote(ctx context.Context, host string, containerPort int) (net.Listener, error) {
+	remote := net.JoinHostPort(host, strconv.Itoa(containerPort))
+	backoff := remoteListenBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var l net.Listener
+		l, err = o.sshClient.Listen("tcp", remote)
+		if err == nil {
+			return l, nil
+		}
+		if attempt == remoteListenAttempts {
+			break
+		}
+		klog.V(2).Infof("Failed to listen on remote %s (attempt %d/%d): %v. Retrying in %v...", remote, attempt, remoteListenAttempts, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to listen on remote %s: %v", remote, err)
+		}
+		backoff *= 2
+	}
+	if strings.Contains(err.Error(), "request denied by peer") {
+		return nil, fmt.Errorf("failed to listen on remote %s: the SSH server denied the request, port %d is probably already in use in the pod. Use a different service port or, if you use --existing-pod or a prewarmed pod, make sure no other process or tunnel is bound to it", remote, containerPort)
+	}
+	return nil, fmt.Errorf("failed to listen on remote %s: %v", remote, err)
+}
+
+// listen opens the remote listener for m and creates its forwarder. It
+// returns nil if m can not be forwarded over SSH.
+func (o *SSHTunnel) listen(ctx context.Context, m port.Mapping) (*SSHTunnelForwarderWithListener, error) {
+	// The SSH server binds to all interfaces for an empty address
+	// only with "GatewayPorts yes", so 0.0.0.0 is requested explicitly.
+	target := m.TargetAddress()
+	host, listenPort, network := "0.0.0.0", m.ContainerPortNumber, m.TargetNetwork()
+	if o.RemoteBindAddress != "" {
+		host = o.RemoteBindAddress
+	}
+	if relay, ok := o.UDPRelayPorts[m.ContainerPort()]; ok && m.Protocol == port.ProtocolUDP {
+		// The datagrams are relayed to a TCP port on the loopback
+		// interface of the pod, see udpRelayPorts.
+		host, listenPort, network = "127.0.0.1", relay, "udp"
+	} else if m.Protocol != port.ProtocolTCP {
+		// The service and container ports are created, but
+		// only TCP connections can be forwarded over SSH.
+		klog.Warningf("Not tunneling kube:%s --> %s: only TCP and UDP are supported for forwarding.", m.ContainerPort(), target)
+		o.emit(Event{
+			Type:          EventError,
+			ContainerPort: m.ContainerPortNumber,
+			Target:        target,
+			Error:         fmt.Sprintf("protocol %s is not supported for forwarding", m.Protocol),
+		})
+		return nil, nil
+	}
+	l, err := o.listenRemote(ctx, host, listenPort)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("Tunneling from kube:%s --> %s", m.ContainerPort(), target)
+
+	// Warn early about targets that are not reachable. This is not
+	// an error since the target may just not be started yet. UDP
+	// targets can not be checked without sending a datagram.
+	if network != "udp" {
+		if err := portforward.CheckTarget(network, target, targetCheckTimeout); err != nil {
+			klog.Warningf("Target %s of kube:%d does not accept connections: %v", target, m.ContainerPortNumber, err)
+		}
+	}
+
+	return &SSHTunnelForwarderWithListener{
+		f: &portforward.Forwarder{
+			TargetAddr:       target,
+			TargetNetwork:    network,
+			DialTimeout:      o.TargetDialTimeout,
+			Workers:          o.ForwarderWorkers,
+			MaxBufferPerConn: o.MaxBufferPerConn,
+			PrewarmConns:     o.PrewarmConns,
+			RewriteHost:      m.RewriteHost,
+			Allow:            m.AllowCIDRs,
+			Deny:             m.DenyCIDRs,
+			ConnState:        o.connStateHook(m),
+			OnTraffic:        o.OnTraffic,
+			SampleRate:       o.ConnectionLogSample,
 		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// Accept all keys.
+		l: l,
+		m: m,
+	}, nil
+}
+
+// UpdatePortMappings changes the running port mappings to portMappings.
+// Mappings that are no longer present are closed, mappings that are new or
+// changed are started. It must be called after RunPortMappings.
+//
+// Mappings that fail to start are skipped and reported in the returned error,
+// all other changes are still applied.
+func (o *SSHTunnel) UpdatePortMappings(portMappings []port.Mapping) error {
+	o.updateMu.Lock()
+	defer o.updateMu.Unlock()
+	o.mu.Lock()
+	if o.active == nil {
+		o.mu.Unlock()
+		return fmt.Errorf("port mappings not running")
+	}
+	if o.ctx.Err() != nil {
+		o.mu.Unlock()
+		return graceful.Interrupted
+	}
+
+	wanted := make(map[port.Port]port.Mapping)
+	for _, m := range portMappings {
+		wanted[m.ContainerPort()] = m
+	}
+
+	for p, a := range o.active {
+		if m, ok := wanted[p]; ok && mappingKey(m) == mappingKey(a.m) {
+			continue
+		}
+		klog.V(2).Infof("Closing tunnel kube:%s --> %s...", p, a.m.TargetAddress())
+		o.closeForwarder(a)
+		delete(o.active, p)
+	}
+	var added []port.Mapping
+	for p, m := range wanted {
+		if _, ok := o.active[p]; !ok {
+			added = append(added, m)
+		}
+	}
+	ctx := o.ctx
+	o.mu.Unlock()
+
+	// listen retries with backoff, so o.mu is not held while the new
+	// mappings are started.
+	var errs []error
+	for _, m := range added {
+		pair, err := o.listen(ctx, m)
+		if err != nil {
+			errs = append(errs, err)
+			o.emit(Event{
+				Type:          EventError,
+				ContainerPort: m.ContainerPortNumber,
+				Target:        m.TargetAddress(),
+				Error:         err.Error(),
+			})
+			continue
+		}
+		if pair == nil {
+			continue
+		}
+		o.mu.Lock()
+		if ctx.Err() != nil {
+			// The port mappings were closed meanwhile, the
+			// forwarder was not opened yet.
+			o.mu.Unlock()
+			pair.l.Close()
+			return graceful.Interrupted
+		}
+		o.active[m.ContainerPort()] = pair
+		o.mu.Unlock()
+		go func() {
+			if err := pair.f.Open(pair.l); err != nil {
+				klog.Errorf("Tunnel ->%s closed: %v", pair.f, err)
+			}
+		}()
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ActiveMappings returns the port mappings that are currently forwarded,
+// ordered by container port.
+func (o *SSHTunnel) ActiveMappings() []port.Mapping {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var mm []port.Mapping
+	for _, a := range o.active {
+		mm = append(mm, a.m)
+	}
+	sort.Slice(mm, func(i, j int) bool {
+		if mm[i].ContainerPortNumber != mm[j].ContainerPortNumber {
+			return mm[i].ContainerPortNumber < mm[j].ContainerPortNumber
+		}
+		return mm[i].Protocol < mm[j].Protocol
+	})
+	return mm
+}
+
+// mappingKey returns a string that differs for mappings that need to be
+// forwarded differently.
+func mappingKey(m port.Mapping) string {
+	return fmt.Sprintf("%s %s %v %v", m.ContainerPort(), m.TargetAddress(), m.AllowCIDRs, m.DenyCIDRs)
+}
+
+// connStateHook returns a portforward.Forwarder.ConnState hook that emits
+// connection events for the port mapping m.
+func (o *SSHTunnel) connStateHook(m port.Mapping) func(net.Conn, portforward.ConnState, portforward.ConnInfo) {
+	return func(conn net.Conn, state portforward.ConnState, info portforward.ConnInfo) {
+		e := Event{
+			ContainerPort: m.ContainerPortNumber,
+			Target:        m.TargetAddress(),
+			RemoteAddr:    conn.RemoteAddr().String(),
+			Error:         errString(info.Err),
+			sampled:       info.Sampled,
+		}
+		switch state {
+		case portforward.StateNew:
+			e.Type = EventConnectionOpened
+		case portforward.StateClosed:
+			e.Type = EventConnectionClosed
+			e.BytesSent = info.BytesSent
+			e.BytesReceived = info.BytesReceived
+			e.Duration = time.Since(info.Opened).Seconds()
+		case portforward.StateRejected:
+			e.Type = EventConnectionRejected
+		}
+		o.emit(e)
+	}
+}
+
+func (o *SSHTunnel) emit(e Event) {
+	if o.OnEvent != nil {
+		o.OnEvent(e)
+	}
+}
+
+func (o *SSHTunnel) sshConfig() *ssh.ClientConfig {
+	creds := o.Credentials
+	if creds.User == "" {
+		creds = Credentials(DefaultCredentials)
+	}
+	config := &ssh.ClientConfig{
+		User:            creds.User,
+		Auth:            creds.authMethods(),
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         o.ConnectTimeout,
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultSSHConnectTimeout
+	}
+	if o.HostKey != nil {
+		fixed := ssh.FixedHostKey(o.HostKey)
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := fixed(hostname, remote, key); err != nil {
+				return ErrHostKeyMismatch
+			}
 			return nil
-		},
+		}
+		// Make the server present the pinned key, not one of its other
+		// host keys.
+		config.HostKeyAlgorithms = []string{o.HostKey.Type()}
 	}
+	return config
 }
 
 func sshDialContext(ctx context.Context, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
@@ -176,9 +721,28 @@ func sshDialContext(ctx context.Context, network, addr string, config *ssh.Clien
 	if err != nil {
 		return nil, err
 	}
-	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	// config.Timeout only applies to the TCP connection. Bound the
+	// handshake as well, which hangs if the port-forward accepts the
+	// connection but the SSH server does not answer.
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	// The handshake error of ssh.NewClientConn does not wrap the error of
+	// the HostKeyCallback, so it is kept to be returned instead.
+	var hostKeyErr error
+	cfg := *config
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyErr = config.HostKeyCallback(hostname, remote, key)
+		return hostKeyErr
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &cfg)
 	if err != nil {
+		conn.Close()
+		if hostKeyErr != nil {
+			return nil, fmt.Errorf("ssh: handshake failed: %w", hostKeyErr)
+		}
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 	return ssh.NewClient(c, chans, reqs), nil
 }
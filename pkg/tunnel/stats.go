@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the connection statistics of a tunnel.
+type Stats struct {
+	// Since is the time the tunnel was started. The counters in Mappings
+	// are cumulative since then, including all reconnects.
+	Since time.Time
+
+	// Mappings holds the counters for each port mapping, ordered by
+	// container port.
+	Mappings []MappingStats
+
+	// Session holds the counters of the current SSH session only. They
+	// are reset whenever the SSH connection is (re-)established.
+	Session SessionStats
+}
+
+// MappingStats are the cumulative connection statistics of a port mapping.
+type MappingStats struct {
+	ContainerPort int
+	Target        string
+
+	// Connections is the number of connections accepted and Rejected the
+	// number of connections rejected by the source address filters.
+	Connections int64
+	Rejected    int64
+
+	// Active is the number of currently open connections.
+	Active int64
+
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// SessionStats are the connection statistics of a single SSH session.
+type SessionStats struct {
+	Since         time.Time
+	Connections   int64
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// statsRecorder records Stats from connection events. It lives on the Tunnel
+// so that counters survive re-dialing the SSH connection.
+type statsRecorder struct {
+	// lastTraffic is the time in Unix nanoseconds data was last
+	// forwarded, see traffic. It is accessed atomically and comes first
+	// to be 64-bit aligned.
+	lastTraffic int64
+
+	mu       sync.Mutex
+	since    time.Time
+	mappings map[int]*MappingStats
+	session  SessionStats
+
+	// lastActivity is the time a connection was last opened or closed.
+	lastActivity time.Time
+}
+
+func newStatsRecorder() *statsRecorder {
+	now := time.Now()
+	return &statsRecorder{
+		since:        now,
+		mappings:     make(map[int]*MappingStats),
+		session:      SessionStats{Since: now},
+		lastActivity: now,
+	}
+}
+
+// newSession resets the session counters.
+func (r *statsRecorder) newSession() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.session = SessionStats{Since: time.Now()}
+}
+
+// record updates the counters from a connection event. Other events are
+// ignored.
+func (r *statsRecorder) record(e Event) {
+	switch e.Type {
+	case EventConnectionOpened, EventConnectionClosed, EventConnectionRejected:
+	default:
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.mappings[e.ContainerPort]
+	if !ok {
+		m = &MappingStats{ContainerPort: e.ContainerPort, Target: e.Target}
+		r.mappings[e.ContainerPort] = m
+	}
+
+	switch e.Type {
+	case EventConnectionOpened:
+		m.Connections++
+		m.Active++
+		r.session.Connections++
+		r.lastActivity = time.Now()
+	case EventConnectionClosed:
+		m.Active--
+		r.lastActivity = time.Now()
+		m.BytesSent += e.BytesSent
+		m.BytesReceived += e.BytesReceived
+		r.session.BytesSent += e.BytesSent
+		r.session.BytesReceived += e.BytesReceived
+	case EventConnectionRejected:
+		m.Rejected++
+	}
+}
+
+// traffic records that data has been forwarded. It is called for every read
+// of a forwarded connection and thus does not lock r.
+func (r *statsRecorder) traffic() {
+	atomic.StoreInt64(&r.lastTraffic, time.Now().UnixNano())
+}
+
+// idleSince returns the time since which no data has been forwarded and no
+// connection has been opened or closed.
+func (r *statsRecorder) idleSince() time.Time {
+	r.mu.Lock()
+	since := r.lastActivity
+	r.mu.Unlock()
+	if last := time.Unix(0, atomic.LoadInt64(&r.lastTraffic)); last.After(since) {
+		return last
+	}
+	return since
+}
+
+func (r *statsRecorder) snapshot() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := Stats{Since: r.since, Session: r.session}
+	for _, m := range r.mappings {
+		s.Mappings = append(s.Mappings, *m)
+	}
+	sort.Slice(s.Mappings, func(i, j int) bool {
+		return s.Mappings[i].ContainerPort < s.Mappings[j].ContainerPort
+	})
+	return s
+}
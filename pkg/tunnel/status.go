@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// StatusCheck is the result of a single check of the cluster side state of a
+// tunnel.
+type StatusCheck struct {
+	Name   string
+	OK     bool
+	Reason string
+}
+
+// TunnelStatus describes the health of a tunnel as seen from the cluster.
+type TunnelStatus struct {
+	Checks []StatusCheck
+
+	// Ports are the ports of the Service of the tunnel and
+	// ContainerPorts the ports of its Pod, excluding the SSH port.
+	Ports          []corev1.ServicePort
+	ContainerPorts []corev1.ContainerPort
+}
+
+// Healthy reports whether all checks succeeded.
+func (s *TunnelStatus) Healthy() bool {
+	for _, c := range s.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *TunnelStatus) add(name string, ok bool, format string, args ...interface{}) {
+	s.Checks = append(s.Checks, StatusCheck{Name: name, OK: ok, Reason: fmt.Sprintf(format, args...)})
+}
+
+// GetTunnelStatus checks the Service, Pod and endpoints of the tunnel name in
+// namespace. Failed checks are reported in the returned status, an error is
+// only returned if the resources can not be read. The SSH connection of a
+// running kubetnl can not be checked from the cluster.
+func GetTunnelStatus(ctx context.Context, cs kubernetes.Interface, namespace, name string) (*TunnelStatus, error) {
+	status := &TunnelStatus{}
+
+	svc, err := cs.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		status.add("service", false, "Service %q not found", name)
+		svc = nil
+	case err != nil:
+		return nil, fmt.Errorf("error getting Service %q: %v", name, err)
+	case svc.Labels["io.github.kubetnl"] != name:
+		status.add("service", false, "Service %q has not been created by kubetnl", name)
+		svc = nil
+	default:
+		status.Ports = svc.Spec.Ports
+		status.add("service", true, "%s %s", svc.Spec.Type, svc.Spec.ClusterIP)
+	}
+
+	// The Pod of a tunnel that adopted a prewarmed pod has a different
+	// name, but it is labeled like the Service.
+	pods, err := cs.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: "io.github.kubetnl=" + name})
+	if err != nil {
+		return nil, fmt.Errorf("error listing the Pods of tunnel %q: %v", name, err)
+	}
+	switch len(pods.Items) {
+	case 0:
+		status.add("pod", false, "no Pod found")
+	case 1:
+		pod := &pods.Items[0]
+		for _, p := range pod.Spec.Containers[0].Ports {
+			if p.Name != "ssh" {
+				status.ContainerPorts = append(status.ContainerPorts, p)
+			}
+		}
+		if isPodReady(pod) {
+			status.add("pod", true, "Pod %q is ready on node %q%s", pod.Name, pod.Spec.NodeName, podRestarts(pod))
+		} else {
+			status.add("pod", false, "Pod %q is not ready: %s%s", pod.Name, podNotReadyReason(pod), podRestarts(pod))
+		}
+	default:
+		status.add("pod", false, "found %d Pods, expected one", len(pods.Items))
+	}
+
+	if svc == nil {
+		return status, nil
+	}
+	endpoints, err := cs.CoreV1().Endpoints(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("error getting Endpoints %q: %v", name, err)
+	}
+	ready, notReady := 0, 0
+	if err == nil {
+		for _, subset := range endpoints.Subsets {
+			ready += len(subset.Addresses)
+			notReady += len(subset.NotReadyAddresses)
+		}
+	}
+	switch {
+	case ready > 0:
+		status.add("endpoints", true, "%d ready address(es)", ready)
+	case notReady > 0:
+		status.add("endpoints", false, "%d address(es), none of them ready", notReady)
+	default:
+		status.add("endpoints", false, "no addresses: the Service does not select a running Pod")
+	}
+	return status, nil
+}
+
+// podNotReadyReason explains why pod is not ready.
+func podNotReadyReason(pod *corev1.Pod) string {
+	if pod.DeletionTimestamp != nil {
+		return "it is being deleted"
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse {
+			return fmt.Sprintf("not scheduled: %s", cond.Message)
+		}
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != sshContainer(pod) {
+			continue
+		}
+		if w := cs.State.Waiting; w != nil {
+			return strings.TrimSuffix(fmt.Sprintf("container waiting: %s: %s", w.Reason, w.Message), ": ")
+		}
+		if t := cs.State.Terminated; t != nil {
+			return fmt.Sprintf("container terminated: %s (exit code %d)", t.Reason, t.ExitCode)
+		}
+		if !cs.Ready {
+			return "the SSH server does not accept connections"
+		}
+	}
+	return fmt.Sprintf("phase %s", pod.Status.Phase)
+}
+
+// podRestarts returns a note about the restarts of the tunnel container of
+// pod, if any.
+func podRestarts(pod *corev1.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == sshContainer(pod) && cs.RestartCount > 0 {
+			return fmt.Sprintf(" (restarted %d times)", cs.RestartCount)
+		}
+	}
+	return ""
+}
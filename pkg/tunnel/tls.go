@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/pschmitt/kubetnl/pkg/port"
+)
+
+// tlsVerifyTimeout is the timeout for the TLS handshake of VerifyTLS.
+const tlsVerifyTimeout = 10 * time.Second
+
+var tlsVersionName = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// TLSReport is the result of a TLS handshake through a tunnel.
+type TLSReport struct {
+	Version     string
+	CipherSuite string
+	Subject     string
+	Issuer      string
+	NotAfter    time.Time
+}
+
+func (r TLSReport) String() string {
+	return fmt.Sprintf("%s (%s), subject %q, issuer %q, valid until %s", r.Version, r.CipherSuite, r.Subject, r.Issuer, r.NotAfter.Format(time.RFC3339))
+}
+
+// VerifyTLS performs a TLS handshake with the target of m through the tunnel.
+// The connection is opened from within the tunnel pod to the container port
+// of m, so it takes the same path as connections from within the cluster.
+//
+// The certificate of the target is not verified, since the purpose is to
+// check that TLS passes through the tunnel untouched.
+func (o *SSHTunnel) VerifyTLS(ctx context.Context, m port.Mapping) (TLSReport, error) {
+	if o.sshClient == nil {
+		return TLSReport{}, fmt.Errorf("SSH connection not established")
+	}
+	conn, err := o.sshClient.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", m.ContainerPortNumber))
+	if err != nil {
+		return TLSReport{}, fmt.Errorf("error connecting to kube:%d: %v", m.ContainerPortNumber, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, tlsVerifyTimeout)
+	defer cancel()
+	go func() {
+		// Unblock the handshake when ctx is done.
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         m.TargetIP,
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return TLSReport{}, fmt.Errorf("TLS handshake with %s through kube:%d failed: %v", m.TargetAddress(), m.ContainerPortNumber, err)
+	}
+
+	state := tlsConn.ConnectionState()
+	r := TLSReport{
+		Version:     tlsVersionName[state.Version],
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		r.Subject = cert.Subject.String()
+		r.Issuer = cert.Issuer.String()
+		r.NotAfter = cert.NotAfter
+	}
+	return r, nil
+}
+
+// verifyTLSTargets performs a TLS handshake with the targets of all TCP port
+// mappings through the tunnel and reports the results. Failures are reported
+// but do not stop the tunnel.
+func (o *Tunnel) verifyTLSTargets(ctx context.Context) {
+	for _, m := range o.PortMappings {
+		if m.Protocol != port.ProtocolTCP {
+			continue
+		}
+		r, err := o.currentSSHTunnel().VerifyTLS(ctx, m)
+		if err != nil {
+			fmt.Fprintf(o.ErrOut, "Warning: %v\n", err)
+			o.emit(Event{
+				Type:          EventError,
+				ContainerPort: m.ContainerPortNumber,
+				Target:        m.TargetAddress(),
+				Error:         err.Error(),
+			})
+			continue
+		}
+		fmt.Fprintf(o.ErrOut, "TLS through kube:%d --> %s: %s\n", m.ContainerPortNumber, m.TargetAddress(), r)
+	}
+}
@@ -2,18 +2,33 @@ package tunnel
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 
+	"github.com/pschmitt/kubetnl/pkg/graceful"
 	"github.com/pschmitt/kubetnl/pkg/port"
 	"github.com/pschmitt/kubetnl/pkg/portforward"
 )
 
+// drainPollInterval is the interval the active connections are checked at
+// while draining them on shutdown.
+const drainPollInterval = 100 * time.Millisecond
+
 type TunnelConfig struct {
 	genericclioptions.IOStreams
 
@@ -24,6 +39,246 @@ type TunnelConfig struct {
 	// Name of the tunnel. This will also be the name of the pod and service.
 	Name string
 
+	// ImagePullSecrets are the names of Secrets in the namespace used to
+	// pull Image, e.g. from a private registry mirroring the server image.
+	ImagePullSecrets []string
+
+	// ImagePullTimeout, if non-zero, is the maximum duration the pod may
+	// wait for its image to be pulled before creating the tunnel fails.
+	ImagePullTimeout time.Duration
+
+	// PodReadyTimeout, if non-zero, is the maximum duration to wait for
+	// the pod to become ready. If it is exceeded, the error reports the
+	// scheduling events of the pod, e.g. for nodes with taints the pod
+	// does not tolerate.
+	PodReadyTimeout time.Duration
+
+	// SetupTimeout, if non-zero, is the maximum duration Run may take to
+	// make the tunnel ready, from creating the resources to establishing
+	// the SSH connection. If it is exceeded, Run fails and the resources
+	// created so far are deleted by Stop.
+	SetupTimeout time.Duration
+
+	// IdleTimeout, if non-zero, ends the tunnel once no data has been
+	// forwarded and no connection has been opened or closed for this
+	// duration, see Done. Err then returns an error wrapping ErrIdle. Open
+	// connections without traffic, e.g. a forgotten shell, do not keep
+	// the tunnel alive.
+	IdleTimeout time.Duration
+
+	// PodMaxLifetime, if non-zero, is set as activeDeadlineSeconds of the
+	// pod, so that Kubernetes terminates it after this duration even if
+	// kubetnl keeps running, e.g. for time-boxed access from CI. The
+	// tunnel ends once the pod is terminated, see Done.
+	PodMaxLifetime time.Duration
+
+	// SSHMaxSessions and SSHMaxStartups, if set, override the MaxSessions
+	// and MaxStartups settings of the SSH server in the pod. Raise them
+	// for tunnels with a high rate of new connections. See sshd_config(5)
+	// for the format of MaxStartups.
+	SSHMaxSessions int
+	SSHMaxStartups string
+
+	// ProbeInitialDelay, ProbePeriod and ProbeFailureThreshold configure
+	// the readiness and liveness probes on the SSH port of the pod. The
+	// liveness probe restarts the container if the SSH server hangs. Raise
+	// ProbeInitialDelay for images that take longer to start the SSH
+	// server. See DefaultProbeInitialDelay for the defaults of the command
+	// line.
+	ProbeInitialDelay     time.Duration
+	ProbePeriod           time.Duration
+	ProbeFailureThreshold int32
+
+	// StartupProbe adds a startup probe on the SSH port to the pod. Use
+	// it for images that take a long time to start the SSH server.
+	StartupProbe bool
+
+	// StartupProbeFailureThreshold is the number of failed startup probes,
+	// executed every 5 seconds, after which the container is restarted.
+	StartupProbeFailureThreshold int32
+
+	// HostNetwork runs the pod in the network namespace of the node it is
+	// scheduled on. This allows to tunnel to targets that are only
+	// reachable from the node, e.g. services bound to the node's loopback
+	// interface. Note that the SSH port and all container ports are then
+	// opened on the node itself: the pod can not be scheduled on nodes
+	// where another hostNetwork pod uses one of these ports, and the
+	// readiness probe may succeed wrongly if another process on the node
+	// already listens on the SSH port.
+	HostNetwork bool
+
+	// NodeSelector restricts the nodes the pod is scheduled on to the
+	// ones with all of these labels, e.g. to nodes that can reach the
+	// targets of the tunnel.
+	NodeSelector map[string]string
+
+	// NodeName, if set, places the pod on this node directly, bypassing
+	// the scheduler. If the node does not exist or can not run the pod,
+	// the pod never becomes ready.
+	NodeName string
+
+	// Tolerations allow the pod to be scheduled on nodes with matching
+	// taints.
+	Tolerations []corev1.Toleration
+
+	// SeccompProfile, if set, is the seccomp profile of the pod and its
+	// container: "RuntimeDefault", "Unconfined" or "localhost/<path>" for
+	// a profile on the node, relative to the kubelet's seccomp profile
+	// directory. The PodSecurity "restricted" level requires
+	// "RuntimeDefault" or a localhost profile.
+	SeccompProfile string
+
+	// ServiceAccount, if set, is the name of an existing ServiceAccount
+	// the tunnel pod runs as, e.g. if creating ServiceAccounts is not
+	// permitted. Otherwise a ServiceAccount is created for the tunnel.
+	ServiceAccount string
+
+	// NoInitScript, if set, omits the ConfigMap with the init script of
+	// the SSH server, which is specific to the linuxserver.io based
+	// default image, for images that configure their SSH server
+	// themselves. Since the ConfigMap also holds the authorized keys and
+	// the UDP relay, it requires password authentication and TCP port
+	// mappings.
+	NoInitScript bool
+
+	// PodSecurityContext and SecurityContext, if set, are the security
+	// contexts of the tunnel pod and its container. The seccomp profile
+	// is set with SeccompProfile instead. See DefaultSecurityContext and
+	// NonRootSecurityContexts.
+	PodSecurityContext *corev1.PodSecurityContext
+	SecurityContext    *corev1.SecurityContext
+
+	// PodResources are the resource requests and limits of the container
+	// of the tunnel pod. See DefaultPodResources.
+	PodResources corev1.ResourceRequirements
+
+	// ContainerName is the name of the container of the tunnel pod.
+	// Defaults to "main".
+	ContainerName string
+
+	// ExtraEnv are additional environment variables of the container of
+	// the tunnel pod, e.g. for debugging the server image. They are
+	// applied after the variables set by kubetnl and replace variables of
+	// the same name.
+	ExtraEnv []corev1.EnvVar
+
+	// InternalTrafficPolicy, if set, is the internalTrafficPolicy of the
+	// Service, either "Cluster" or "Local". With "Local" traffic from
+	// within the cluster is only routed to the tunnel pod if it originates
+	// from the node the pod runs on, which avoids an additional hop
+	// between nodes but drops the traffic of clients on all other nodes.
+	// The field requires Kubernetes 1.21 or newer with the
+	// ServiceInternalTrafficPolicy feature gate enabled.
+	InternalTrafficPolicy string
+
+	// ServiceType is the type of the Service, "ClusterIP", "NodePort" or
+	// "LoadBalancer". Defaults to "ClusterIP". The latter two make the
+	// tunnel reachable from outside the cluster.
+	ServiceType string
+
+	// Controller is the kind of workload that runs the tunnel pod,
+	// ControllerPod or ControllerDeployment. Defaults to a bare Pod.
+	// With a Deployment, a pod lost e.g. with its node is replaced and
+	// the tunnel moves to the replacement pod, so the Service gets
+	// endpoints again without re-running kubetnl. The SSH connection is
+	// only re-established if KeepaliveInterval is set.
+	Controller string
+
+	// ServiceAnnotations are added to the annotations of the Service,
+	// e.g. to configure the load balancer of a cloud provider.
+	ServiceAnnotations map[string]string
+
+	// SSHUser and SSHPassword are the credentials used between kubetnl
+	// and the tunnel pod. SSHUser defaults to DefaultSSHUser. If
+	// SSHPassword is set, password authentication is used. All are
+	// ignored if CredentialProvider is set.
+	SSHUser     string
+	SSHPassword string
+
+	// InsecureSkipHostKeyCheck makes the tunnel accept any host key of
+	// the SSH server if its host key can not be read from the pod. This
+	// allows to intercept the SSH connection. By default, the host key
+	// is read by executing a command in the pod, which requires the
+	// permission to create pods/exec.
+	InsecureSkipHostKeyCheck bool
+
+	// SSHPrivateKeyPath is the path of a private key that is used for
+	// public key authentication if SSHPassword is not set. If neither is
+	// set, an ephemeral key is generated for the tunnel.
+	SSHPrivateKeyPath string
+
+	// SSHKeySecret references a private key in a Secret in the namespace
+	// of the tunnel as "<name>/<key>". It is used like SSHPrivateKeyPath,
+	// which must not be set at the same time.
+	SSHKeySecret string
+
+	// SSHKeyPassphrase decrypts the private key of SSHPrivateKeyPath or
+	// SSHKeySecret if it is encrypted.
+	SSHKeyPassphrase string
+
+	// CredentialProvider, if set, provides the SSH credentials used
+	// between kubetnl and the tunnel pod instead of SSHUser,
+	// SSHPassword, SSHPrivateKeyPath and SSHKeySecret.
+	CredentialProvider CredentialProvider
+
+	// ExistingPod is the name of a running Pod with an SSH server to use
+	// for the tunnel. If set, no resources are created in the cluster and
+	// the Pod is not deleted when the tunnel is stopped. The Pod must
+	// name its SSH container port "ssh".
+	ExistingPod string
+
+	// Attach makes the tunnel use the Service and Pod of an existing
+	// tunnel named Name instead of creating resources, e.g. to take over
+	// a tunnel whose kubetnl process was killed. The resources are only
+	// deleted when the tunnel is stopped if AttachCleanup is set.
+	Attach        bool
+	AttachCleanup bool
+
+	// UsePrewarmed makes the tunnel adopt a Pod created by Prewarm, if
+	// there is one available, instead of creating a new one.
+	UsePrewarmed bool
+
+	// ResourceTTL, if non-zero, is set as value of the
+	// ResourceTTLAnnotation on all created resources. This allows external
+	// garbage collection tools to delete leftover resources in case
+	// kubetnl fails to clean them up itself.
+	ResourceTTL time.Duration
+
+	// ResourceTTLAnnotation is the annotation key used for ResourceTTL.
+	// Defaults to DefaultResourceTTLAnnotation.
+	ResourceTTLAnnotation string
+
+	// Labels and Annotations are added to all resources created for the
+	// tunnel, e.g. for cost tracking. The "io.github.kubetnl" label that
+	// identifies the resources of a tunnel can not be overridden.
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// Protect adds the ProtectFinalizer to the Service, so that deleting
+	// it, e.g. with kubectl, does not take effect until the tunnel is
+	// stopped and removes the finalizer. If kubetnl is killed, the
+	// finalizer is left behind and blocks the deletion of the Service
+	// until it is removed, e.g. by "kubetnl cleanup".
+	Protect bool
+
+	// ReuseService makes the tunnel update the ports and selector of an
+	// existing Service named Name that carries the "io.github.kubetnl"
+	// label instead of failing to create it. A reused Service is only
+	// deleted when the tunnel is stopped if it has the ManagedAnnotation,
+	// i.e. it was created by kubetnl and not provisioned by the user.
+	ReuseService bool
+
+	// WaitEndpoints makes Run wait until the Endpoints of the Service
+	// have a ready address before the tunnel is reported as ready, so
+	// that the first request to the Service from within the cluster
+	// does not fail. The wait is bounded by PodReadyTimeout.
+	WaitEndpoints bool
+
+	// FollowLogs makes the tunnel stream the logs of the SSH server
+	// container of the tunnel pod to ErrOut as soon as the pod exists,
+	// e.g. to debug an SSH server that does not come up.
+	FollowLogs bool
+
 	RawPortMappings []string
 
 	PortMappings []port.Mapping
@@ -32,12 +287,114 @@ type TunnelConfig struct {
 	// on.
 	RemoteSSHPort int
 
+	// RemoteBindAddress is the IP address in the pod the forwarded ports
+	// are bound to, e.g. 127.0.0.1 to only make them reachable from
+	// within the pod. Defaults to 0.0.0.0, i.e. all interfaces. The SSH
+	// server must set "GatewayPorts clientspecified", as the init script
+	// does.
+	RemoteBindAddress string
+
 	ContinueOnTunnelError bool
 
+	// RequireAllMappings makes the tunnel fail instead of becoming ready
+	// if any port mapping can not be forwarded, e.g. because of its
+	// protocol or, with ContinueOnTunnelError, because listening in the
+	// pod failed. Without it, at least one mapping must be forwarded.
+	RequireAllMappings bool
+
+	// TargetDialTimeout is the timeout for dialing the target address of a
+	// port mapping. Zero means no timeout.
+	TargetDialTimeout time.Duration
+
+	// ForwarderWorkers limits the number of connections handled
+	// concurrently for each port mapping. Zero means unlimited.
+	ForwarderWorkers int
+
+	// PrewarmConns is the number of idle connections kept open to the
+	// target of each port mapping, so that forwarded connections do not
+	// have to wait for the target to be dialed. The target sees them as
+	// connections without data. Zero disables it.
+	PrewarmConns int
+
+	// MaxBufferPerConn limits the amount of data in bytes buffered per
+	// forwarded connection and direction. Connections exceeding the limit
+	// are closed. Zero means no additional buffering.
+	MaxBufferPerConn int
+
+	// DrainTimeout is the time active connections are given to finish
+	// when the tunnel is shut down before they are closed forcibly. Zero
+	// means to wait for all connections to finish.
+	DrainTimeout time.Duration
+
+	// KeepaliveInterval is the interval SSH keepalive requests are sent
+	// at to detect a dead connection, e.g. after the pod restarted. Dead
+	// connections are re-established together with the port mappings.
+	// Zero disables keepalives and thus reconnecting.
+	KeepaliveInterval time.Duration
+
+	// SSHDialTimeout, if non-zero, is the maximum duration establishing
+	// the SSH connection is retried for.
+	SSHDialTimeout time.Duration
+
+	// SSHDialBackoff is the backoff between the attempts to establish the
+	// SSH connection. Its Steps are the maximum number of attempts.
+	// Defaults to DefaultSSHDialBackoff if Steps is zero.
+	SSHDialBackoff wait.Backoff
+
+	// SSHConnectTimeout is the maximum duration of a single attempt to
+	// establish the SSH connection, including the SSH handshake, so that
+	// an attempt hanging on a flaky network is retried. Defaults to
+	// DefaultSSHConnectTimeout if zero.
+	SSHConnectTimeout time.Duration
+
+	// OnEvent is an optional callback that is called for every significant
+	// event while the tunnel is running, e.g. opened and closed
+	// connections. It may be called concurrently from multiple
+	// goroutines.
+	OnEvent func(Event)
+
+	// VerifyTLSTarget makes the tunnel perform a TLS handshake with the
+	// target of every port mapping through the tunnel once it is set up
+	// and report the negotiated TLS version and certificate subject.
+	VerifyTLSTarget bool
+
+	// ConnectionLogPath, if set, is the path of a file that a ledger
+	// entry is appended to for every connection handled by the tunnel.
+	ConnectionLogPath string
+
+	// MetricsAddr, if set, is the address Prometheus metrics of the
+	// tunnel are served on under /metrics, e.g. ":9090". The metrics
+	// include connection and byte counters per port mapping and the
+	// number of reconnects.
+	MetricsAddr string
+
+	// ConnectionLogSample is the fraction of connections, between 0 and
+	// 1, that are recorded in the connection log, which reduces its
+	// volume for busy tunnels. It applies to all port mappings. The
+	// connection statistics still count all connections. Zero, the zero
+	// value of TunnelConfig, records all connections like 1 does; the
+	// --connection-log-sample flag defaults to 1 and does not accept zero
+	// since it reads like recording none.
+	ConnectionLogSample float64
+
 	// The port on the localhost that is used to forward SSH connections to
 	// the remote container.
 	LocalSSHPort int
 
+	// PortForwardAttempts limits the number of attempts to establish the
+	// port-forward to the SSH port once the pod is ready. Zero means no
+	// limit.
+	PortForwardAttempts int
+
+	// PortForwardMaxRetryDuration limits the time the port-forward to the
+	// SSH port may fail continuously before the tunnel ends, see Done.
+	// Zero means no limit.
+	PortForwardMaxRetryDuration time.Duration
+
+	// LocalAddresses are the local addresses the port-forward to the SSH
+	// port of the pod listens on. Defaults to "127.0.0.1".
+	LocalAddresses []string
+
 	RESTConfig *rest.Config
 	ClientSet  *kubernetes.Clientset
 }
@@ -46,11 +403,31 @@ type Tunnel struct {
 	TunnelConfig
 
 	readyCh              chan struct{}
+	doneCh               chan struct{}
+	doneOnce             sync.Once
+	err                  error
+	stopWatch            context.CancelFunc
+	prewarm              bool
+	existingPod          bool
+	ledger               *connectionLedger
+	metrics              *metricsRecorder
+	stats                *statsRecorder
+	credentials          Credentials
+	generatedPassword    bool
+	udpRelays            map[port.Port]int
+	history              eventHistory
+	events               eventBus
+	sshMu                sync.Mutex // Guards sshTunnel, which is replaced on reconnects, and pod and kubeForwarder, which are replaced with the pod of a Deployment.
+	sshTunnel            *SSHTunnel
+	kubeForwarder        *portforward.KubeForwarder
+	deployment           *appsv1.Deployment
+	deploymentClient     appsv1client.DeploymentInterface
 	serviceAccount       *corev1.ServiceAccount
 	serviceAccountClient v1.ServiceAccountInterface
 	configMap            *corev1.ConfigMap
 	configMapClient      v1.ConfigMapInterface
 	service              *corev1.Service
+	keepService          bool // The reused Service was not created by kubetnl.
 	serviceClient        v1.ServiceInterface
 	pod                  *corev1.Pod
 	podClient            v1.PodInterface
@@ -60,56 +437,142 @@ func NewTunnel(cfg TunnelConfig) *Tunnel {
 	return &Tunnel{
 		TunnelConfig: cfg,
 		readyCh:      make(chan struct{}), // Closed when portforwarding ready.
+		doneCh:       make(chan struct{}),
+		stats:        newStatsRecorder(),
 	}
 }
 
 // Run starts the runnel from the kubernetes cluster to the defined list of port mappings.
 func (o *Tunnel) Run(ctx context.Context) (chan struct{}, error) {
-	if err := o.CreateService(ctx); err != nil {
-		return nil, err
+	if o.SetupTimeout <= 0 {
+		return o.run(ctx)
+	}
+	// The tunnel keeps running with runCtx once it is ready, so runCtx
+	// is only canceled if the timer fires before.
+	runCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(o.SetupTimeout, cancel)
+	readyCh, err := o.run(runCtx)
+	timedOut := !timer.Stop() && ctx.Err() == nil
+	if err != nil || timedOut {
+		cancel()
 	}
+	if timedOut {
+		if err == nil || err == graceful.Interrupted {
+			return nil, fmt.Errorf("tunnel not ready within the setup timeout of %s", o.SetupTimeout)
+		}
+		return nil, fmt.Errorf("tunnel not ready within the setup timeout of %s: %v", o.SetupTimeout, err)
+	}
+	return readyCh, err
+}
 
-	if err := o.CreateConfigMap(ctx); err != nil {
+func (o *Tunnel) run(ctx context.Context) (chan struct{}, error) {
+	if err := o.resolveCredentials(ctx); err != nil {
 		return nil, err
 	}
 
-	if err := o.CreatePod(ctx); err != nil {
-		return nil, err
+	if o.ConnectionLogPath != "" {
+		ledger, err := openConnectionLedger(o.ConnectionLogPath)
+		if err != nil {
+			return nil, err
+		}
+		o.ledger = ledger
 	}
 
-	kf, err := portforward.NewKubeForwarder(portforward.KubeForwarderConfig{
-		PodName:      o.pod.Name,
-		PodNamespace: o.pod.Namespace,
-		LocalPort:    o.LocalSSHPort,
-		RemotePort:   o.RemoteSSHPort,
-		RESTConfig:   o.RESTConfig,
-		ClientSet:    o.ClientSet,
-	})
+	if o.MetricsAddr != "" {
+		metrics := newMetricsRecorder()
+		if err := metrics.serve(ctx, o.MetricsAddr); err != nil {
+			return nil, err
+		}
+		o.metrics = metrics
+	}
+
+	if o.ExistingPod != "" {
+		if err := o.useExistingPod(ctx); err != nil {
+			return nil, err
+		}
+	} else if o.Attach {
+		if err := o.attach(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		o.udpRelays = udpRelayPorts(o.PortMappings, o.RemoteSSHPort)
+		if err := o.createResources(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	kf, err := portforward.NewKubeForwarder(o.kubeForwarderConfig(o.pod))
 	if err != nil {
 		return nil, err
 	}
 	if _, err := kf.Run(ctx); err != nil {
 		return nil, err
 	}
+	// Keep the forwarder, so that reconnecting reuses its local port.
+	o.kubeForwarder = kf
 
 	klog.V(3).Infof("Waiting for SSH port-forward to be ready...")
 	select {
 	case <-kf.Ready():
 		klog.V(3).Infof("SSH port-forward is ready: starting SSH connection...")
+	case <-kf.Done():
+		if err := kf.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("port-forward to the SSH port stopped before it was ready")
 	case <-ctx.Done():
+		if err := kf.LastError(); err != nil {
+			return nil, fmt.Errorf("port-forward to the SSH port not ready: %v", err)
+		}
 		return nil, ctx.Err()
 	}
 
-	sshtunnel := NewSSHTunnel(o.LocalSSHPort, o.RemoteSSHPort, o.ContinueOnTunnelError)
+	hostKey, err := o.fetchHostKey(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, graceful.Interrupted
+		}
+		if !o.InsecureSkipHostKeyCheck {
+			return nil, fmt.Errorf("error reading the SSH host key of Pod %q (check that you are allowed to create pods/exec or skip the check with --insecure-skip-host-key-check): %v", o.pod.Name, err)
+		}
+		klog.Warningf("Unable to read the SSH host key of Pod %q: accepting any host key. %v", o.pod.Name, err)
+	}
+
+	sshtunnel := o.newSSHTunnel(hostKey)
+	o.sshTunnel = sshtunnel
 	if err := sshtunnel.Dial(ctx); err != nil {
 		return nil, err
 	}
-	if err := sshtunnel.RunPortMappings(ctx, o.PortMappings); err != nil {
+	o.stats.newSession()
+	sessionCtx, cancelSession := context.WithCancel(ctx)
+	if err := sshtunnel.RunPortMappings(sessionCtx, o.PortMappings); err != nil {
+		cancelSession()
 		return nil, err
 	}
+	if o.VerifyTLSTarget {
+		o.verifyTLSTargets(ctx)
+	}
+	if o.WaitEndpoints && o.ExistingPod == "" {
+		if err := o.waitForEndpoints(ctx); err != nil {
+			cancelSession()
+			return nil, err
+		}
+	}
 
 	// mark the tunnel as ready
 	close(o.readyCh)
+	o.emit(Event{Type: EventReady})
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	o.stopWatch = cancel
+	if o.pod != nil {
+		go o.watchPodTermination(watchCtx)
+	}
+	if o.IdleTimeout > 0 {
+		go o.watchIdle(watchCtx)
+	}
+	go o.watchPortForward(watchCtx, kf)
+	go o.reconnectSSH(ctx, watchCtx, hostKey, cancelSession)
 
 	// Note that, in case of a graceful shutdown the defer functions will
 	// close the SSH connection, close the portforwarding and cleanup the
@@ -117,16 +580,398 @@ func (o *Tunnel) Run(ctx context.Context) (chan struct{}, error) {
 	return o.readyCh, nil
 }
 
+// kubeForwarderConfig returns the configuration of the port-forward to the SSH
+// port of pod.
+func (o *Tunnel) kubeForwarderConfig(pod *corev1.Pod) portforward.KubeForwarderConfig {
+	return portforward.KubeForwarderConfig{
+		PodName:      pod.Name,
+		PodNamespace: pod.Namespace,
+		LocalPort:    o.LocalSSHPort,
+		RemotePort:   o.RemoteSSHPort,
+		Addresses:    o.LocalAddresses,
+
+		MaxInitialAttempts: o.PortForwardAttempts,
+		MaxRetryDuration:   o.PortForwardMaxRetryDuration,
+		PodReadyTimeout:    o.PodReadyTimeout,
+		OnReconnect: func() {
+			o.metrics.portForwardReconnected(o.Name)
+			o.emit(Event{Type: EventReconnect})
+		},
+		OnFailing: func(err error) {
+			o.emit(Event{Type: EventError, Error: fmt.Sprintf("port-forward to the SSH port failing: %v", err)})
+		},
+		RESTConfig: o.RESTConfig,
+		ClientSet:  o.ClientSet,
+	}
+}
+
+// newSSHTunnel returns an SSHTunnel to the SSH server of the pod that
+// accepts hostKey.
+func (o *Tunnel) newSSHTunnel(hostKey ssh.PublicKey) *SSHTunnel {
+	sshtunnel := NewSSHTunnel(o.LocalSSHPort, o.RemoteSSHPort, o.ContinueOnTunnelError)
+	sshtunnel.HostKey = hostKey
+	sshtunnel.RequireAllMappings = o.RequireAllMappings
+	sshtunnel.TargetDialTimeout = o.TargetDialTimeout
+	sshtunnel.ForwarderWorkers = o.ForwarderWorkers
+	sshtunnel.MaxBufferPerConn = o.MaxBufferPerConn
+	sshtunnel.DrainTimeout = o.DrainTimeout
+	sshtunnel.ConnectionLogSample = o.ConnectionLogSample
+	sshtunnel.PrewarmConns = o.PrewarmConns
+	sshtunnel.OnEvent = o.emit
+	sshtunnel.Credentials = o.credentials
+	sshtunnel.UDPRelayPorts = o.udpRelays
+	sshtunnel.KeepaliveInterval = o.KeepaliveInterval
+	sshtunnel.DialTimeout = o.SSHDialTimeout
+	sshtunnel.DialBackoff = o.SSHDialBackoff
+	sshtunnel.ConnectTimeout = o.SSHConnectTimeout
+	sshtunnel.RemoteBindAddress = o.RemoteBindAddress
+	if o.IdleTimeout > 0 {
+		sshtunnel.OnTraffic = o.stats.traffic
+	}
+	return &sshtunnel
+}
+
+// reconnectSSH re-establishes the SSH connection and the port mappings
+// whenever the SSH connection is dead, e.g. after the SSH server in the pod
+// restarted, until watchCtx is done. The port mappings of a connection are
+// bound to ctx and closed by cancelSession once the connection is dead. The
+// port-forward to the pod recovers by itself.
+func (o *Tunnel) reconnectSSH(ctx, watchCtx context.Context, hostKey ssh.PublicKey, cancelSession context.CancelFunc) {
+	for {
+		current := o.currentSSHTunnel()
+		select {
+		case <-current.Done():
+		case <-watchCtx.Done():
+			return
+		}
+		klog.Warningf("%v: re-establishing the SSH tunnel...", current.Err())
+		o.emit(Event{Type: EventReconnect, Error: current.Err().Error()})
+		cancelSession()
+		current.Close()
+
+		backoff := time.Second
+		for {
+			// A restarted container may have generated a new host
+			// key.
+			if key, err := o.fetchHostKey(watchCtx); err == nil {
+				hostKey = key
+			}
+			next := o.newSSHTunnel(hostKey)
+			err := next.Dial(watchCtx)
+			if err == nil {
+				o.sshMu.Lock()
+				sessionCtx, cancel := context.WithCancel(ctx)
+				if err = next.RunPortMappings(sessionCtx, o.PortMappings); err == nil {
+					o.sshTunnel = next
+					cancelSession = cancel
+				} else {
+					cancel()
+					next.Close()
+				}
+				o.sshMu.Unlock()
+			}
+			if err == nil {
+				break
+			}
+			if watchCtx.Err() != nil {
+				return
+			}
+			klog.Warningf("Failed to re-establish the SSH tunnel: %v. Retrying in %s...", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-watchCtx.Done():
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+		o.stats.newSession()
+		o.metrics.sshReconnected(o.Name)
+		klog.Infof("SSH tunnel re-established.")
+	}
+}
+
+// currentSSHTunnel returns the SSHTunnel of the current SSH connection.
+func (o *Tunnel) currentSSHTunnel() *SSHTunnel {
+	o.sshMu.Lock()
+	defer o.sshMu.Unlock()
+	return o.sshTunnel
+}
+
+// createResources creates the Service, ConfigMap and Pod for the tunnel or
+// adopts a prewarmed Pod if requested. The Service and ConfigMap do not depend
+// on each other and are created concurrently. The Pod is created once both
+// exist. In case of an error, all resources created so far are referenced by
+// o, so that Stop cleans them up.
+func (o *Tunnel) createResources(ctx context.Context) error {
+	var serviceErr, podErr error
+	adopted := false
+
+	var g errgroup.Group
+	g.Go(func() error {
+		serviceErr = o.CreateService(ctx)
+		return nil
+	})
+	g.Go(func() error {
+		if o.UsePrewarmed {
+			adopted, podErr = o.adoptPrewarmed(ctx)
+			if podErr != nil {
+				return nil
+			}
+			if !adopted {
+				klog.V(2).Infof("No prewarmed Pod available: creating a new one.")
+			}
+		}
+		if !adopted {
+			podErr = o.CreateConfigMap(ctx)
+		}
+		return nil
+	})
+	g.Wait()
+
+	if err := aggregateErrors(serviceErr, podErr); err != nil {
+		return err
+	}
+	switch {
+	case adopted:
+		return nil
+	case o.Controller == ControllerDeployment:
+		return o.CreateDeployment(ctx)
+	default:
+		return o.CreatePod(ctx)
+	}
+}
+
+// aggregateErrors combines the non-nil errors of errs into one. If all errors
+// are graceful.Interrupted, graceful.Interrupted is returned.
+func aggregateErrors(errs ...error) error {
+	var agg []error
+	interrupted := true
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		agg = append(agg, err)
+		if err != graceful.Interrupted {
+			interrupted = false
+		}
+	}
+	if len(agg) == 0 {
+		return nil
+	}
+	if interrupted {
+		return graceful.Interrupted
+	}
+	return utilerrors.NewAggregate(agg)
+}
+
+// emit records e in the tunnel stats, history and connection ledger, if
+// any, publishes it to the subscribers of Events and passes it to the OnEvent
+// callback.
+func (o *Tunnel) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Tunnel = o.Name
+	o.stats.record(e)
+	o.metrics.record(e)
+	o.history.record(e)
+	if o.ledger != nil {
+		if err := o.ledger.record(e); err != nil {
+			klog.Errorf("Error writing to connection log: %v", err)
+		}
+	}
+	o.events.publish(e)
+	if o.OnEvent != nil {
+		o.OnEvent(e)
+	}
+}
+
+// Events returns a channel that receives all events emitted by the tunnel
+// from now on. Every call returns a new channel, so multiple observers can
+// subscribe independently. Events are dropped for observers that do not
+// receive them fast enough; use TunnelConfig.OnEvent to get every event
+// synchronously instead. The channel is closed when the tunnel is stopped.
+func (o *Tunnel) Events() <-chan Event {
+	return o.events.subscribe()
+}
+
+// Stats returns the connection statistics of the tunnel. The counters are
+// cumulative over the lifetime of the tunnel and are not reset when the SSH
+// connection is re-established.
+func (o *Tunnel) Stats() Stats {
+	return o.stats.snapshot()
+}
+
+// PodName returns the name of the pod the tunnel runs in. It changes when the
+// tunnel moves to the replacement of a lost pod of its Deployment.
+func (o *Tunnel) PodName() string {
+	o.sshMu.Lock()
+	defer o.sshMu.Unlock()
+	if o.pod == nil {
+		return ""
+	}
+	return o.pod.Name
+}
+
+// ServiceName returns the name of the Service of the tunnel or an empty
+// string if the tunnel has none, e.g. with ExistingPod.
+func (o *Tunnel) ServiceName() string {
+	o.sshMu.Lock()
+	defer o.sshMu.Unlock()
+	if o.service == nil {
+		return ""
+	}
+	return o.service.Name
+}
+
 func (o *Tunnel) Ready() <-chan struct{} {
 	return o.readyCh
 }
 
+// Done returns a channel that is closed when the tunnel ended without Stop
+// being called, e.g. because the pod was terminated after PodMaxLifetime or
+// deleted. Err returns the reason afterwards. Stop must still be called to
+// clean up.
+func (o *Tunnel) Done() <-chan struct{} {
+	return o.doneCh
+}
+
+// end ends the tunnel for reason, see Done. Only the first reason is kept.
+func (o *Tunnel) end(reason error) {
+	o.doneOnce.Do(func() {
+		klog.Warningf("%v: ending the tunnel.", reason)
+		o.emit(Event{Type: EventError, Error: reason.Error()})
+		o.err = reason
+		close(o.doneCh)
+	})
+}
+
+// watchPortForward ends the tunnel once kf gave up, e.g. after failing for
+// PortForwardMaxRetryDuration. It returns without ending the tunnel when kf
+// has been stopped or ctx is done.
+func (o *Tunnel) watchPortForward(ctx context.Context, kf *portforward.KubeForwarder) {
+	select {
+	case <-kf.Done():
+		if err := kf.Err(); err != nil && ctx.Err() == nil {
+			o.end(err)
+		}
+	case <-ctx.Done():
+	}
+}
+
+// ErrIdle is the reason a tunnel ended after its IdleTimeout.
+var ErrIdle = errors.New("tunnel idle")
+
+// watchIdle ends the tunnel once there has been no traffic for IdleTimeout
+// since the tunnel became ready or ctx is done.
+func (o *Tunnel) watchIdle(ctx context.Context) {
+	ready := time.Now()
+	for {
+		last := o.stats.idleSince()
+		if last.Before(ready) {
+			last = ready
+		}
+		idle := time.Since(last)
+		if idle >= o.IdleTimeout {
+			o.end(fmt.Errorf("%w: no traffic for %s", ErrIdle, idle.Round(time.Second)))
+			return
+		}
+		wait := o.IdleTimeout - idle
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Err returns the reason the tunnel ended once Done is closed.
+func (o *Tunnel) Err() error {
+	select {
+	case <-o.doneCh:
+		return o.err
+	default:
+		return nil
+	}
+}
+
+// drain stops the port mappings from accepting new connections and waits
+// for the active connections to finish. If DrainTimeout is set, the port
+// mappings close the connections that are still active afterwards.
+//
+// The context passed to Run may still be alive, e.g. when the tunnel ended
+// because it was idle, so the port mappings are closed here.
+func (o *Tunnel) drain(ctx context.Context) {
+	t := o.currentSSHTunnel()
+	if t == nil {
+		return
+	}
+	t.ClosePortMappings()
+	n := t.ActiveConns()
+	if n == 0 {
+		return
+	}
+	klog.Infof("Waiting for %d active connection(s) to finish...", n)
+	var timeout <-chan time.Time
+	if o.DrainTimeout > 0 {
+		timer := time.NewTimer(o.DrainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for t.ActiveConns() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			// The port mappings close them at the same time.
+			if n := t.ActiveConns(); n > 0 {
+				klog.Warningf("Closing %d connection(s) that did not finish within %s.", n, o.DrainTimeout)
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+	klog.V(2).Infof("All connections finished.")
+}
+
+// closeLedger closes the connection log, if any.
+func (o *Tunnel) closeLedger() {
+	if o.ledger == nil {
+		return
+	}
+	if err := o.ledger.Close(); err != nil {
+		klog.Errorf("Error closing connection log: %v", err)
+	}
+}
+
+// Stop deletes the resources of the tunnel. Active connections are given
+// DrainTimeout to finish after the Service was deleted.
 func (o *Tunnel) Stop(ctx context.Context) error {
+	if o.stopWatch != nil {
+		// Deleting the pod must not be reported as end of the tunnel.
+		o.stopWatch()
+	}
+	o.emit(Event{Type: EventShuttingDown})
+	defer o.events.close()
+	// The connections that finish while draining are still recorded.
+	defer o.closeLedger()
+
 	klog.V(3).Infof("Cleanning up resources in the kubernetes cluster...")
 
+	// Delete the Service first, so that no new connections arrive
+	// while the active ones are drained. Deleting the pod interrupts
+	// them.
 	if err := o.CleanupService(ctx); err != nil {
 		return err
 	}
+	o.drain(ctx)
+	if err := o.CleanupDeployment(ctx); err != nil {
+		return err
+	}
 	if err := o.CleanupPod(ctx); err != nil {
 		return err
 	}
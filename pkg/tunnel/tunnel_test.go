@@ -0,0 +1,474 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/pschmitt/kubetnl/pkg/port"
+	"github.com/pschmitt/kubetnl/pkg/portforward"
+)
+
+// apiServer is a fake Kubernetes API server that creates ConfigMaps, rejects
+// the creation of Services and records all requests.
+type apiServer struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/test/configmaps":
+		// Echo the ConfigMap back as created. The body must be read
+		// before the header is written.
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	case r.Method == http.MethodDelete:
+		json.NewEncoder(w).Encode(metav1.Status{Status: metav1.StatusSuccess})
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonForbidden,
+			Message:  "forbidden",
+			Code:     http.StatusForbidden,
+		})
+	}
+}
+
+func (s *apiServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func TestStopAfterCreateServiceFailed(t *testing.T) {
+	api := &apiServer{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := port.ParseMappings([]string{"8080:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := NewTunnel(TunnelConfig{
+		IOStreams:     genericclioptions.NewTestIOStreamsDiscard(),
+		Namespace:     "test",
+		Name:          "test",
+		ClientSet:     cs,
+		PortMappings:  mappings,
+		RemoteSSHPort: 2222,
+	})
+
+	if err := tun.createResources(context.Background()); err == nil {
+		t.Fatal("createResources succeeded, want the error of creating the Service")
+	}
+	if tun.service != nil || tun.pod != nil {
+		t.Fatalf("createResources referenced resources that have not been created: service %v, pod %v", tun.service, tun.pod)
+	}
+	if err := tun.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	// Only the ConfigMap, which has been created concurrently to the
+	// Service, must be deleted.
+	var deleted []string
+	for _, r := range api.Requests() {
+		if strings.HasPrefix(r, http.MethodDelete) {
+			deleted = append(deleted, r)
+		}
+	}
+	want := "DELETE /api/v1/namespaces/test/configmaps/test"
+	if len(deleted) != 1 || deleted[0] != want {
+		t.Errorf("Stop sent the delete requests %q, want only %q", deleted, want)
+	}
+}
+
+func TestStopWithoutResources(t *testing.T) {
+	tun := NewTunnel(TunnelConfig{
+		IOStreams: genericclioptions.NewTestIOStreamsDiscard(),
+		Name:      "test",
+	})
+	// Stop must not dereference resources that have never been created,
+	// e.g. if creating the ConfigMap failed or was skipped.
+	if err := tun.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+}
+
+func TestRunSetupTimeout(t *testing.T) {
+	// The API server does not answer until the test is done, like an
+	// unreachable cluster.
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := port.ParseMappings([]string{"8080:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := NewTunnel(TunnelConfig{
+		IOStreams:     genericclioptions.NewTestIOStreamsDiscard(),
+		Namespace:     "test",
+		Name:          "test",
+		ClientSet:     cs,
+		PortMappings:  mappings,
+		RemoteSSHPort: 2222,
+		SetupTimeout:  100 * time.Millisecond,
+	})
+
+	_, err = tun.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "setup timeout") {
+		t.Fatalf("Run returned %v, want a setup timeout error", err)
+	}
+	if err := tun.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	mappings, err := port.ParseMappings([]string{"8080:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cfg  TunnelConfig
+		want []string
+	}{
+		{
+			cfg:  TunnelConfig{},
+			want: []string{"Service", "ConfigMap", "ServiceAccount", "Pod"},
+		},
+		{
+			cfg:  TunnelConfig{Controller: ControllerDeployment, ServiceAccount: "tunnel", NoInitScript: true, SSHPassword: "secret"},
+			want: []string{"Service", "Deployment"},
+		},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		cfg.IOStreams = genericclioptions.NewTestIOStreamsDiscard()
+		cfg.Namespace, cfg.Name = "test", "test"
+		cfg.PortMappings = mappings
+		cfg.RemoteSSHPort = 2222
+		// Without server dry-run, the cluster must not be contacted.
+		objs, err := NewTunnel(cfg).Render(context.Background(), false)
+		if err != nil {
+			t.Errorf("Render failed: %v", err)
+			continue
+		}
+		var kinds []string
+		for _, obj := range objs {
+			kinds = append(kinds, obj.GetObjectKind().GroupVersionKind().Kind)
+		}
+		if strings.Join(kinds, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Render returned %v, want %v", kinds, tt.want)
+		}
+	}
+}
+
+func TestWatchIdle(t *testing.T) {
+	tun := NewTunnel(TunnelConfig{
+		IOStreams:   genericclioptions.NewTestIOStreamsDiscard(),
+		Name:        "test",
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Traffic keeps the tunnel alive.
+	tun.stats.record(Event{Type: EventConnectionOpened, ContainerPort: 80})
+	go tun.watchIdle(ctx)
+	for end := time.Now().Add(200 * time.Millisecond); time.Now().Before(end); {
+		tun.stats.traffic()
+		select {
+		case <-tun.Done():
+			t.Fatalf("tunnel ended with traffic: %v", tun.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// The connection is still open, but without traffic.
+	select {
+	case <-tun.Done():
+		if !errors.Is(tun.Err(), ErrIdle) {
+			t.Errorf("tunnel ended with %v, want ErrIdle", tun.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tunnel did not end after the idle timeout")
+	}
+}
+
+func TestStopDrainRecordsConnections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.log")
+	tun := NewTunnel(TunnelConfig{
+		IOStreams:         genericclioptions.NewTestIOStreamsDiscard(),
+		Name:              "test",
+		ConnectionLogPath: path,
+		DrainTimeout:      5 * time.Second,
+	})
+	ledger, err := openConnectionLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.ledger = ledger
+
+	// The target closes the connection shortly after it was accepted,
+	// i.e. while the tunnel is draining.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	}()
+
+	mappings, err := port.ParseMappings([]string{target.Addr().String() + ":80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mappings[0]
+	st := &SSHTunnel{OnEvent: tun.emit}
+	f := &portforward.Forwarder{
+		TargetAddr: m.TargetAddress(),
+		ConnState:  st.connStateHook(m),
+		ErrorLog:   log.New(io.Discard, "", 0),
+	}
+	st.active = map[port.Port]*SSHTunnelForwarderWithListener{m.ContainerPort(): {f: f, m: m}}
+	tun.sshTunnel = st
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Open(l)
+	defer f.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+	for st.ActiveConns() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := tun.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry LedgerEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("connection log %q does not hold a single entry: %v", data, err)
+	}
+	if entry.ContainerPort != 80 {
+		t.Errorf("recorded connection to container port %d, want 80", entry.ContainerPort)
+	}
+}
+
+func TestStopDrainClosesIdleConnections(t *testing.T) {
+	tun := NewTunnel(TunnelConfig{
+		IOStreams:    genericclioptions.NewTestIOStreamsDiscard(),
+		Name:         "test",
+		DrainTimeout: 100 * time.Millisecond,
+	})
+
+	// Neither the target nor the client close the connection, like an idle
+	// keep-alive connection while the context passed to Run is alive.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	mappings, err := port.ParseMappings([]string{target.Addr().String() + ":80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mappings[0]
+	st := &SSHTunnel{DrainTimeout: tun.DrainTimeout}
+	f := &portforward.Forwarder{
+		TargetAddr: m.TargetAddress(),
+		ErrorLog:   log.New(io.Discard, "", 0),
+	}
+	st.active = map[port.Port]*SSHTunnelForwarderWithListener{m.ContainerPort(): {f: f, m: m}}
+	tun.sshTunnel = st
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Open(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for st.ActiveConns() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := tun.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Stop took %v with a drain timeout of %v", d, tun.DrainTimeout)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("reading the idle connection after Stop returned %v, want io.EOF", err)
+	}
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Error("the port mapping still accepts connections after Stop")
+	}
+}
+
+// sshServer starts an SSH server on a random local port that presents the
+// host key signer and returns its port.
+func sshServer(t *testing.T, signer ssh.Signer) int {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, chans, reqs, err := ssh.NewServerConn(conn, config); err == nil {
+					go ssh.DiscardRequests(reqs)
+					for ch := range chans {
+						ch.Reject(ssh.Prohibited, "")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialHostKeyMismatch(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	server, other := newSigner(), newSigner()
+	localPort := sshServer(t, server)
+
+	tun := NewSSHTunnel(localPort, 2222, false)
+	tun.HostKey = other.PublicKey()
+	tun.DialBackoff = wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1, Steps: 5}
+	err := tun.Dial(context.Background())
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Dial returned %v, want ErrHostKeyMismatch", err)
+	}
+
+	tun = NewSSHTunnel(localPort, 2222, false)
+	tun.HostKey = server.PublicKey()
+	if err := tun.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial with the host key of the server failed: %v", err)
+	}
+	tun.Close()
+}
+
+func TestContainerPortMappings(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+		Ports: []corev1.ContainerPort{
+			{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+			{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+			{Name: "ssh", ContainerPort: 2222},
+		},
+	}}}}
+	mm, err := containerPortMappings(pod, 2222)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range mm {
+		got = append(got, fmt.Sprintf("%s->%s", m.ContainerPort(), m.TargetAddress()))
+	}
+	want := []string{"8080/tcp->127.0.0.1:8080", "53/udp->127.0.0.1:53"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got mappings %q, want %q", got, want)
+	}
+
+	// A pod that only declares the SSH port has nothing to forward.
+	pod.Spec.Containers[0].Ports = pod.Spec.Containers[0].Ports[2:]
+	if _, err := containerPortMappings(pod, 2222); err == nil {
+		t.Error("expected an error for a pod without ports besides the SSH port")
+	}
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pschmitt/kubetnl/pkg/net"
+	"github.com/pschmitt/kubetnl/pkg/port"
+)
+
+// SSH can only forward TCP connections. UDP datagrams are thus relayed
+// through TCP: in the pod, socat receives the datagrams on the container port
+// and forwards each one over a new TCP connection to a relay port on the
+// loopback interface. The relay port is forwarded over SSH and kubetnl sends
+// the data of each connection as datagram to the target. Responses take the
+// same way back.
+
+// udpRelayBasePort is the first port that is considered as relay port.
+const udpRelayBasePort = 61000
+
+// udpRelayPorts chooses a relay port in the pod for every UDP mapping of mm
+// that is used neither by a mapping nor for the SSH server.
+func udpRelayPorts(mm []port.Mapping, sshPort int) map[port.Port]int {
+	relays := make(map[port.Port]int)
+	next := udpRelayBasePort
+	for _, m := range mm {
+		if m.Protocol != port.ProtocolUDP {
+			continue
+		}
+		for net.IsInUse(mm, next) || next == sshPort {
+			next++
+		}
+		relays[m.ContainerPort()] = next
+		next++
+	}
+	return relays
+}
+
+// udpForwardsEnv returns the value of the UDP_FORWARDS environment variable
+// of the pod for relays: a space separated list of
+// "<container port>:<relay port>" pairs.
+func udpForwardsEnv(relays map[port.Port]int) string {
+	var ff []string
+	for p, relay := range relays {
+		ff = append(ff, fmt.Sprintf("%d:%d", p.Number, relay))
+	}
+	sort.Strings(ff)
+	return strings.Join(ff, " ")
+}
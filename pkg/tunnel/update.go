@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/pschmitt/kubetnl/pkg/net"
+	"github.com/pschmitt/kubetnl/pkg/port"
+)
+
+// UpdatePortMappings changes the port mappings of the running tunnel to
+// portMappings without restarting it. The ports of the Service are updated
+// first, then removed mappings are closed and new ones are started.
+//
+// If the Service can not be updated, nothing is changed. Mappings that fail
+// to start are reported in the returned error while all other changes are
+// still applied. Use ActivePortMappings to get the resulting set.
+func (o *Tunnel) UpdatePortMappings(ctx context.Context, portMappings []port.Mapping) error {
+	// Keep the SSH tunnel from being re-established with the old
+	// mappings while they are updated.
+	o.sshMu.Lock()
+	defer o.sshMu.Unlock()
+	if o.sshTunnel == nil {
+		return fmt.Errorf("tunnel is not running")
+	}
+	if err := port.CheckDuplicates(portMappings); err != nil {
+		return err
+	}
+	if net.IsInUse(portMappings, o.RemoteSSHPort) {
+		return fmt.Errorf("port %d is used for the SSH connection of the tunnel", o.RemoteSSHPort)
+	}
+	if o.service != nil && len(servicePorts(portMappings)) == 0 {
+		return fmt.Errorf("at least one port mapping must be exposed in the Service")
+	}
+	// Container ports of a running pod can not be changed, so new named
+	// ports would not resolve.
+	named := make(map[string]bool)
+	for _, m := range o.PortMappings {
+		named[m.ContainerPortName] = true
+	}
+	for _, m := range portMappings {
+		if m.ContainerPortName != "" && !named[m.ContainerPortName] {
+			return fmt.Errorf("named port %q can not be added to a running tunnel", m.ContainerPortName)
+		}
+	}
+	// The UDP relays are set up when the pod is created.
+	for _, m := range portMappings {
+		if _, ok := o.udpRelays[m.ContainerPort()]; m.Protocol == port.ProtocolUDP && !ok {
+			return fmt.Errorf("UDP port %s can not be added to a running tunnel", m.ContainerPort())
+		}
+	}
+	for _, relay := range o.udpRelays {
+		if net.IsInUse(portMappings, relay) {
+			return fmt.Errorf("port %d is used to relay UDP datagrams in the pod", relay)
+		}
+	}
+
+	if o.service != nil {
+		svc, err := o.serviceClient.Get(ctx, o.service.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("error getting Service: %v", err)
+		}
+		ports := servicePorts(portMappings)
+		keepNodePorts(ports, svc.Spec.Ports)
+		svc.Spec.Ports = ports
+		svc, err = o.serviceClient.Update(ctx, svc, metav1.UpdateOptions{})
+		if err != nil {
+			return fmt.Errorf("error updating Service ports: %v", err)
+		}
+		o.service = svc
+		o.printNodePorts()
+	}
+
+	err := o.sshTunnel.UpdatePortMappings(portMappings)
+	o.PortMappings = portMappings
+
+	var active []string
+	for _, m := range o.sshTunnel.ActiveMappings() {
+		active = append(active, fmt.Sprintf("kube:%s --> %s", m.ContainerPort(), m.TargetAddress()))
+	}
+	klog.Infof("Active port mappings: %s", strings.Join(active, ", "))
+	return err
+}
+
+// ActivePortMappings returns the port mappings that are currently forwarded.
+func (o *Tunnel) ActivePortMappings() []port.Mapping {
+	sshTunnel := o.currentSSHTunnel()
+	if sshTunnel == nil {
+		return nil
+	}
+	return sshTunnel.ActiveMappings()
+}
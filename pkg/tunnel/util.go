@@ -1,11 +1,19 @@
 package tunnel
 
 import (
+	"fmt"
+
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/pschmitt/kubetnl/pkg/port"
 )
 
+// portName returns the name of the service and container port for m. The name
+// is unique even if the same port number is mapped for multiple protocols.
+func portName(m port.Mapping) string {
+	return fmt.Sprintf("%s-%d", m.Protocol, m.ContainerPortNumber)
+}
+
 func protocolToCoreV1(p port.Protocol) corev1.Protocol {
 	if p == port.ProtocolSCTP {
 		return corev1.ProtocolSCTP
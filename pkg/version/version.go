@@ -4,7 +4,7 @@ package version
 import "strings"
 
 var (
-	// Release version of kubetnl.
+	// Release version of kubetnl. Set with ldflags on release builds.
 	version = "0.2.0"
 
 	// NOTE: The $Format strings are replaced during 'git archive' thanks
@@ -18,10 +18,10 @@ var (
 type Info struct {
 	// Version is the release version of kubetnl. Format follows the rules
 	// of semantic versioning.
-	Version string
+	Version string `json:"version"`
 
 	// GitCommit is the git commit SHA the kubetnl binary was build against.
-	GitCommit string
+	GitCommit string `json:"gitCommit"`
 }
 
 // Get returns the current version information.